@@ -0,0 +1,51 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// checkCommand prints the mode an iptables binary or symlink currently resolves to.
+func checkCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	path := flags.String("path", "", "iptables binary or symlink to inspect (default: iptables in the detected sbin folder)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *path == "" {
+		sbinPath, err := detectBinaryDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		*path = filepath.Join(sbinPath, "iptables")
+	}
+
+	mode, err := iptables.CurrentMode(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(mode)
+	return 0
+}
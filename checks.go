@@ -0,0 +1,66 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// check is a named verification that passes if run doesn't return an error.
+type check struct {
+	name string
+	run  func() error
+	// warning makes a failure of the check not fail the whole run, unless
+	// warnings are treated as errors.
+	warning bool
+}
+
+// runChecks runs all the checks, printing a PASS/FAIL/WARN line for each one
+// and a final summary. It returns true if all checks passed, ignoring the
+// failed warning checks unless warningsAsErrors is set.
+func runChecks(w io.Writer, checks []check, warningsAsErrors bool) bool {
+	failed, warned := 0, 0
+	for _, c := range checks {
+		err := c.run()
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "PASS: %s\n", c.name)
+		case c.warning && !warningsAsErrors:
+			warned++
+			fmt.Fprintf(w, "WARN: %s: %s\n", c.name, err)
+		default:
+			failed++
+			fmt.Fprintf(w, "FAIL: %s: %s\n", c.name, err)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(w, "%d of %d checks failed\n", failed, len(checks))
+		return false
+	}
+	if warned > 0 {
+		fmt.Fprintf(w, "all %d checks passed, with %d warnings\n", len(checks), warned)
+		return true
+	}
+	fmt.Fprintf(w, "all %d checks passed\n", len(checks))
+	return true
+}
+
+// warningsAsErrorsFlag defines the --warnings-as-errors flag in flags, which
+// defaults to the value of IPTABLES_WRAPPER_WARNINGS_AS_ERRORS.
+func warningsAsErrorsFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("warnings-as-errors", envEnabled(warningsAsErrorsEnv), "fail on warnings too, e.g. in CI (default $"+warningsAsErrorsEnv+")")
+}
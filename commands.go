@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/netns"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "unknown"
+
+const usage = `Usage: iptables-wrapper <command>
+
+Commands:
+  check           print the mode the iptables command currently resolves to
+  family-check    check the IPv4 and IPv6 rules use the same mode
+  install         symlink (or copy) the iptables commands to the wrapper
+  mode            print the mode the wrapper would select
+  path            print the path of the xtables-<mode>-multi binary for a mode
+  reset-state     remove the mode cache, so the next runs detect the mode again
+  uninstall       remove the iptables commands symlinked to the wrapper
+  validate-rules  check a ruleset file against the detected mode
+  verify          check the wrapper is installed and ready to be used
+  verify-image    check the image is correctly set up to use the wrapper
+  version         print the iptables-wrapper version
+  whatif          print the mode each detection strategy would pick
+`
+
+// runCommand runs one of the wrapper's own subcommands and returns
+// the exit code.
+func runCommand(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "check":
+		return checkCommand(ctx, args[1:])
+	case "family-check":
+		return familyCheckCommand(ctx, args[1:])
+	case "install":
+		return installCommand(ctx, args[1:])
+	case "mode":
+		return modeCommand(ctx, args[1:])
+	case "path":
+		return pathCommand(ctx, args[1:])
+	case "reset-state":
+		return resetStateCommand(ctx, args[1:])
+	case "uninstall":
+		return uninstallCommand(ctx, args[1:])
+	case "validate-rules":
+		return validateRulesCommand(ctx, args[1:])
+	case "verify":
+		return verifyCommand(ctx, args[1:])
+	case "verify-image":
+		return verifyImageCommand(ctx, args[1:])
+	case "whatif":
+		return whatifCommand(ctx, args[1:])
+	case "version":
+		fmt.Println(version)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// netnsFlag defines the --netns flag in flags, to run the detection of a
+// subcommand in another network namespace.
+func netnsFlag(flags *flag.FlagSet) *string {
+	return flags.String("netns", os.Getenv(netnsEnv), "network namespace to inspect the rules of, e.g. /proc/<pid>/ns/net or /run/netns/<name> (default $"+netnsEnv+" or the current one)")
+}
+
+// inNetns runs fn in the network namespace at path, or in the current one if
+// path is empty.
+func inNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	return netns.Do(path, fn)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// probe is a save command run during detection and its result.
+type probe struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Error   string   `json:"error,omitempty"`
+	Chains  []string `json:"chains"`
+	// File is the name of the file with the raw output.
+	File   string `json:"file"`
+	output []byte
+}
+
+// recordingInstallation wraps an Installation, keeping the output of all
+// the save commands run through it.
+type recordingInstallation struct {
+	iptables.Installation
+	// mu guards probes, since the save commands can run concurrently.
+	mu     sync.Mutex
+	probes []probe
+}
+
+func (r *recordingInstallation) LegacySave(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return r.record("legacy-iptables-save", r.Installation.LegacySave, ctx, out, args)
+}
+
+func (r *recordingInstallation) LegacySaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return r.record("legacy-ip6tables-save", r.Installation.LegacySaveIP6, ctx, out, args)
+}
+
+func (r *recordingInstallation) NFTSave(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return r.record("nft-iptables-save", r.Installation.NFTSave, ctx, out, args)
+}
+
+func (r *recordingInstallation) NFTSaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return r.record("nft-ip6tables-save", r.Installation.NFTSaveIP6, ctx, out, args)
+}
+
+type saveFunc func(ctx context.Context, out *bytes.Buffer, args ...string) error
+
+func (r *recordingInstallation) record(command string, save saveFunc, ctx context.Context, out *bytes.Buffer, args []string) error {
+	start := out.Len()
+	err := save(ctx, out, args...)
+
+	output := append([]byte(nil), out.Bytes()[start:]...)
+	p := probe{
+		Command: command,
+		Args:    args,
+		Chains:  iptables.ParseChains(output),
+		output:  output,
+	}
+	if err != nil {
+		p.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p.File = fmt.Sprintf("%02d-%s.txt", len(r.probes)+1, command)
+	r.probes = append(r.probes, p)
+
+	return err
+}
+
+// decision is the summary of a detection, written as JSON to the debug folder.
+type decision struct {
+	Time     time.Time     `json:"time"`
+	Applet   string        `json:"applet"`
+	SbinPath string        `json:"sbinPath"`
+	Mode     iptables.Mode `json:"mode,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Probes   []probe       `json:"probes"`
+}
+
+// writeDebugArtifacts writes the raw output of every probe and the final decision to a
+// new timestamped folder inside dir, so the reasons behind a decision can be shared.
+// Every file is written atomically.
+func writeDebugArtifacts(dir string, d decision) error {
+	runDir := filepath.Join(dir, fmt.Sprintf("%s-%d", d.Time.UTC().Format("20060102T150405.000000000Z"), os.Getpid()))
+	if err := os.MkdirAll(runDir, 0o755); err != nil {
+		return err
+	}
+
+	for _, p := range d.Probes {
+		if err := files.WriteFileAtomic(filepath.Join(runDir, p.File), p.output, 0o644); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return files.WriteFileAtomic(filepath.Join(runDir, "decision.json"), append(data, '\n'), 0o644)
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+const (
+	// forceModeEnv sets the mode to use, skipping the detection.
+	forceModeEnv = "IPTABLES_MODE"
+	// readOnlyEnv makes the wrapper run the detected mode binary directly
+	// without ever updating the alternatives/symlinks.
+	readOnlyEnv = "IPTABLES_WRAPPER_READONLY"
+	// strictEnv makes the wrapper fail instead of guessing when the
+	// detection results are inconsistent.
+	strictEnv = "IPTABLES_WRAPPER_STRICT"
+	// strictShortEnv is the same as strictEnv.
+	strictShortEnv = "IPTABLES_STRICT"
+	// probePrefixEnv holds a command, split by whitespace, to prefix all
+	// the detection commands with. For example, `nsenter --target 1 --net`.
+	probePrefixEnv = "IPTABLES_WRAPPER_PROBE_PREFIX"
+	// appletFamiliesEnv maps non standard applet names to their IP family,
+	// with the format `name=family,name=family`. For example, `iptables6=ipv6`.
+	appletFamiliesEnv = "IPTABLES_WRAPPER_APPLET_FAMILIES"
+	// printCommandEnv makes the wrapper print the command it would run
+	// instead of running it.
+	printCommandEnv = "IPTABLES_WRAPPER_PRINT_CMD"
+	// independentFamiliesEnv makes the wrapper switch the IPv4 and IPv6
+	// commands to their own detected mode, instead of using the same for both.
+	independentFamiliesEnv = "IPTABLES_WRAPPER_INDEPENDENT_FAMILIES"
+	// authoritativeFamilyEnv sets the IP family, ipv4 or ipv6, whose mode is
+	// used for both families when their kubelet chains disagree.
+	authoritativeFamilyEnv = "IPTABLES_WRAPPER_AUTHORITATIVE_FAMILY"
+	// kernelCmdlineEnv enables reading the mode from the kernel command line
+	// and sets its priority over the detection: first or fallback.
+	kernelCmdlineEnv = "IPTABLES_WRAPPER_KERNEL_CMDLINE"
+	// defaultModeEnv sets the mode to use when it can't be detected:
+	// nft (default), legacy or none to fail instead.
+	defaultModeEnv = "IPTABLES_WRAPPER_DEFAULT_MODE"
+	// childStdoutEnv and childStderrEnv redirect the output of the
+	// re-executed command to the files they point to.
+	childStdoutEnv = "IPTABLES_WRAPPER_CHILD_STDOUT"
+	childStderrEnv = "IPTABLES_WRAPPER_CHILD_STDERR"
+	// metricsFileEnv points to the Prometheus textfile the selected
+	// mode is written to.
+	metricsFileEnv = "IPTABLES_WRAPPER_METRICS_FILE"
+	// noSwitchAppletsEnv is a comma separated list of applets that run the
+	// detected mode directly, without switching it for the whole node.
+	noSwitchAppletsEnv = "IPTABLES_WRAPPER_NO_SWITCH_APPLETS"
+	// nftProbeEnv enables looking for the kubelet chains with `nft list ruleset`.
+	nftProbeEnv = "IPTABLES_WRAPPER_NFT_PROBE"
+	// eventFileEnv points to the file a Kubernetes Event recording the
+	// selected mode is written to.
+	eventFileEnv = "IPTABLES_WRAPPER_EVENT_FILE"
+	// fallbackHintEnv overrides the hint shown when the iptables
+	// binaries can't be redirected.
+	fallbackHintEnv = "IPTABLES_WRAPPER_FALLBACK_HINT"
+	// postSwitchHookEnv holds a command, split by whitespace, to run after
+	// the iptables mode has been switched.
+	postSwitchHookEnv = "IPTABLES_WRAPPER_POST_SWITCH_HOOK"
+	// debugDirEnv points to a folder where the output of the detection
+	// probes and the final decision are dumped for troubleshooting.
+	debugDirEnv = "IPTABLES_WRAPPER_DEBUG_DIR"
+	// allowRecursionEnv disables the recursion guard, allowing the wrapper
+	// to be run from a command it re-executed.
+	allowRecursionEnv = "IPTABLES_WRAPPER_ALLOW_RECURSION"
+	// probeEnvPrefix is the prefix of the variables added, without it, to
+	// the environment of the detection commands only. For example,
+	// IPTABLES_WRAPPER_PROBE_ENV_XTABLES_LOCKFILE sets XTABLES_LOCKFILE.
+	probeEnvPrefix = "IPTABLES_WRAPPER_PROBE_ENV_"
+	// legacyHintChainsEnv is a comma separated list of chains that, when found
+	// in the legacy tables, make the wrapper pick legacy if no kubelet chains
+	// are found.
+	legacyHintChainsEnv = "IPTABLES_WRAPPER_LEGACY_HINT_CHAINS"
+	// outputModeEnv selects whether the output of the re-executed command
+	// is streamed (default) or buffered until it exits.
+	outputModeEnv = "IPTABLES_WRAPPER_OUTPUT_MODE"
+	// lockPolicyEnv selects what to do when the re-executed command fails
+	// because the xtables lock is held: fail (default), retry-N or wait.
+	lockPolicyEnv = "IPTABLES_WRAPPER_LOCK_POLICY"
+	// depthEnv is set by the wrapper in the environment of the commands it
+	// re-executes, to detect when it ends up calling itself.
+	depthEnv = "IPTABLES_WRAPPER_DEPTH"
+	// allTablesEnv makes the detection also look for the kubelet chains in the
+	// nft nat, filter and raw tables when they aren't in the mangle table.
+	allTablesEnv = "IPTABLES_WRAPPER_ALL_TABLES"
+	// matchRegexEnv holds a regular expression looked for in the rules
+	// instead of the kubelet chains.
+	matchRegexEnv = "IPTABLES_WRAPPER_MATCH_REGEX"
+	// detectPatternsEnv is a comma separated list of regular expressions for
+	// the names of the chains to look for instead of the kubelet ones.
+	detectPatternsEnv = "IPTABLES_DETECT_PATTERNS"
+	// warningsAsErrorsEnv makes the diagnostic subcommands fail on warnings.
+	warningsAsErrorsEnv = "IPTABLES_WRAPPER_WARNINGS_AS_ERRORS"
+	// detectTimeoutEnv sets how long each detection command can take, as a
+	// duration like 5s or a number of seconds.
+	detectTimeoutEnv = "IPTABLES_DETECT_TIMEOUT"
+	// probeConcurrencyEnv sets how many detection commands can run at the
+	// same time, 0 for no limit.
+	probeConcurrencyEnv = "IPTABLES_WRAPPER_PROBE_CONCURRENCY"
+	// decisionSocketEnv points to a Unix socket the selected mode is sent to.
+	decisionSocketEnv = "IPTABLES_WRAPPER_DECISION_SOCKET"
+	// sbinDirEnv sets the folder the iptables binaries are in, skipping the
+	// search in the usual folders.
+	sbinDirEnv = "IPTABLES_SBIN_DIR"
+	// logLevelEnv sets the level of the logs written to stderr: error, warn,
+	// info or debug. Nothing is logged by default.
+	logLevelEnv = "IPTABLES_WRAPPER_LOG_LEVEL"
+	// netnsEnv points to the network namespace, like /proc/<pid>/ns/net, the
+	// detection and the iptables command run in, instead of the current one.
+	netnsEnv = "IPTABLES_NETNS"
+	// noVersionCheckEnv makes the wrapper run iptables-nft even if it's a
+	// version with known compatibility bugs.
+	noVersionCheckEnv = "IPTABLES_WRAPPER_NO_VERSION_CHECK"
+	// installModeEnv sets how the install subcommand makes the iptables
+	// commands run the wrapper: symlink (default), copy or hardlink.
+	installModeEnv = "IPTABLES_INSTALL_MODE"
+	// manifestEnv is where the install subcommand writes its manifest, and
+	// the uninstall subcommand reads it from, if it exists.
+	manifestEnv = "IPTABLES_WRAPPER_MANIFEST"
+	// modeCacheTTLEnv enables the mode cache file and sets for how long the
+	// mode written to it is reused, as a duration like 10m or a number of
+	// seconds.
+	modeCacheTTLEnv = "IPTABLES_WRAPPER_MODE_CACHE_TTL"
+	// modeCacheFileEnv overrides the path of the mode cache file.
+	modeCacheFileEnv = "IPTABLES_WRAPPER_MODE_CACHE_FILE"
+)
+
+// envEnabled returns true if the environment variable is set to a
+// true boolean value (1, t, true, etc.).
+func envEnabled(name string) bool {
+	enabled, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && enabled
+}
+
+// strictEnabled checks if the strict mode is enabled through the environment,
+// with either strictEnv or strictShortEnv.
+func strictEnabled() bool {
+	return envEnabled(strictEnv) || envEnabled(strictShortEnv)
+}
+
+// envList parses a comma separated list from an environment variable,
+// ignoring empty entries.
+func envList(name string) []string {
+	var list []string
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// probeEnv returns the variables, in the form "key=value", to add to the
+// environment of the detection commands.
+func probeEnv() []string {
+	var env []string
+	for _, entry := range os.Environ() {
+		if strings.HasPrefix(entry, probeEnvPrefix) && !strings.HasPrefix(entry, probeEnvPrefix+"=") {
+			env = append(env, strings.TrimPrefix(entry, probeEnvPrefix))
+		}
+	}
+	return env
+}
+
+// detectBinaryDir returns the folder the iptables binaries are in: the one set
+// through the environment or, if unset, the first of the usual folders that
+// has them.
+func detectBinaryDir() (string, error) {
+	if dir := os.Getenv(sbinDirEnv); dir != "" {
+		sbinPath, err := iptables.FindBinaryDir([]string{dir})
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %v", sbinDirEnv, err)
+		}
+		slog.Debug("Using the configured iptables binaries folder", "dir", sbinPath)
+		return sbinPath, nil
+	}
+
+	sbinPath, err := iptables.DetectBinaryDir()
+	if err != nil {
+		return "", fmt.Errorf("%v, set %s to the folder they are in", err, sbinDirEnv)
+	}
+	slog.Debug("Found the iptables binaries folder", "dir", sbinPath)
+	return sbinPath, nil
+}
+
+// envDuration parses a duration, like 5s, or a number of seconds from an
+// environment variable. If it's unset, it returns 0.
+func envDuration(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		// Also accept a plain number of seconds.
+		seconds, secondsErr := strconv.ParseFloat(value, 64)
+		if secondsErr != nil {
+			return 0, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must not be negative", name, value)
+	}
+	return duration, nil
+}
+
+// newInstallation builds the Installation used to inspect the rules in
+// sbinPath, with the per command timeout and the number of commands run at the
+// same time configured through the environment.
+func newInstallation(sbinPath string) (iptables.XtablesMulti, error) {
+	installation := iptables.NewXtablesMultiInstallation(sbinPath)
+	if value := os.Getenv(probeConcurrencyEnv); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 0 {
+			return installation, fmt.Errorf("invalid %s %q, must be a number of commands, or 0 for no limit", probeConcurrencyEnv, value)
+		}
+		installation = installation.WithProbeConcurrency(concurrency)
+	}
+	if os.Getenv(detectTimeoutEnv) == "" {
+		return installation, nil
+	}
+	timeout, err := envDuration(detectTimeoutEnv)
+	if err != nil {
+		return installation, err
+	}
+	return installation.WithTimeout(timeout), nil
+}
+
+// authoritativeFamily parses the authoritative IP family from the environment,
+// empty if it's not configured.
+func authoritativeFamily() (iptables.Family, error) {
+	value := os.Getenv(authoritativeFamilyEnv)
+	if value == "" {
+		return "", nil
+	}
+	family, err := iptables.ParseFamily(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", authoritativeFamilyEnv, err)
+	}
+	return family, nil
+}
+
+// appletFamilies parses the applet to IP family overrides from the environment.
+func appletFamilies() (map[string]iptables.Family, error) {
+	value := os.Getenv(appletFamiliesEnv)
+	if value == "" {
+		return nil, nil
+	}
+
+	families := map[string]iptables.Family{}
+	for _, entry := range strings.Split(value, ",") {
+		applet, familyStr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || applet == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected <applet>=<family>", appletFamiliesEnv, entry)
+		}
+		family, err := iptables.ParseFamily(familyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %v", appletFamiliesEnv, entry, err)
+		}
+		families[applet] = family
+	}
+
+	return families, nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+func TestAppletFamilies(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    map[string]iptables.Family
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "iptables6=ipv6", want: map[string]iptables.Family{"iptables6": iptables.IPv6}},
+		{
+			value: "iptables6=ipv6, legacy-ip6tables=ipv4",
+			want:  map[string]iptables.Family{"iptables6": iptables.IPv6, "legacy-ip6tables": iptables.IPv4},
+		},
+		{value: "iptables6", wantErr: true},
+		{value: "=ipv6", wantErr: true},
+		{value: "iptables6=ipv5", wantErr: true},
+		{value: "iptables6=ipv6,", wantErr: true},
+	} {
+		t.Setenv(appletFamiliesEnv, tc.value)
+		got, err := appletFamilies()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("appletFamilies() with %q: got error %v, want error %v", tc.value, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("appletFamilies() with %q = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestAppletFamiliesOverrideDefaults(t *testing.T) {
+	t.Setenv(appletFamiliesEnv, "iptables6=ipv6,ip6tables-v4=ipv4")
+	families, err := appletFamilies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for applet, want := range map[string]iptables.Family{
+		"/usr/sbin/iptables6": iptables.IPv6,
+		"ip6tables-v4":        iptables.IPv4,
+		"ip6tables":           iptables.IPv6,
+		"iptables-save":       iptables.IPv4,
+		"unknown":             iptables.IPv4,
+	} {
+		if got := iptables.AppletFamily(applet, families); got != want {
+			t.Errorf("AppletFamily(%q) = %s, want %s", applet, got, want)
+		}
+	}
+}
+
+func TestNewInstallationProbeConcurrency(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "2"},
+		{value: "0"},
+		{value: "-1", wantErr: true},
+		{value: "many", wantErr: true},
+	} {
+		t.Setenv(probeConcurrencyEnv, tc.value)
+		if _, err := newInstallation(t.TempDir()); (err != nil) != tc.wantErr {
+			t.Errorf("newInstallation() with %s=%q: got error %v, want error %v", probeConcurrencyEnv, tc.value, err, tc.wantErr)
+		}
+	}
+}
+
+func TestStrictEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		wrapper, short string
+		want           bool
+	}{
+		{want: false},
+		{wrapper: "1", want: true},
+		{short: "1", want: true},
+		{wrapper: "0", short: "true", want: true},
+		{wrapper: "false", short: "0", want: false},
+	} {
+		t.Setenv(strictEnv, tc.wrapper)
+		t.Setenv(strictShortEnv, tc.short)
+		if got := strictEnabled(); got != tc.want {
+			t.Errorf("strictEnabled() with %s=%q and %s=%q = %v, want %v", strictEnv, tc.wrapper, strictShortEnv, tc.short, got, tc.want)
+		}
+	}
+}
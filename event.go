@@ -0,0 +1,93 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// nodeNameEnv is the environment variable usually populated with the node
+// name through the downward API.
+const nodeNameEnv = "NODE_NAME"
+
+// event is the subset of a Kubernetes core/v1 Event written by the wrapper.
+// We don't depend on the Kubernetes API packages to keep the wrapper small.
+type event struct {
+	APIVersion     string        `json:"apiVersion"`
+	Kind           string        `json:"kind"`
+	Metadata       eventMetadata `json:"metadata"`
+	InvolvedObject eventObject   `json:"involvedObject"`
+	Reason         string        `json:"reason"`
+	Message        string        `json:"message"`
+	Type           string        `json:"type"`
+	Source         eventSource   `json:"source"`
+	FirstTimestamp time.Time     `json:"firstTimestamp"`
+	LastTimestamp  time.Time     `json:"lastTimestamp"`
+	Count          int           `json:"count"`
+}
+
+type eventMetadata struct {
+	GenerateName string `json:"generateName"`
+}
+
+type eventObject struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type eventSource struct {
+	Component string `json:"component"`
+	Host      string `json:"host,omitempty"`
+}
+
+// writeModeEvent writes a Kubernetes Event for the Node, recording the selected mode,
+// to path. It's meant to be picked up by a sidecar that creates it in the API server,
+// so the wrapper itself never talks to the API. The node name is taken from NODE_NAME,
+// falling back to the hostname.
+func writeModeEvent(path string, mode iptables.Mode) error {
+	node := os.Getenv(nodeNameEnv)
+	if node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		node = hostname
+	}
+
+	now := time.Now().UTC()
+	e := event{
+		APIVersion:     "v1",
+		Kind:           "Event",
+		Metadata:       eventMetadata{GenerateName: wrapperBinaryName + "-"},
+		InvolvedObject: eventObject{Kind: "Node", Name: node},
+		Reason:         "IPTablesModeSelected",
+		Message:        "iptables-wrapper selected iptables " + string(mode) + " mode",
+		Type:           "Normal",
+		Source:         eventSource{Component: wrapperBinaryName, Host: node},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return files.WriteFileAtomic(path, append(data, '\n'), 0o644)
+}
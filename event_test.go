@@ -0,0 +1,96 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// decodedEvent is the part of the written Event checked by the tests, decoded
+// from the JSON field names the API server expects.
+type decodedEvent struct {
+	APIVersion     string `json:"apiVersion"`
+	Kind           string `json:"kind"`
+	InvolvedObject struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"involvedObject"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Source  struct {
+		Component string `json:"component"`
+		Host      string `json:"host"`
+	} `json:"source"`
+	Count int `json:"count"`
+}
+
+func readModeEvent(t *testing.T, mode iptables.Mode) decodedEvent {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "event.json")
+	if err := writeModeEvent(path, mode); err != nil {
+		t.Fatalf("writeModeEvent() failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e decodedEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	return e
+}
+
+func TestWriteModeEvent(t *testing.T) {
+	t.Setenv(nodeNameEnv, "node-1")
+	e := readModeEvent(t, iptables.NFT)
+
+	if e.APIVersion != "v1" || e.Kind != "Event" || e.Type != "Normal" || e.Count != 1 {
+		t.Errorf("got apiVersion %q, kind %q, type %q, count %d, want a v1 Normal Event with count 1", e.APIVersion, e.Kind, e.Type, e.Count)
+	}
+	if e.InvolvedObject.Kind != "Node" || e.InvolvedObject.Name != "node-1" {
+		t.Errorf("got involvedObject %+v, want Node node-1", e.InvolvedObject)
+	}
+	if e.Reason != "IPTablesModeSelected" {
+		t.Errorf("got reason %q, want IPTablesModeSelected", e.Reason)
+	}
+	if e.Message != "iptables-wrapper selected iptables nft mode" {
+		t.Errorf("got message %q", e.Message)
+	}
+	if e.Source.Component != wrapperBinaryName || e.Source.Host != "node-1" {
+		t.Errorf("got source %+v, want %s on node-1", e.Source, wrapperBinaryName)
+	}
+}
+
+func TestWriteModeEventHostnameFallback(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no hostname: %v", err)
+	}
+	t.Setenv(nodeNameEnv, "")
+	e := readModeEvent(t, iptables.Legacy)
+
+	if e.InvolvedObject.Name != hostname || e.Source.Host != hostname {
+		t.Errorf("got involvedObject %q and source.host %q, want the hostname %q", e.InvolvedObject.Name, e.Source.Host, hostname)
+	}
+	if e.Message != "iptables-wrapper selected iptables legacy mode" {
+		t.Errorf("got message %q", e.Message)
+	}
+}
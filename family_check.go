@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// exitFamiliesDisagree is the exit code used by family-check when the IPv4 and
+// IPv6 rules were created with different modes.
+const exitFamiliesDisagree = 4
+
+// familyCheckCommand detects the mode of the IPv4 and IPv6 rules independently
+// and prints both. It fails if they disagree.
+func familyCheckCommand(ctx context.Context, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: family-check doesn't accept arguments\n")
+		return 2
+	}
+
+	sbinPath, err := detectBinaryDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	installation, err := newInstallation(sbinPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	detector, err := newDetector(installation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	modes := map[iptables.Family]iptables.Mode{}
+	for _, family := range []iptables.Family{iptables.IPv4, iptables.IPv6} {
+		mode, found := detector.FamilyMode(ctx, family)
+		if !found {
+			fmt.Printf("%s: no kubelet chains found\n", family)
+			continue
+		}
+		modes[family] = mode
+		fmt.Printf("%s: %s\n", family, mode)
+	}
+
+	// A family without kubelet chains can't disagree with the other one.
+	if v4Mode, v6Mode := modes[iptables.IPv4], modes[iptables.IPv6]; v4Mode != "" && v6Mode != "" && v4Mode != v6Mode {
+		fmt.Fprintf(os.Stderr, "Error: IPv4 rules are in %s mode but IPv6 rules are in %s mode\n", v4Mode, v6Mode)
+		return exitFamiliesDisagree
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/commands"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// hookModeEnv is the environment variable the post switch hook receives
+// the new mode in.
+const hookModeEnv = "IPTABLES_WRAPPER_MODE"
+
+// runPostSwitchHook runs the command configured as post switch hook, if any, after
+// the iptables mode has been switched. The new mode is passed both as the last
+// argument and in IPTABLES_WRAPPER_MODE. The hook's stdout is sent to stderr, since
+// stdout belongs to the iptables command.
+func runPostSwitchHook(ctx context.Context, mode iptables.Mode) error {
+	hook := strings.Fields(os.Getenv(postSwitchHookEnv))
+	if len(hook) == 0 {
+		return nil
+	}
+
+	c := exec.CommandContext(ctx, hook[0], append(hook[1:], string(mode))...)
+	c.Env = append(os.Environ(), hookModeEnv+"="+string(mode))
+	c.Stdout = os.Stderr
+	return commands.RunAndReadError(c)
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+	"github.com/kubernetes-sigs/iptables-wrappers/pkg/install"
+)
+
+// installPresets are the named subsets of the iptables commands that can be
+// installed with --preset.
+var installPresets = map[string][]string{
+	"all":          iptables.Commands,
+	"save-restore": {"iptables-save", "iptables-restore", "ip6tables-save", "ip6tables-restore"},
+	"ipv4":         {"iptables", "iptables-save", "iptables-restore"},
+	"ipv6":         {"ip6tables", "ip6tables-save", "ip6tables-restore"},
+}
+
+// installCommand symlinks all the iptables commands to the wrapper binary.
+func installCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("install", flag.ContinueOnError)
+	dir := flags.String("dir", "", "folder where the iptables commands are installed (default: detected sbin folder)")
+	wrapperPath := flags.String("wrapper", "", "path to the wrapper binary (default: this binary)")
+	takeover := flags.Bool("takeover-alternatives", false, "replace iptables commands managed by alternatives instead of skipping them")
+	verifySelf := flags.Bool("verify-self", false, "check the wrapper binary is executable and statically linked before installing it")
+	bindir := flags.String("bindir", "", "dedicated folder, to be prepended to PATH, where the iptables commands are created, leaving the sbin folder untouched")
+	arpEbtables := flags.Bool("arp-ebtables", false, "also link the arptables and ebtables commands")
+	preset := flags.String("preset", "all", "commands to install: all, save-restore (only the save and restore commands), ipv4 or ipv6")
+	linkModeName := flags.String("mode", installModeDefault(), "how the commands run the wrapper: symlink, or copy or hardlink for filesystems that don't keep symlinks (default $"+installModeEnv+" or symlink)")
+	filePerm := flags.String("file-mode", "", "permissions of the copies of the wrapper with --mode copy, in octal like 0755 (default: the wrapper's)")
+	manifest := flags.String("manifest", os.Getenv(manifestEnv), "write the list of commands pointed at the wrapper, and what they replaced, to this file, for uninstall (default $"+manifestEnv+")")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	linkMode, err := install.ParseLinkMode(*linkModeName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	var perm os.FileMode
+	if *filePerm != "" {
+		if linkMode != install.Copy {
+			fmt.Fprintf(os.Stderr, "Error: --file-mode only applies to the %s link mode\n", install.Copy)
+			return 2
+		}
+		parsed, err := strconv.ParseUint(*filePerm, 8, 32)
+		if err != nil || parsed == 0 || parsed > 0o777 {
+			fmt.Fprintf(os.Stderr, "Error: invalid --file-mode %q, must be octal permissions like 0755\n", *filePerm)
+			return 2
+		}
+		perm = os.FileMode(parsed)
+	}
+
+	commands, ok := installPresets[*preset]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown preset %q, must be all, save-restore, ipv4 or ipv6\n", *preset)
+		return 2
+	}
+
+	if *bindir != "" {
+		if *dir != "" {
+			fmt.Fprintln(os.Stderr, "Error: --dir and --bindir can't be used together")
+			return 2
+		}
+		// PATH entries should be absolute, so the printed hint works from any folder.
+		abs, err := filepath.Abs(*bindir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		*bindir = abs
+		if err := os.MkdirAll(*bindir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		*dir = *bindir
+	} else if *dir == "" {
+		sbinPath, err := detectBinaryDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		*dir = sbinPath
+	}
+
+	if *wrapperPath == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: finding wrapper binary: %s\n", err)
+			return 1
+		}
+		*wrapperPath = executable
+	}
+
+	if *verifySelf && !runChecks(os.Stdout, wrapperChecks(*wrapperPath), false) {
+		fmt.Fprintf(os.Stderr, "Error: %s can't be installed\n", *wrapperPath)
+		return 1
+	}
+
+	links, err := install.NewSymlinker(*dir, *wrapperPath).WithAlternativesTakeover(*takeover).WithCommands(commands).WithArpEbtables(*arpEbtables).WithLinkMode(linkMode).WithFilePerm(perm).WithBackup(*manifest != "").WithLogf(warnf).LinkAll(ctx)
+	var created, updated, unchanged, skipped int
+	var installed []install.Link
+	for _, link := range links {
+		if link.Skipped == "" {
+			installed = append(installed, link)
+		}
+		switch {
+		case link.Skipped != "":
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: %s, use --takeover-alternatives to replace it\n", link.Path, link.Skipped)
+			skipped++
+		case link.Unchanged:
+			unchanged++
+		case link.Updated:
+			fmt.Printf("%s -> %s (updated)\n", link.Path, link.Target)
+			updated++
+		default:
+			fmt.Printf("%s -> %s\n", link.Path, link.Target)
+			created++
+		}
+	}
+	fmt.Printf("%d created, %d updated, %d unchanged, %d skipped\n", created, updated, unchanged, skipped)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	if *manifest != "" {
+		m := install.Manifest{Version: version, AltStyle: install.AltStyleNone, Links: installed}
+		if err := install.WriteManifest(*manifest, m); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: writing manifest: %s\n", err)
+			return 1
+		}
+	}
+
+	if *bindir != "" {
+		fmt.Printf("\nThe iptables commands in %s are only used if it comes first in PATH, e.g.:\n", *bindir)
+		fmt.Printf("  export PATH=%s:$PATH\n", *bindir)
+	}
+
+	return 0
+}
+
+// installModeDefault returns the link mode configured through the environment,
+// or symlink if unset.
+func installModeDefault() string {
+	if mode := os.Getenv(installModeEnv); mode != "" {
+		return mode
+	}
+	return string(install.Symlink)
+}
+
+// wrapperChecks returns the checks that make sure the wrapper binary at path can
+// run in any image, including distroless ones without a dynamic loader.
+func wrapperChecks(path string) []check {
+	return []check{
+		{
+			name: "wrapper is executable",
+			run: func() error {
+				if !files.ExecutableExists(path) {
+					return fmt.Errorf("%s is not executable", path)
+				}
+				return nil
+			},
+		},
+		{
+			name: "wrapper is statically linked",
+			run: func() error {
+				static, err := files.StaticallyLinked(path)
+				if err != nil {
+					return err
+				}
+				if !static {
+					return fmt.Errorf("%s is dynamically linked, build it with CGO_ENABLED=0", path)
+				}
+				return nil
+			},
+		},
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package files
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file in the same folder as path
+// and then renames it to path, so readers never see a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// This is a no-op if the rename succeeded.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// SymlinkAtomic creates a symlink to target at path, replacing whatever is
+// there. The symlink is created with a temporary name in the same folder and
+// then renamed to path, so path never stops existing while it's replaced.
+func SymlinkAtomic(target, path string) error {
+	for {
+		// Reserve a unique name, then replace it with the symlink. If someone
+		// else takes the name in between, try again with another one.
+		tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		if err := os.Remove(tmp.Name()); err != nil {
+			return err
+		}
+
+		err = os.Symlink(target, tmp.Name())
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		return nil
+	}
+}
+
+// CopyFileAtomic copies the file at src to path, replacing whatever is there
+// and keeping the permissions of src, like the executable bit. The copy is
+// written with a temporary name in the same folder and then renamed to path,
+// so path never stops existing while it's replaced.
+func CopyFileAtomic(src, path string) error {
+	return CopyFileAtomicPerm(src, path, 0)
+}
+
+// CopyFileAtomicPerm is like CopyFileAtomic, but the copy gets the permissions
+// perm instead of the ones of src. With 0, it keeps them like CopyFileAtomic.
+func CopyFileAtomicPerm(src, path string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if perm == 0 {
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// This is a no-op if the rename succeeded.
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LinkAtomic creates a hard link to target at path, replacing whatever is
+// there. Like SymlinkAtomic, the link is created with a temporary name in the
+// same folder and then renamed to path. Both must be in the same filesystem.
+func LinkAtomic(target, path string) error {
+	for {
+		tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		if err := os.Remove(tmp.Name()); err != nil {
+			return err
+		}
+
+		err = os.Link(target, tmp.Name())
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package files
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// StaticallyLinked checks if the ELF binary at path can run without a dynamic
+// loader, that is, it doesn't request an interpreter nor depend on any shared
+// library.
+func StaticallyLinked(path string) (bool, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("reading %s as an ELF binary: %v", path, err)
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return false, nil
+		}
+	}
+
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return false, fmt.Errorf("reading %s dynamic libraries: %v", path, err)
+	}
+	return len(libs) == 0, nil
+}
@@ -13,10 +13,62 @@ limitations under the License.
 
 package files
 
-import "os"
+import (
+	"bytes"
+	"io"
+	"os"
+)
 
 // ExecutableExists checks if a file exists and it's executable by someone.
 func ExecutableExists(path string) bool {
 	stat, err := os.Stat(path)
 	return err == nil && stat.Mode()&0o111 != 0
 }
+
+// SameContent checks if the files at a and b, following symlinks, have the
+// same content. That's always the case if they are the same file.
+func SameContent(a, b string) (bool, error) {
+	fileA, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fileA.Close()
+	fileB, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fileB.Close()
+
+	infoA, err := fileA.Stat()
+	if err != nil {
+		return false, err
+	}
+	infoB, err := fileB.Stat()
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(infoA, infoB) {
+		return true, nil
+	}
+	if !infoA.Mode().IsRegular() || !infoB.Mode().IsRegular() || infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		nA, errA := io.ReadFull(fileA, bufA)
+		nB, errB := io.ReadFull(fileB, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrLockTimeout is returned by Lock when the lock is still held by someone
+// else after the timeout.
+var ErrLockTimeout = errors.New("timed out waiting for the lock")
+
+// lockPollInterval is how often Lock tries to take a contended lock again.
+const lockPollInterval = 50 * time.Millisecond
+
+// Lock takes an exclusive advisory lock (flock) on the file at path, creating
+// it if needed, and returns the function that releases it. If someone else
+// holds the lock, onContended, if not nil, is called once and Lock keeps
+// trying for up to timeout before returning ErrLockTimeout.
+func Lock(ctx context.Context, path string, timeout time.Duration, onContended func()) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for contended := false; ; contended = true {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			// Closing the file releases the lock.
+			return func() { f.Close() }, nil
+		}
+		if !contended && onContended != nil {
+			onContended()
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("locking %s: %w after %s", path, ErrLockTimeout, timeout)
+			}
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -15,34 +15,122 @@ package iptables
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 
-	"github.com/kubernetes-sigs/iptables-wrappers/internal/commands"
 	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
 )
 
+// AlternativesDir is where both update-alternatives and alternatives keep the
+// symlinks to the selected alternatives, e.g. /usr/sbin/iptables -> /etc/alternatives/iptables.
+const AlternativesDir = "/etc/alternatives"
+
+// Commands is the list of iptables commands that are redirected to the
+// binaries of the selected mode.
+var Commands = []string{"iptables", "iptables-save", "iptables-restore", "ip6tables", "ip6tables-save", "ip6tables-restore"}
+
+// ArpEbtablesCommands is the list of arptables and ebtables commands, which
+// have the same legacy/nft split. They aren't managed by the alternatives, so
+// they are always run directly with the binary of the selected mode.
+var ArpEbtablesCommands = []string{"arptables", "arptables-save", "arptables-restore", "ebtables", "ebtables-save", "ebtables-restore"}
+
+// IsArpEbtablesCommand checks if applet, given its name or path, is one of
+// the ArpEbtablesCommands.
+func IsArpEbtablesCommand(applet string) bool {
+	applet = filepath.Base(applet)
+	for _, cmd := range ArpEbtablesCommands {
+		if cmd == applet {
+			return true
+		}
+	}
+	return false
+}
+
 // AlternativeSelector allows to configure a system to use iptables in
 // nft or legacy mode.
 type AlternativeSelector interface {
 	// UseMode configures the system to use the selected iptables mode.
 	UseMode(ctx context.Context, mode Mode) error
+	// UseFamilyMode configures the system to use the selected iptables mode
+	// only for the commands of the given IP family.
+	UseFamilyMode(ctx context.Context, family Family, mode Mode) error
 }
 
 // BuildAlternativeSelector builds the proper iptablesAlternativeSelector depending
 // on the machine's setup. It will use either `alternatives` or `update-alternatives` if present
-// in the sbin folder. If none is present, it will manage iptables binaries by manually
-// creating symlinks.
+// in the sbin folder. If none is present, or if they fail, it will manage iptables binaries by
+// manually creating symlinks.
 func BuildAlternativeSelector(sbinPath string) AlternativeSelector {
+	return BuildAlternativeSelectorWithRunner(sbinPath, ExecRunner{}, nil, nil, nil)
+}
+
+// BuildAlternativeSelectorWithRunner is like BuildAlternativeSelector, but the
+// `alternatives` and `update-alternatives` commands are run with runner. If
+// logf is not nil, it's told when they fail and the symlinks are created instead.
+// The symlinks for each IP family are the commands AppletFamily assigns to it
+// with families as overrides. The selector logs to logger or, if it's nil, to
+// slog.Default().
+func BuildAlternativeSelectorWithRunner(sbinPath string, runner CommandRunner, logf func(format string, args ...interface{}), families map[string]Family, logger *slog.Logger) AlternativeSelector {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	symlinks := symlinkSelector{sbinPath: sbinPath, alternativesDir: AlternativesDir, families: families}
 	if files.ExecutableExists(filepath.Join(sbinPath, "alternatives")) {
-		return alternativesSelector{sbinPath: sbinPath}
+		logger.Debug("Selecting the iptables mode with alternatives")
+		return symlinkFallbackSelector{selector: alternativesSelector{sbinPath: sbinPath, runner: runner}, name: "alternatives", symlinks: symlinks, logf: logf, logger: logger}
 	} else if files.ExecutableExists(filepath.Join(sbinPath, "update-alternatives")) {
-		return updateAlternativesSelector{sbinPath: sbinPath}
+		logger.Debug("Selecting the iptables mode with update-alternatives")
+		return symlinkFallbackSelector{selector: updateAlternativesSelector{sbinPath: sbinPath, runner: runner}, name: "update-alternatives", symlinks: symlinks, logf: logf, logger: logger}
 	} else {
 		// if we don't find any tool to managed the alternatives, handle it manually with symlinks
-		return symlinkSelector{sbinPath: sbinPath}
+		logger.Debug("Selecting the iptables mode with symlinks")
+		return symlinks
+	}
+}
+
+// errIndependentFamilies is returned by the selectors that can't configure the
+// commands of each IP family on their own. Falling back to symlinks would only
+// break the structure they manage.
+var errIndependentFamilies = errors.New("can't configure the IP families independently")
+
+// symlinkFallbackSelector uses selector and, if it fails, e.g. because the
+// alternatives database is corrupt, it creates the symlinks directly so the
+// commands still point to the binaries of the selected mode.
+type symlinkFallbackSelector struct {
+	selector AlternativeSelector
+	// name is the name of the command selector runs.
+	name     string
+	symlinks symlinkSelector
+	logf     func(format string, args ...interface{})
+	logger   *slog.Logger
+}
+
+func (f symlinkFallbackSelector) UseMode(ctx context.Context, mode Mode) error {
+	err := f.selector.UseMode(ctx, mode)
+	if err == nil || errors.Is(err, errIndependentFamilies) {
+		return err
+	}
+	f.log("%s failed, creating the symlinks for mode %s instead: %v", f.name, mode, err)
+	f.logger.Debug("Selecting the iptables mode with symlinks")
+	return f.symlinks.UseMode(ctx, mode)
+}
+
+func (f symlinkFallbackSelector) UseFamilyMode(ctx context.Context, family Family, mode Mode) error {
+	err := f.selector.UseFamilyMode(ctx, family, mode)
+	if err == nil || errors.Is(err, errIndependentFamilies) {
+		return err
+	}
+	f.log("%s failed, creating the %s symlinks for mode %s instead: %v", f.name, family, mode, err)
+	f.logger.Debug("Selecting the iptables mode with symlinks", "family", family)
+	return f.symlinks.UseFamilyMode(ctx, family, mode)
+}
+
+func (f symlinkFallbackSelector) log(format string, args ...interface{}) {
+	if f.logf != nil {
+		f.logf(format, args...)
 	}
 }
 
@@ -50,17 +138,25 @@ func BuildAlternativeSelector(sbinPath string) AlternativeSelector {
 // This is most common for debian based OSs.
 type updateAlternativesSelector struct {
 	sbinPath string
+	runner   CommandRunner
 }
 
 func (u updateAlternativesSelector) UseMode(ctx context.Context, mode Mode) error {
-	modeStr := string(mode)
+	if err := u.UseFamilyMode(ctx, IPv4, mode); err != nil {
+		return err
+	}
+	return u.UseFamilyMode(ctx, IPv6, mode)
+}
 
-	if err := commands.RunAndReadError(exec.CommandContext(ctx, "update-alternatives", "--set", "iptables", filepath.Join(u.sbinPath, "iptables-"+modeStr))); err != nil {
-		return fmt.Errorf("update-alternatives iptables to mode %s: %v", modeStr, err)
+func (u updateAlternativesSelector) UseFamilyMode(ctx context.Context, family Family, mode Mode) error {
+	modeStr := string(mode)
+	name := "iptables"
+	if family == IPv6 {
+		name = "ip6tables"
 	}
 
-	if err := commands.RunAndReadError(exec.CommandContext(ctx, "update-alternatives", "--set", "ip6tables", filepath.Join(u.sbinPath, "ip6tables-"+modeStr))); err != nil {
-		return fmt.Errorf("update-alternatives ip6tables to mode %s: %v", modeStr, err)
+	if _, err := u.runner.Run(ctx, "update-alternatives", "--set", name, filepath.Join(u.sbinPath, name+"-"+modeStr)); err != nil {
+		return fmt.Errorf("update-alternatives %s to mode %s: %v", name, modeStr, err)
 	}
 
 	return nil
@@ -70,37 +166,86 @@ func (u updateAlternativesSelector) UseMode(ctx context.Context, mode Mode) erro
 // This is most common for fedora based OSs.
 type alternativesSelector struct {
 	sbinPath string
+	runner   CommandRunner
 }
 
 func (a alternativesSelector) UseMode(ctx context.Context, mode Mode) error {
-	if err := commands.RunAndReadError(exec.CommandContext(ctx, "alternatives", "--set", "iptables", filepath.Join(a.sbinPath, "iptables-"+string(mode)))); err != nil {
+	if _, err := a.runner.Run(ctx, "alternatives", "--set", "iptables", filepath.Join(a.sbinPath, "iptables-"+string(mode))); err != nil {
 		return fmt.Errorf("alternatives to update iptables to mode %s: %v", string(mode), err)
 	}
 	return nil
 }
 
+func (a alternativesSelector) UseFamilyMode(ctx context.Context, family Family, mode Mode) error {
+	// The ip6tables commands are slaves of the iptables alternative, so both
+	// families can't be configured independently.
+	return fmt.Errorf("alternatives %w, needed to switch the %s commands to mode %s", errIndependentFamilies, family, mode)
+}
+
 // symlinkSelector  manages an iptables setup by manually creating symlinks
 // that point to the proper "mode" binaries.
 // It configures: `iptables`, `iptables-save`, `iptables-restore`,
 // `ip6tables`, `ip6tables-save` and `ip6tables-restore`.
+// If the commands are links to an alternatives folder, the links in that
+// folder are the ones updated. If they are regular files, like the wrapper
+// installed in the copy or hardlink link modes, they stay regular files,
+// since the filesystem may not keep symlinks.
 type symlinkSelector struct {
-	sbinPath string
+	sbinPath        string
+	alternativesDir string
+	// families overrides the IP family of the commands, see AppletFamily.
+	families map[string]Family
 }
 
 func (s symlinkSelector) UseMode(ctx context.Context, mode Mode) error {
+	if err := s.UseFamilyMode(ctx, IPv4, mode); err != nil {
+		return err
+	}
+	return s.UseFamilyMode(ctx, IPv6, mode)
+}
+
+func (s symlinkSelector) UseFamilyMode(ctx context.Context, family Family, mode Mode) error {
 	modeStr := string(mode)
-	xtablesForModePath := XtablesPath(s.sbinPath, mode)
-	cmds := []string{"iptables", "iptables-save", "iptables-restore", "ip6tables", "ip6tables-save", "ip6tables-restore"}
 
-	for _, cmd := range cmds {
-		cmdPath := filepath.Join(s.sbinPath, cmd)
-		// If deleting fails, ignore it and try to create symlink regardless
-		_ = os.RemoveAll(cmdPath)
+	for _, cmd := range Commands {
+		if AppletFamily(cmd, s.families) != family {
+			continue
+		}
 
-		if err := os.Symlink(xtablesForModePath, cmdPath); err != nil {
+		cmdPath := filepath.Join(s.sbinPath, cmd)
+		// If the command is managed through the alternatives folder, but the alternatives
+		// binary is not available, update the link there to keep the same structure.
+		if target, err := os.Readlink(cmdPath); err == nil && filepath.Dir(target) == s.alternativesDir {
+			cmdPath = target
+		}
+		// Replace the command atomically, so concurrent invocations never find
+		// it missing, e.g. kube-proxy starting while the mode is switched.
+		binary, _ := ModeBinary(s.sbinPath, mode, cmd)
+		if info, err := os.Lstat(cmdPath); err == nil && info.Mode().IsRegular() {
+			if err := replaceRegularFile(binary, cmdPath); err != nil {
+				return fmt.Errorf("replacing %s for mode %s: %v", cmd, modeStr, err)
+			}
+			continue
+		}
+		if err := files.SymlinkAtomic(binary, cmdPath); err != nil {
 			return fmt.Errorf("creating %s symlink for mode %s: %v", cmd, modeStr, err)
 		}
 	}
 
 	return nil
 }
+
+// replaceRegularFile replaces the regular file at path with binary, as a hard
+// link if possible, so it doesn't take any extra space, or as a copy if it's in
+// another filesystem. Both are replaced atomically, like the symlinks.
+func replaceRegularFile(binary, path string) error {
+	// A hard link to a symlink would still be a symlink.
+	resolved, err := filepath.EvalSymlinks(binary)
+	if err != nil {
+		return err
+	}
+	if err := files.LinkAtomic(resolved, path); err == nil {
+		return nil
+	}
+	return files.CopyFileAtomic(resolved, path)
+}
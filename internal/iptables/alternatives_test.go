@@ -0,0 +1,91 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newSbin returns a folder with both xtables multi binaries.
+func newSbin(t *testing.T) string {
+	sbinPath := t.TempDir()
+	for _, name := range []string{"xtables-nft-multi", "xtables-legacy-multi"} {
+		if err := os.WriteFile(filepath.Join(sbinPath, name), []byte("#!/bin/sh\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sbinPath
+}
+
+func TestSymlinkSelectorFamilyOverrides(t *testing.T) {
+	sbinPath := newSbin(t)
+	selector := symlinkSelector{sbinPath: sbinPath, alternativesDir: t.TempDir(), families: map[string]Family{"iptables-save": IPv6}}
+	if err := selector.UseMode(context.Background(), Legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := selector.UseFamilyMode(context.Background(), IPv6, NFT); err != nil {
+		t.Fatal(err)
+	}
+
+	for cmd, want := range map[string]string{
+		"iptables":          "xtables-legacy-multi",
+		"iptables-save":     "xtables-nft-multi",
+		"iptables-restore":  "xtables-legacy-multi",
+		"ip6tables":         "xtables-nft-multi",
+		"ip6tables-save":    "xtables-nft-multi",
+		"ip6tables-restore": "xtables-nft-multi",
+	} {
+		target, err := os.Readlink(filepath.Join(sbinPath, cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(target) != want {
+			t.Errorf("%s -> %s, want %s", cmd, target, want)
+		}
+	}
+}
+
+func TestSymlinkSelectorRegularFiles(t *testing.T) {
+	sbinPath := newSbin(t)
+	// Copies of the wrapper, as installed in the copy link mode.
+	for _, cmd := range Commands {
+		if err := os.WriteFile(filepath.Join(sbinPath, cmd), []byte("wrapper"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	selector := symlinkSelector{sbinPath: sbinPath, alternativesDir: t.TempDir()}
+	if err := selector.UseMode(context.Background(), NFT); err != nil {
+		t.Fatal(err)
+	}
+
+	binary, err := os.Stat(filepath.Join(sbinPath, "xtables-nft-multi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range Commands {
+		info, err := os.Lstat(filepath.Join(sbinPath, cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("%s is %v, want a regular file", cmd, info.Mode())
+		}
+		if !os.SameFile(info, binary) {
+			t.Errorf("%s isn't a hard link to xtables-nft-multi", cmd)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// KernelCmdlinePath is the file exposing the kernel command line.
+	KernelCmdlinePath = "/proc/cmdline"
+	// kernelCmdlineModeParam is the kernel command line parameter used
+	// to set the iptables mode, e.g. `iptables_wrapper.mode=nft`.
+	kernelCmdlineModeParam = "iptables_wrapper.mode"
+)
+
+// ModeFromKernelCmdline reads the kernel command line from path and returns
+// the mode set with the `iptables_wrapper.mode` parameter. It returns false if
+// the parameter is not present. As the kernel does, if the parameter is repeated
+// the last value wins.
+func ModeFromKernelCmdline(path string) (Mode, bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	var value string
+	found := false
+	for _, token := range strings.Fields(string(content)) {
+		if strings.HasPrefix(token, kernelCmdlineModeParam+"=") {
+			value = strings.Trim(strings.TrimPrefix(token, kernelCmdlineModeParam+"="), `"`)
+			found = true
+		}
+	}
+	if !found {
+		return "", false, nil
+	}
+
+	mode, err := ParseMode(value)
+	if err != nil {
+		return "", false, fmt.Errorf("parsing %s in %s: %v", kernelCmdlineModeParam, path, err)
+	}
+	return mode, true, nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModeFromKernelCmdline(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		cmdline   string
+		wantMode  Mode
+		wantFound bool
+		wantErr   bool
+	}{
+		{
+			name:    "missing",
+			cmdline: "BOOT_IMAGE=/vmlinuz root=/dev/sda1 ro quiet\n",
+		},
+		{
+			name:      "nft",
+			cmdline:   "BOOT_IMAGE=/vmlinuz iptables_wrapper.mode=nft ro\n",
+			wantMode:  NFT,
+			wantFound: true,
+		},
+		{
+			name:      "legacy quoted",
+			cmdline:   `ro iptables_wrapper.mode="legacy" quiet` + "\n",
+			wantMode:  Legacy,
+			wantFound: true,
+		},
+		{
+			name:    "invalid",
+			cmdline: "ro iptables_wrapper.mode=bogus quiet\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			cmdline: "ro iptables_wrapper.mode= quiet\n",
+			wantErr: true,
+		},
+		{
+			name:      "repeated",
+			cmdline:   "iptables_wrapper.mode=nft ro iptables_wrapper.mode=legacy\n",
+			wantMode:  Legacy,
+			wantFound: true,
+		},
+		{
+			name:      "at the end without newline",
+			cmdline:   "ro quiet iptables_wrapper.mode=nft",
+			wantMode:  NFT,
+			wantFound: true,
+		},
+		{
+			name:    "other parameter with the same prefix",
+			cmdline: "iptables_wrapper.modes=nft\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cmdline")
+			if err := os.WriteFile(path, []byte(tc.cmdline), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			mode, found, err := ModeFromKernelCmdline(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if mode != tc.wantMode || found != tc.wantFound {
+				t.Errorf("got %q, %v, want %q, %v", mode, found, tc.wantMode, tc.wantFound)
+			}
+		})
+	}
+}
+
+func TestModeFromKernelCmdlineMissingFile(t *testing.T) {
+	if _, _, err := ModeFromKernelCmdline(filepath.Join(t.TempDir(), "cmdline")); err == nil {
+		t.Errorf("got no error for a missing file")
+	}
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// CurrentMode returns the mode the iptables binary or symlink at iptablesPath
+// resolves to. It follows all symlinks, so when the command is managed by an
+// alternatives system, the mode comes from the link in AlternativesDir, which
+// is the source of truth for the alternatives database.
+func CurrentMode(iptablesPath string) (Mode, error) {
+	target, err := filepath.EvalSymlinks(iptablesPath)
+	if err != nil {
+		return "", err
+	}
+
+	switch name := filepath.Base(target); {
+	case name == xtablesNFTMultiBinaryName || strings.HasSuffix(name, "-nft"):
+		return NFT, nil
+	case name == xtablesLegacyMultiBinaryName || strings.HasSuffix(name, "-legacy"):
+		return Legacy, nil
+	default:
+		return "", fmt.Errorf("%s resolves to %s, which is not a known nft or legacy binary", iptablesPath, target)
+	}
+}
@@ -16,21 +16,42 @@ package iptables
 import (
 	"bytes"
 	"context"
-	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
 )
 
-// DetectBinaryDir tries to detect the `iptables` location in
-// either /usr/sbin or /sbin. If it's not there, it returns an error.
+// BinaryDirCandidates are the folders DetectBinaryDir looks for the iptables
+// binaries in, in order of priority. The last one is where NixOS links them.
+var BinaryDirCandidates = []string{"/usr/sbin", "/sbin", "/usr/bin", "/bin", "/run/current-system/sw/bin"}
+
+// DetectBinaryDir tries to detect the iptables binaries location in the
+// BinaryDirCandidates. If they aren't in any of them, it returns an error.
 func DetectBinaryDir() (string, error) {
-	if files.ExecutableExists("/usr/sbin/iptables") {
-		return "/usr/sbin", nil
-	} else if files.ExecutableExists("/sbin/iptables") {
-		return "/sbin", nil
-	} else {
-		return "", errors.New("iptables is not present in either /usr/sbin or /sbin")
+	return FindBinaryDir(BinaryDirCandidates)
+}
+
+// FindBinaryDir returns the first of dirs that contains the
+// `xtables-nft-multi` or `xtables-legacy-multi` binary. For images without
+// them, it falls back to the first one that contains `iptables`. If none
+// does, it returns an error listing the folders searched.
+func FindBinaryDir(dirs []string) (string, error) {
+	for _, dir := range dirs {
+		if files.ExecutableExists(XtablesPath(dir, NFT)) || files.ExecutableExists(XtablesPath(dir, Legacy)) {
+			return dir, nil
+		}
+	}
+	for _, dir := range dirs {
+		if files.ExecutableExists(filepath.Join(dir, "iptables")) {
+			return dir, nil
+		}
 	}
+	return "", fmt.Errorf("iptables is not present in any of %s", strings.Join(dirs, ", "))
 }
 
 // Mode represents the two different modes iptables can be
@@ -39,49 +60,541 @@ func DetectBinaryDir() (string, error) {
 type Mode string
 
 const (
-	legacy Mode = "legacy"
-	nft    Mode = "nft"
+	Legacy Mode = "legacy"
+	NFT    Mode = "nft"
+)
+
+// ParseMode parses the string representation of a Mode.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case Legacy, NFT:
+		return Mode(s), nil
+	default:
+		return "", fmt.Errorf("invalid iptables mode %q, must be %s or %s", s, Legacy, NFT)
+	}
+}
+
+// Family represents the IP family iptables rules are configured for.
+type Family string
+
+const (
+	IPv4 Family = "ipv4"
+	IPv6 Family = "ipv6"
 )
 
+// DetectionResult explains how a mode was detected.
+type DetectionResult struct {
+	// Mode is the detected mode.
+	Mode Mode
+	// LegacyLines and NFTLines are the number of rules in each mode. They are
+	// only counted when no kubelet chains are found or they are found in
+	// legacy, otherwise they are zero.
+	LegacyLines int
+	NFTLines    int
+	// MatchedFamily is the IP family the kubelet chains were found for in the
+	// detected mode, IPv4 if they were found for both. It is empty if the mode
+	// was picked from the number of rules.
+	MatchedFamily Family
+	// Ambiguous is true if the other mode was also a candidate: there are
+	// kubelet chains in both, or neither has them and both have the same
+	// number of rules.
+	Ambiguous bool
+	// NFTUnsupported is why nft was refused in favour of legacy, even though
+	// it was detected, because the kernel can't support it.
+	NFTUnsupported string
+}
+
 // DetectMode inspects the current iptables entries and tries to
-// guess which iptables mode is being used: legacy or nft
+// guess which iptables mode is being used: legacy or nft. If the kernel
+// can't support nf_tables, it falls back to legacy.
 func DetectMode(ctx context.Context, iptables Installation) Mode {
+	return NewDetector(iptables).Mode(ctx)
+}
+
+// DetectModeDetailed works like DetectMode but also returns why the mode was
+// picked.
+func DetectModeDetailed(ctx context.Context, iptables Installation) DetectionResult {
+	return NewDetector(iptables).ModeDetailed(ctx)
+}
+
+// TryDetectModeDetailed works like DetectModeDetailed, but returns a
+// *ProbeTimeoutError instead of a result if any of the commands times out.
+func TryDetectModeDetailed(ctx context.Context, iptables Installation) (DetectionResult, error) {
+	return NewDetector(iptables).TryModeDetailed(ctx)
+}
+
+// Mode inspects the current iptables entries and tries to guess which
+// iptables mode is being used: legacy or nft
+func (d Detector) Mode(ctx context.Context) Mode {
+	return d.ModeDetailed(ctx).Mode
+}
+
+// ModeDetailed works like Mode but also returns why the mode was picked.
+func (d Detector) ModeDetailed(ctx context.Context) DetectionResult {
+	result := d.detectedMode(ctx)
+	if result.Mode == NFT && d.nftProbe != nil {
+		if supported, reason := d.nftProbe.supported(ctx, d.log()); !supported {
+			d.log().Warn("The kernel doesn't support nf_tables, falling back to legacy", "reason", reason)
+			result.Mode = Legacy
+			result.NFTUnsupported = reason
+		}
+	}
+	return result
+}
+
+// TryModeDetailed works like ModeDetailed, but returns a *ProbeTimeoutError
+// instead of a result if any of the save commands times out. A command that
+// timed out can't tell if there are kubelet chains, so the result could be
+// wrong, and ModeDetailed can't be told apart from not finding any.
+func (d Detector) TryModeDetailed(ctx context.Context) (DetectionResult, error) {
+	tracker := NewTimeoutTracker(d.installation)
+	d.installation = tracker
+	result := d.ModeDetailed(ctx)
+	if err := tracker.Err(); err != nil {
+		return DetectionResult{}, err
+	}
+	return result, nil
+}
+
+// detectedMode picks the mode from the rules, without checking if the kernel
+// supports it.
+func (d Detector) detectedMode(ctx context.Context) DetectionResult {
+	if result, found := d.KubeletModeDetailed(ctx); found {
+		return result
+	}
+
+	// Without kubelet chains, do the same as the original shell wrapper
+	// and pick the mode with more rules.
+	result := DetectionResult{Mode: NFT}
+	result.LegacyLines, result.NFTLines = ruleLines(ctx, d.installation, d.log())
+	if result.LegacyLines > result.NFTLines {
+		result.Mode = Legacy
+	}
+
+	// If there are no more rules in legacy, default to nft.
+	result.Ambiguous = result.LegacyLines == result.NFTLines
+	return result
+}
+
+// RuleLines counts the rules in all the tables of both IP families for each
+// of the two modes.
+func RuleLines(ctx context.Context, iptables Installation) (legacyLines, nftLines int) {
+	return ruleLines(ctx, iptables, slog.Default())
+}
+
+// ruleLines is RuleLines, logging to logger.
+func ruleLines(ctx context.Context, iptables Installation, logger *slog.Logger) (legacyLines, nftLines int) {
+	outputs := saveConcurrently(ctx, iptables.LegacySave, iptables.LegacySaveIP6, iptables.NFTSave, iptables.NFTSaveIP6)
+	legacyLines = ruleEntriesNum(outputs[0]) + ruleEntriesNum(outputs[1])
+	nftLines = ruleEntriesNum(outputs[2]) + ruleEntriesNum(outputs[3])
+	logger.Debug("Counted the iptables rules", "legacy", legacyLines, "nft", nftLines)
+	return legacyLines, nftLines
+}
+
+// runConcurrently runs fns at the same time, at most DefaultProbeConcurrency
+// of them at once, and waits for them to finish. Since the probes are external
+// processes, this takes about as long as the slowest of them, instead of all
+// of them added up, without starting a process per probe at once on a
+// constrained node.
+func runConcurrently(fns ...func()) {
+	sem := make(chan struct{}, DefaultProbeConcurrency)
+	var wg sync.WaitGroup
+	wg.Add(len(fns))
+	for _, fn := range fns {
+		sem <- struct{}{}
+		go func(fn func()) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn()
+		}(fn)
+	}
+	wg.Wait()
+}
+
+// saveConcurrently runs the save functions concurrently, ignoring
+// their errors, and returns their outputs in the same order.
+func saveConcurrently(ctx context.Context, saves ...func(context.Context, *bytes.Buffer, ...string) error) [][]byte {
+	outputs := make([][]byte, len(saves))
+	fns := make([]func(), 0, len(saves))
+	for i, save := range saves {
+		i, save := i, save
+		fns = append(fns, func() {
+			rulesOutput := &bytes.Buffer{}
+			_ = save(ctx, rulesOutput)
+			outputs[i] = rulesOutput.Bytes()
+		})
+	}
+	runConcurrently(fns...)
+	return outputs
+}
+
+// nftFallbackTables are the tables checked for the kubelet chains in nft
+// mode, when enabled, if they can't be found in the mangle table.
+var nftFallbackTables = []string{"nat", "filter", "raw"}
+
+// Detector looks for the kubelet chains in the rules of an Installation to
+// detect the iptables mode in use.
+type Detector struct {
+	installation Installation
+	// allTables makes the Detector look for the kubelet chains in all the
+	// nft tables when they can't be found in the mangle table.
+	allTables bool
+	// matchRegex, if set, is looked for in the rules instead of the
+	// kubelet chains.
+	matchRegex *regexp.Regexp
+	// nftProbe, if set, is used to refuse nft when the kernel can't support it.
+	nftProbe *NFTKernelProbe
+	// logger gets the logs of the detection, if set. Otherwise, they go to
+	// slog.Default().
+	logger *slog.Logger
+}
+
+// NewDetector builds a Detector that inspects the rules of installation.
+func NewDetector(installation Installation) Detector {
+	return Detector{installation: installation, nftProbe: NewNFTKernelProbe(installation)}
+}
+
+// WithNFTKernelProbe returns a copy of d that uses probe to check if the kernel
+// supports nf_tables before picking nft, so its cached result can be shared. A
+// nil probe disables the check. By default, each Detector has its own probe.
+func (d Detector) WithNFTKernelProbe(probe *NFTKernelProbe) Detector {
+	d.nftProbe = probe
+	return d
+}
+
+// WithLogger returns a copy of d that logs the detection to logger instead of
+// to slog.Default(), e.g. to route it to the logging of a larger binary. A nil
+// logger restores the default.
+func (d Detector) WithLogger(logger *slog.Logger) Detector {
+	d.logger = logger
+	return d
+}
+
+// log returns the logger of d.
+func (d Detector) log() *slog.Logger {
+	if d.logger != nil {
+		return d.logger
+	}
+	return slog.Default()
+}
+
+// WithAllTables returns a copy of d that, if allTables is true, also checks the
+// nat, filter and raw nft tables when no kubelet chains are found in the nft
+// mangle table. This is useful when kube-proxy or a CNI only creates them in
+// other tables. By default, only the mangle table is checked.
+func (d Detector) WithAllTables(allTables bool) Detector {
+	d.allTables = allTables
+	return d
+}
+
+// WithMatchRegex returns a copy of d that looks for matches of regex in the
+// rules instead of the kubelet chains, for setups with their own canary chains.
+// The backend with more distinct matches wins when both have them. regex
+// should be built with CompileMatchRegex or, to look for chains by name, with
+// ChainPatternsRegex.
+func (d Detector) WithMatchRegex(regex *regexp.Regexp) Detector {
+	d.matchRegex = regex
+	return d
+}
+
+// DetectKubeletMode inspects the current iptables entries and returns the mode
+// where the kubelet chains were found. If they can't be found in any of the two
+// modes, it returns false.
+func DetectKubeletMode(ctx context.Context, iptables Installation) (Mode, bool) {
+	return NewDetector(iptables).KubeletMode(ctx)
+}
+
+// DetectFamilyMode inspects the iptables entries for a single IP family and
+// returns the mode where the kubelet chains were found. If they can't be found
+// in any of the two modes, it returns false.
+func DetectFamilyMode(ctx context.Context, iptables Installation, family Family) (Mode, bool) {
+	return NewDetector(iptables).FamilyMode(ctx, family)
+}
+
+// KubeletMode inspects the current iptables entries and returns the mode
+// where the kubelet chains were found. If they can't be found in any of the two
+// modes, it returns false.
+func (d Detector) KubeletMode(ctx context.Context) (Mode, bool) {
+	result, found := d.KubeletModeDetailed(ctx)
+	return result.Mode, found
+}
+
+// KubeletModeDetailed works like KubeletMode but also returns why the mode was
+// picked.
+func (d Detector) KubeletModeDetailed(ctx context.Context) (DetectionResult, bool) {
 	// This method ignores all errors, this is on purpose. We execute all commands
 	// and try to detect patterns in a best effort basis. If somthing fails,
-	// continue with the next step. Worse case scenario if everything fails,
-	// default to nft.
+	// continue with the next step.
 
 	// In kubernetes 1.17 and later, kubelet will have created at least
 	// one chain in the "mangle" table (either "KUBE-IPTABLES-HINT" or
 	// "KUBE-KUBELET-CANARY"), so check that first, against
 	// iptables-nft, because we can check that more efficiently and
 	// it's more common these days.
+	//
+	// Check also for kubernetes 1.17-or-later with iptables-legacy. We
+	// can't pass "-t mangle" to iptables-legacy-save because it would
+	// cause the kernel to create that table if it didn't already
+	// exist, which we don't want. So we have to grab all the rules.
+	//
+	// All the probes are run at the same time to reduce the latency.
+	var nftV4, nftV6, legacyV4, legacyV6 bool
+	runConcurrently(
+		func() { nftV4 = d.hasNFTKubeletChains(ctx, IPv4) },
+		func() { nftV6 = d.hasNFTKubeletChains(ctx, IPv6) },
+		func() { legacyV4 = d.hasLegacyKubeletChains(ctx, IPv4) },
+		func() { legacyV6 = d.hasLegacyKubeletChains(ctx, IPv6) },
+	)
+	nftFound := nftV4 || nftV6
+	legacyFound := legacyV4 || legacyV6
+	d.log().Debug("Looked for the kubelet chains", "nftIPv4", nftV4, "nftIPv6", nftV6, "legacyIPv4", legacyV4, "legacyIPv6", legacyV6)
+
+	var result DetectionResult
+	switch {
+	case legacyFound:
+		// Leftovers from a previous kubelet can leave chains in both backends,
+		// e.g. after the node was switched, and the nft check above only looks
+		// at the mangle tables, so there can be kubelet chains in other nft
+		// tables. Compare all the tables of both backends: the one kubelet and
+		// kube-proxy are actively managing will have more of their chains.
+		result.Mode, result.LegacyLines, result.NFTLines = d.modeWithMoreKubeletChains(ctx, IPv4, IPv6)
+		result.Ambiguous = nftFound
+	case nftFound:
+		result.Mode = NFT
+	default:
+		return result, false
+	}
+
+	switch {
+	case result.Mode == Legacy && legacyV4, result.Mode == NFT && nftV4:
+		result.MatchedFamily = IPv4
+	case result.Mode == Legacy && legacyV6, result.Mode == NFT && nftV6:
+		result.MatchedFamily = IPv6
+	}
+	return result, true
+}
+
+// FamilyMode inspects the iptables entries for a single IP family and
+// returns the mode where the kubelet chains were found. If they can't be found
+// in any of the two modes, it returns false.
+func (d Detector) FamilyMode(ctx context.Context, family Family) (Mode, bool) {
+	var nftFound, legacyFound bool
+	runConcurrently(
+		func() { nftFound = d.hasNFTKubeletChains(ctx, family) },
+		func() { legacyFound = d.hasLegacyKubeletChains(ctx, family) },
+	)
+
+	switch {
+	case legacyFound:
+		mode, _, _ := d.modeWithMoreKubeletChains(ctx, family)
+		return mode, true
+	case nftFound:
+		return NFT, true
+	default:
+		return "", false
+	}
+}
+
+// FamilyModes inspects the iptables entries of each IP family independently
+// and returns the mode where the kubelet chains were found for each of them.
+// The families where they can't be found are left out, so on hybrid hosts
+// IPv4 and IPv6 can end up with different modes.
+func (d Detector) FamilyModes(ctx context.Context) map[Family]Mode {
+	modes := map[Family]Mode{}
+	for _, family := range []Family{IPv4, IPv6} {
+		if mode, found := d.FamilyMode(ctx, family); found {
+			modes[family] = mode
+		}
+	}
+	return modes
+}
+
+// CanaryChains summarizes the kubelet and kube-proxy canary chains found in
+// the rules of a mode for an IP family.
+type CanaryChains struct {
+	Mode   Mode
+	Family Family
+	// Canaries is the number of canary chains.
+	Canaries int
+	// OtherChains is the number of the other kubelet and kube-proxy chains,
+	// not counting KUBE-IPTABLES-HINT.
+	OtherChains int
+}
+
+// Stale checks if the canary chains are likely leftovers, e.g. from before the
+// node was switched to the other mode or kubelet was upgraded: they are the
+// only kubelet and kube-proxy chains in the rules. The rules don't record when
+// chains were created, so this is only a heuristic.
+func (c CanaryChains) Stale() bool {
+	return c.Canaries > 0 && c.OtherChains == 0
+}
+
+// FindCanaryChains returns the canary chains found in all the tables of each
+// mode and IP family, leaving out the ones without any.
+func FindCanaryChains(ctx context.Context, iptables Installation) []CanaryChains {
+	candidates := []CanaryChains{
+		{Mode: Legacy, Family: IPv4},
+		{Mode: Legacy, Family: IPv6},
+		{Mode: NFT, Family: IPv4},
+		{Mode: NFT, Family: IPv6},
+	}
+	outputs := saveConcurrently(ctx, iptables.LegacySave, iptables.LegacySaveIP6, iptables.NFTSave, iptables.NFTSaveIP6)
+
+	var found []CanaryChains
+	for i, c := range candidates {
+		for _, chain := range ParseChains(outputs[i]) {
+			switch {
+			case canaryChains[chain]:
+				c.Canaries++
+			case chain != "KUBE-IPTABLES-HINT" && kubeletManagedChains[chain]:
+				c.OtherChains++
+			}
+		}
+		if c.Canaries > 0 {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// HasLegacyChains checks if any of the given chains is declared in any of the
+// legacy tables, for IPv4 or IPv6.
+func HasLegacyChains(ctx context.Context, iptables Installation, chains []string) bool {
+	wanted := map[string]bool{}
+	for _, chain := range chains {
+		wanted[chain] = true
+	}
+
+	for _, save := range []func(context.Context, *bytes.Buffer, ...string) error{iptables.LegacySave, iptables.LegacySaveIP6} {
+		rulesOutput := &bytes.Buffer{}
+		_ = save(ctx, rulesOutput)
+		for _, chain := range ParseChains(rulesOutput.Bytes()) {
+			if wanted[chain] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// modeWithMoreKubeletChains returns the mode with more distinct kubelet and
+// kube-proxy chains, across all the tables of the given families. On a tie
+// it returns nft. Since the chains are combined for all the families, kubelet
+// chains split across tables and families add up to the same backend. A mode
+// with the KUBE-IPTABLES-HINT chain wins if the other only has canary chains.
+// It also returns the number of rules it saw in each mode, since it has to save
+// all of them anyway.
+func (d Detector) modeWithMoreKubeletChains(ctx context.Context, families ...Family) (mode Mode, legacyLines, nftLines int) {
+	var saves []func(context.Context, *bytes.Buffer, ...string) error
+	for _, family := range families {
+		if family == IPv6 {
+			saves = append(saves, d.installation.NFTSaveIP6, d.installation.LegacySaveIP6)
+		} else {
+			saves = append(saves, d.installation.NFTSave, d.installation.LegacySave)
+		}
+	}
+
+	nftChains := map[string]bool{}
+	legacyChains := map[string]bool{}
+	for i, output := range saveConcurrently(ctx, saves...) {
+		if i%2 == 0 {
+			d.addManagedChains(nftChains, output)
+			nftLines += ruleEntriesNum(output)
+		} else {
+			d.addManagedChains(legacyChains, output)
+			legacyLines += ruleEntriesNum(output)
+		}
+	}
+
+	// KUBE-IPTABLES-HINT is created by kubelet precisely to tell which mode
+	// it uses, so it outweighs lone canary chains in the other mode.
+	switch {
+	case d.matchRegex != nil:
+	case hintOutweighs(nftChains, legacyChains):
+		return NFT, legacyLines, nftLines
+	case hintOutweighs(legacyChains, nftChains):
+		return Legacy, legacyLines, nftLines
+	}
+
+	if len(legacyChains) > len(nftChains) {
+		return Legacy, legacyLines, nftLines
+	}
+	return NFT, legacyLines, nftLines
+}
+
+// hintOutweighs checks if chains has the KUBE-IPTABLES-HINT chain and the only
+// kubelet chains in other, if any, are canaries.
+func hintOutweighs(chains, other map[string]bool) bool {
+	if !chains["KUBE-IPTABLES-HINT"] {
+		return false
+	}
+	for chain := range other {
+		if !canaryChains[chain] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasNFTKubeletChains checks if the kubelet chains are present in the nft
+// "mangle" table for the given family and, if d checks all the tables and
+// they aren't there, in the nat, filter and raw tables.
+func (d Detector) hasNFTKubeletChains(ctx context.Context, family Family) bool {
+	save := d.installation.NFTSave
+	if family == IPv6 {
+		save = d.installation.NFTSaveIP6
+	}
 	rulesOutput := &bytes.Buffer{}
-	_ = iptables.NFTSave(ctx, rulesOutput, "-t", "mangle")
-	if hasKubeletChains(rulesOutput.Bytes()) {
-		return nft
+	_ = save(ctx, rulesOutput, "-t", "mangle")
+	if d.hasChains(rulesOutput.Bytes()) {
+		return true
 	}
-	rulesOutput.Reset()
-	_ = iptables.NFTSaveIP6(ctx, rulesOutput, "-t", "mangle")
-	if hasKubeletChains(rulesOutput.Bytes()) {
-		return nft
+	if !d.allTables {
+		return false
 	}
-	rulesOutput.Reset()
 
-	// Check for kubernetes 1.17-or-later with iptables-legacy. We
-	// can't pass "-t mangle" to iptables-legacy-save because it would
-	// cause the kernel to create that table if it didn't already
-	// exist, which we don't want. So we have to grab all the rules.
-	_ = iptables.LegacySave(ctx, rulesOutput)
-	if hasKubeletChains(rulesOutput.Bytes()) {
-		return legacy
+	for _, table := range nftFallbackTables {
+		rulesOutput.Reset()
+		_ = save(ctx, rulesOutput, "-t", table)
+		if d.hasChains(rulesOutput.Bytes()) {
+			return true
+		}
 	}
-	rulesOutput.Reset()
-	_ = iptables.LegacySaveIP6(ctx, rulesOutput)
-	if hasKubeletChains(rulesOutput.Bytes()) {
-		return legacy
+	return false
+}
+
+// hasLegacyKubeletChains checks if the kubelet chains are present in any of the
+// legacy tables for the given family.
+func (d Detector) hasLegacyKubeletChains(ctx context.Context, family Family) bool {
+	save := d.installation.LegacySave
+	if family == IPv6 {
+		save = d.installation.LegacySaveIP6
 	}
+	rulesOutput := &bytes.Buffer{}
+	_ = save(ctx, rulesOutput)
+	return d.hasChains(rulesOutput.Bytes())
+}
 
-	// If we can't detect any of the 2 patterns, default to nft.
-	return nft
+// hasChains checks if the output of an iptables*-save command contains the
+// kubelet chains or, if set, matches the match regex.
+func (d Detector) hasChains(output []byte) bool {
+	if d.matchRegex != nil {
+		return d.matchRegex.Match(output)
+	}
+	return hasKubeletChains(output)
+}
+
+// addManagedChains adds to chains the kubelet and kube-proxy chains or, if
+// set, the distinct matches of the match regex in an iptables*-save command
+// output.
+func (d Detector) addManagedChains(chains map[string]bool, output []byte) {
+	if d.matchRegex == nil {
+		addKubeletManagedChains(chains, output)
+		return
+	}
+	for _, match := range d.matchRegex.FindAll(output, -1) {
+		chains[string(match)] = true
+	}
 }
@@ -0,0 +1,350 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRunner is a CommandRunner that returns canned output for each command
+// line, with the binary by name, like "xtables-nft-multi iptables-save -t mangle".
+// Command lines in errs fail with the given message instead, and the rest
+// succeed without any output.
+type fakeRunner struct {
+	outputs map[string]string
+	errs    map[string]string
+}
+
+func (r fakeRunner) Run(_ context.Context, path string, args ...string) ([]byte, error) {
+	cmdline := strings.Join(append([]string{filepath.Base(path)}, args...), " ")
+	if msg, ok := r.errs[cmdline]; ok {
+		return nil, errors.New(msg)
+	}
+	return []byte(r.outputs[cmdline]), nil
+}
+
+// saveOutput builds an iptables*-save output with a table declaring chains
+// and having rules entries.
+func saveOutput(table string, chains []string, rules int) string {
+	var b strings.Builder
+	b.WriteString("*" + table + "\n")
+	for _, chain := range chains {
+		b.WriteString(":" + chain + " - [0:0]\n")
+	}
+	for i := 0; i < rules; i++ {
+		b.WriteString("-A INPUT -j ACCEPT\n")
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+func TestDetectorModeDetailedWithRunner(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		runner      fakeRunner
+		kernelProbe bool
+		want        DetectionResult
+	}{
+		{
+			name:   "no rules",
+			runner: fakeRunner{},
+			want:   DetectionResult{Mode: NFT, Ambiguous: true},
+		},
+		{
+			name: "more legacy rules",
+			runner: fakeRunner{outputs: map[string]string{
+				"xtables-legacy-multi iptables-save": saveOutput("filter", nil, 3),
+				"xtables-nft-multi iptables-save":    saveOutput("filter", nil, 1),
+			}},
+			want: DetectionResult{Mode: Legacy, LegacyLines: 3, NFTLines: 1},
+		},
+		{
+			name: "more nft rules across families",
+			runner: fakeRunner{outputs: map[string]string{
+				"xtables-legacy-multi iptables-save": saveOutput("filter", nil, 2),
+				"xtables-nft-multi iptables-save":    saveOutput("filter", nil, 1),
+				"xtables-nft-multi ip6tables-save":   saveOutput("filter", nil, 2),
+			}},
+			want: DetectionResult{Mode: NFT, LegacyLines: 2, NFTLines: 3},
+		},
+		{
+			name: "same number of rules",
+			runner: fakeRunner{outputs: map[string]string{
+				"xtables-legacy-multi ip6tables-save": saveOutput("filter", nil, 2),
+				"xtables-nft-multi iptables-save":     saveOutput("filter", nil, 2),
+			}},
+			want: DetectionResult{Mode: NFT, LegacyLines: 2, NFTLines: 2, Ambiguous: true},
+		},
+		{
+			name: "kubelet chains win over rules",
+			runner: fakeRunner{outputs: map[string]string{
+				"xtables-legacy-multi iptables-save":        saveOutput("filter", nil, 10),
+				"xtables-nft-multi iptables-save -t mangle": saveOutput("mangle", []string{"KUBE-IPTABLES-HINT"}, 0),
+			}},
+			want: DetectionResult{Mode: NFT, MatchedFamily: IPv4},
+		},
+		{
+			name: "legacy IPv6 only",
+			runner: fakeRunner{outputs: map[string]string{
+				"xtables-legacy-multi ip6tables-save": saveOutput("mangle", []string{"KUBE-KUBELET-CANARY"}, 0),
+			}},
+			want: DetectionResult{Mode: Legacy, MatchedFamily: IPv6},
+		},
+		{
+			name: "failing commands are ignored",
+			runner: fakeRunner{
+				outputs: map[string]string{
+					"xtables-nft-multi ip6tables-save -t mangle": saveOutput("mangle", []string{"KUBE-IPTABLES-HINT"}, 0),
+				},
+				errs: map[string]string{
+					"xtables-legacy-multi iptables-save":  "exit status 1",
+					"xtables-legacy-multi ip6tables-save": "exit status 1",
+				},
+			},
+			want: DetectionResult{Mode: NFT, MatchedFamily: IPv6},
+		},
+		{
+			name: "nft unsupported by the kernel",
+			runner: fakeRunner{
+				outputs: map[string]string{
+					"xtables-nft-multi iptables-save -t mangle": saveOutput("mangle", []string{"KUBE-IPTABLES-HINT"}, 0),
+				},
+				errs: map[string]string{
+					"xtables-nft-multi iptables-save": "Failed to initialize nft: Protocol not supported",
+				},
+			},
+			kernelProbe: true,
+			want: DetectionResult{
+				Mode:           Legacy,
+				MatchedFamily:  IPv4,
+				NFTUnsupported: "iptables-nft-save failed to initialize nft",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(tc.runner)
+			detector := NewDetector(installation).WithNFTKernelProbe(nil)
+			if tc.kernelProbe {
+				detector = detector.WithNFTKernelProbe(NewNFTKernelProbe(installation))
+			}
+
+			if got := detector.ModeDetailed(context.Background()); got != tc.want {
+				t.Errorf("ModeDetailed() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleLinesWithRunner(t *testing.T) {
+	installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(fakeRunner{outputs: map[string]string{
+		// Chain declarations, comments and COMMIT lines aren't rules, and
+		// -I entries are.
+		"xtables-legacy-multi iptables-save":  "# Generated by iptables-legacy-save\n" + saveOutput("filter", []string{"INPUT"}, 2) + "-I INPUT -j DROP\n",
+		"xtables-legacy-multi ip6tables-save": saveOutput("filter", nil, 1),
+		"xtables-nft-multi iptables-save":     saveOutput("nat", []string{"KUBE-SERVICES"}, 0),
+		"xtables-nft-multi ip6tables-save":    saveOutput("filter", nil, 4),
+	}})
+
+	legacyLines, nftLines := RuleLines(context.Background(), installation)
+	if legacyLines != 4 || nftLines != 4 {
+		t.Errorf("RuleLines() = %d, %d, want 4, 4", legacyLines, nftLines)
+	}
+}
+
+// goldenRunner is a CommandRunner that replays the iptables*-save outputs
+// recorded in a folder, named like legacy-save or nft6-save. A missing file is
+// an empty output, and "-t table" only returns that table, like the real
+// commands do.
+type goldenRunner string
+
+func (dir goldenRunner) Run(_ context.Context, path string, args ...string) ([]byte, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "xtables-"), "-multi")
+	if len(args) > 0 && strings.HasPrefix(args[0], "ip6tables") {
+		name += "6"
+	}
+	output, err := os.ReadFile(filepath.Join(string(dir), name+"-save"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 3 && args[1] == "-t" {
+		return saveTable(output, args[2]), nil
+	}
+	return output, nil
+}
+
+// saveTable returns the lines of the given table in an iptables*-save output.
+func saveTable(output []byte, table string) []byte {
+	var b bytes.Buffer
+	inTable := false
+	for _, line := range strings.SplitAfter(string(output), "\n") {
+		if strings.HasPrefix(line, "*") {
+			inTable = strings.TrimSpace(line) == "*"+table
+		}
+		if inTable {
+			b.WriteString(line)
+		}
+		if strings.TrimSpace(line) == "COMMIT" {
+			inTable = false
+		}
+	}
+	return b.Bytes()
+}
+
+func TestKubeletModeDetailedGolden(t *testing.T) {
+	for _, tc := range []struct {
+		dir  string
+		want DetectionResult
+	}{
+		// Kubernetes 1.17 to 1.22 only created the canary chains.
+		{dir: "canary-legacy", want: DetectionResult{Mode: Legacy, LegacyLines: 15, MatchedFamily: IPv4}},
+		{dir: "hint-nft-dual-stack", want: DetectionResult{Mode: NFT, MatchedFamily: IPv4}},
+		{dir: "hint-legacy-dual-stack", want: DetectionResult{Mode: Legacy, LegacyLines: 30, MatchedFamily: IPv4}},
+		{dir: "ipv6-only-nft", want: DetectionResult{Mode: NFT, MatchedFamily: IPv6}},
+		// The legacy canaries are more chains, but the nft hint outweighs them.
+		{dir: "hint-nft-canaries-legacy", want: DetectionResult{Mode: NFT, MatchedFamily: IPv4, Ambiguous: true}},
+		// The same, with the CRLF line endings of some misconfigured systems.
+		{dir: "crlf-hint-nft-canaries-legacy", want: DetectionResult{Mode: NFT, MatchedFamily: IPv4, Ambiguous: true}},
+		{dir: "tie", want: DetectionResult{Mode: NFT, MatchedFamily: IPv4, Ambiguous: true}},
+		// A canary left behind in nft after switching to legacy.
+		{dir: "split-brain-legacy", want: DetectionResult{Mode: Legacy, LegacyLines: 15, MatchedFamily: IPv4, Ambiguous: true}},
+	} {
+		t.Run(tc.dir, func(t *testing.T) {
+			runner := goldenRunner(filepath.Join("testdata", tc.dir))
+			detector := NewDetector(NewXtablesMultiInstallation(t.TempDir()).WithRunner(runner))
+
+			got, found := detector.KubeletModeDetailed(context.Background())
+			if !found || got != tc.want {
+				t.Errorf("KubeletModeDetailed() = %+v, %v, want %+v, true", got, found, tc.want)
+			}
+		})
+	}
+}
+
+func TestModeWithMoreKubeletChainsGolden(t *testing.T) {
+	for _, tc := range []struct {
+		dir      string
+		families []Family
+		want     Mode
+	}{
+		{dir: "hint-legacy-dual-stack", families: []Family{IPv6}, want: Legacy},
+		{dir: "hint-nft-canaries-legacy", families: []Family{IPv4, IPv6}, want: NFT},
+		{dir: "crlf-hint-nft-canaries-legacy", families: []Family{IPv4, IPv6}, want: NFT},
+		{dir: "tie", families: []Family{IPv4}, want: NFT},
+		// There aren't any kubelet chains for IPv4, which is a tie.
+		{dir: "ipv6-only-nft", families: []Family{IPv4}, want: NFT},
+		{dir: "ipv6-only-nft", families: []Family{IPv6}, want: NFT},
+		{dir: "split-brain-legacy", families: []Family{IPv4, IPv6}, want: Legacy},
+	} {
+		t.Run(fmt.Sprintf("%s/%v", tc.dir, tc.families), func(t *testing.T) {
+			runner := goldenRunner(filepath.Join("testdata", tc.dir))
+			detector := NewDetector(NewXtablesMultiInstallation(t.TempDir()).WithRunner(runner))
+
+			if got, _, _ := detector.modeWithMoreKubeletChains(context.Background(), tc.families...); got != tc.want {
+				t.Errorf("modeWithMoreKubeletChains(%v) = %s, want %s", tc.families, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGoldenCRLF(t *testing.T) {
+	lf := NewXtablesMultiInstallation(t.TempDir()).WithRunner(goldenRunner(filepath.Join("testdata", "hint-nft-canaries-legacy")))
+	crlf := NewXtablesMultiInstallation(t.TempDir()).WithRunner(goldenRunner(filepath.Join("testdata", "crlf-hint-nft-canaries-legacy")))
+
+	crlfLegacy, crlfNFT := RuleLines(context.Background(), crlf)
+	if legacy, nft := RuleLines(context.Background(), lf); crlfLegacy != legacy || crlfNFT != nft {
+		t.Errorf("RuleLines() with CRLF = %d, %d, want %d, %d", crlfLegacy, crlfNFT, legacy, nft)
+	}
+	crlfCanaries := FindCanaryChains(context.Background(), crlf)
+	if canaries := FindCanaryChains(context.Background(), lf); !reflect.DeepEqual(crlfCanaries, canaries) {
+		t.Errorf("FindCanaryChains() with CRLF = %+v, want %+v", crlfCanaries, canaries)
+	}
+}
+
+// hangingRunner is a CommandRunner whose commands only finish when their
+// context is done.
+type hangingRunner struct{}
+
+func (hangingRunner) Run(ctx context.Context, _ string, _ ...string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDetectorTryModeDetailed(t *testing.T) {
+	installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(fakeRunner{outputs: map[string]string{
+		"xtables-legacy-multi iptables-save": saveOutput("mangle", []string{"KUBE-IPTABLES-HINT"}, 0),
+	}})
+	detector := NewDetector(installation).WithNFTKernelProbe(nil)
+
+	result, err := detector.TryModeDetailed(context.Background())
+	if want := (DetectionResult{Mode: Legacy, MatchedFamily: IPv4}); err != nil || result != want {
+		t.Errorf("TryModeDetailed() = %+v, %v, want %+v, no error", result, err, want)
+	}
+
+	// Without a timeout, ModeDetailed can't tell the commands that hang from
+	// the ones that find nothing.
+	hanging := NewDetector(installation.WithRunner(hangingRunner{}).WithTimeout(10 * time.Millisecond)).WithNFTKernelProbe(nil)
+	if result := hanging.ModeDetailed(context.Background()); result.Mode != NFT {
+		t.Errorf("ModeDetailed() with hanging commands = %+v, want the nft default", result)
+	}
+	_, err = hanging.TryModeDetailed(context.Background())
+	var timeoutErr *ProbeTimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, ErrProbeTimeout) || timeoutErr.Timeout != 10*time.Millisecond {
+		t.Errorf("TryModeDetailed() with hanging commands = %v, want a *ProbeTimeoutError after 10ms", err)
+	}
+}
+
+func TestRunConcurrentlyLimit(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning, ran := 0, 0, 0
+	fns := make([]func(), 3*DefaultProbeConcurrency)
+	for i := range fns {
+		fns[i] = func() {
+			mu.Lock()
+			running++
+			ran++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}
+	}
+
+	runConcurrently(fns...)
+	if ran != len(fns) {
+		t.Errorf("runConcurrently() ran %d functions, want %d", ran, len(fns))
+	}
+	if maxRunning > DefaultProbeConcurrency {
+		t.Errorf("runConcurrently() ran %d functions at once, want at most %d", maxRunning, DefaultProbeConcurrency)
+	}
+	if maxRunning < 2 {
+		t.Errorf("runConcurrently() ran %d functions at once, want them to run concurrently", maxRunning)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ParseFamily parses the string representation of a Family.
+func ParseFamily(s string) (Family, error) {
+	switch Family(s) {
+	case IPv4, IPv6:
+		return Family(s), nil
+	default:
+		return "", fmt.Errorf("invalid IP family %q, must be %s or %s", s, IPv4, IPv6)
+	}
+}
+
+// AppletFamily returns the IP family managed by an iptables applet, given its
+// name or path. Applets starting with `ip6tables` manage IPv6 rules and all
+// the others IPv4 ones. Non standard names can be mapped with overrides, which
+// takes precedence.
+func AppletFamily(applet string, overrides map[string]Family) Family {
+	applet = filepath.Base(applet)
+	if family, ok := overrides[applet]; ok {
+		return family
+	}
+	if strings.HasPrefix(applet, "ip6tables") {
+		return IPv6
+	}
+	return IPv4
+}
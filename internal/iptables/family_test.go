@@ -0,0 +1,53 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import "testing"
+
+func TestAppletFamily(t *testing.T) {
+	overrides := map[string]Family{
+		"iptables6":    IPv6,
+		"ip6tables-v4": IPv4,
+	}
+	for _, tc := range []struct {
+		applet    string
+		overrides map[string]Family
+		want      Family
+	}{
+		// Defaults.
+		{applet: "iptables", want: IPv4},
+		{applet: "iptables-save", want: IPv4},
+		{applet: "iptables-restore", want: IPv4},
+		{applet: "ip6tables", want: IPv6},
+		{applet: "ip6tables-save", want: IPv6},
+		{applet: "ip6tables-restore", want: IPv6},
+		{applet: "/usr/sbin/ip6tables-restore", want: IPv6},
+		{applet: "/usr/sbin/iptables", want: IPv4},
+		// Overrides, matched by base name, take precedence.
+		{applet: "iptables6", overrides: overrides, want: IPv6},
+		{applet: "/opt/bin/iptables6", overrides: overrides, want: IPv6},
+		{applet: "ip6tables-v4", overrides: overrides, want: IPv4},
+		{applet: "ip6tables", overrides: overrides, want: IPv6},
+		{applet: "iptables6", want: IPv4},
+		// Unknown applets default to IPv4 unless they start with ip6tables.
+		{applet: "kube-iptables", want: IPv4},
+		{applet: "ebtables", want: IPv4},
+		{applet: "ip6tables-custom", want: IPv6},
+		{applet: "", want: IPv4},
+	} {
+		if got := AppletFamily(tc.applet, tc.overrides); got != tc.want {
+			t.Errorf("AppletFamily(%q, %v) = %s, want %s", tc.applet, tc.overrides, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import "os"
+
+// firewalldPIDFile is created by firewalld when it starts and removed on exit.
+const firewalldPIDFile = "/var/run/firewalld.pid"
+
+// FirewalldRunning checks in a best effort basis if firewalld is managing
+// the firewall. This can only be detected if /var/run is shared with the host.
+func FirewalldRunning() bool {
+	_, err := os.Stat(firewalldPIDFile)
+	return err == nil
+}
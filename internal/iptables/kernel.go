@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// SysModuleDir is the folder the kernel lists its loaded and built-in
+	// modules in.
+	SysModuleDir = "/sys/module"
+	// KernelModulesDir is the folder with the loadable kernel modules, in a
+	// subfolder for each kernel release.
+	KernelModulesDir = "/lib/modules"
+	// KernelReleasePath is the file exposing the release of the running kernel.
+	KernelReleasePath = "/proc/sys/kernel/osrelease"
+)
+
+// NFTKernelProbe checks if the running kernel can support nf_tables. On minimal
+// kernels without the nf_tables module, the nft binaries can still succeed while
+// programming nothing, so the kernel has to be asked directly. The result of the
+// first check is cached, so a probe can be shared to avoid repeating it. It's
+// safe for concurrent use.
+type NFTKernelProbe struct {
+	installation     Installation
+	sysModuleDir     string
+	kernelModulesDir string
+	releasePath      string
+
+	mu      sync.Mutex
+	checked bool
+	// reason is why the kernel can't support nf_tables, empty if it can.
+	reason string
+}
+
+// NewNFTKernelProbe builds an NFTKernelProbe that inspects the running kernel
+// and the nft binaries of installation.
+func NewNFTKernelProbe(installation Installation) *NFTKernelProbe {
+	return &NFTKernelProbe{
+		installation:     installation,
+		sysModuleDir:     SysModuleDir,
+		kernelModulesDir: KernelModulesDir,
+		releasePath:      KernelReleasePath,
+	}
+}
+
+// Supported returns true if the kernel supports nf_tables or it can't be told,
+// and otherwise false along with the reason. Only the first call runs the
+// checks, unless ctx is done before they finish.
+func (p *NFTKernelProbe) Supported(ctx context.Context) (bool, string) {
+	return p.supported(ctx, slog.Default())
+}
+
+// supported is Supported, logging the checks to logger.
+func (p *NFTKernelProbe) supported(ctx context.Context, logger *slog.Logger) (bool, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.checked {
+		p.reason = p.unsupportedReason(ctx)
+		p.checked = ctx.Err() == nil
+		logger.Debug("Checked the kernel support for nf_tables", "supported", p.reason == "", "reason", p.reason)
+	}
+	return p.reason == "", p.reason
+}
+
+// unsupportedReason runs the checks and returns why the kernel can't support
+// nf_tables, or an empty string if it can or it can't be told.
+func (p *NFTKernelProbe) unsupportedReason(ctx context.Context) string {
+	if supported, err := NFTKernelSupported(ctx, p.installation); err == nil && !supported {
+		return "iptables-nft-save failed to initialize nft"
+	}
+
+	// Both the loaded and the built-in modules are listed here.
+	if _, err := os.Stat(filepath.Join(p.sysModuleDir, "nf_tables")); err == nil {
+		return ""
+	} else if _, err := os.Stat(p.sysModuleDir); err != nil {
+		// Without sysfs, there is nothing else to check.
+		return ""
+	}
+
+	// It's not loaded yet, but the kernel loads it on demand if it's available.
+	release, err := os.ReadFile(p.releasePath)
+	if err != nil {
+		return ""
+	}
+	modulesDir := filepath.Join(p.kernelModulesDir, strings.TrimSpace(string(release)))
+	available, err := hasModule(modulesDir, "nf_tables")
+	if err != nil {
+		return ""
+	}
+	if !available {
+		return fmt.Sprintf("the nf_tables module is not loaded nor available in %s", modulesDir)
+	}
+	return ""
+}
+
+// hasModule checks if module is listed in the modules.dep or modules.builtin
+// files of modulesDir. If neither can be read, it returns an error.
+func hasModule(modulesDir, module string) (bool, error) {
+	read := 0
+	for _, name := range []string{"modules.dep", "modules.builtin"} {
+		content, err := os.ReadFile(filepath.Join(modulesDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		read++
+
+		// Entries look like kernel/net/netfilter/nf_tables.ko.xz: kernel/net/netfilter/nfnetlink.ko.xz
+		for _, line := range bytes.Split(content, []byte("\n")) {
+			path, _, _ := bytes.Cut(line, []byte(":"))
+			base := filepath.Base(string(path))
+			if strings.HasPrefix(base, module+".ko") {
+				return true, nil
+			}
+		}
+	}
+	if read == 0 {
+		return false, fmt.Errorf("no modules.dep nor modules.builtin in %s", modulesDir)
+	}
+	return false, nil
+}
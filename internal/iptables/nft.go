@@ -0,0 +1,54 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+)
+
+// nftUnsupportedRegex matches the errors iptables-nft fails with when the
+// kernel doesn't support nf_tables, e.g.:
+//
+//	Failed to initialize nft: Protocol not supported
+var nftUnsupportedRegex = regexp.MustCompile(`Failed to initialize nft|Protocol not supported`)
+
+// NFTKernelSupported checks if the kernel supports nf_tables, which the nft
+// userspace binaries can't tell by themselves. It runs iptables-nft-save, which
+// is harmless and fails on kernels without nf_tables. Errors other than
+// the kernel lacking support, like missing privileges, are returned.
+func NFTKernelSupported(ctx context.Context, iptables Installation) (bool, error) {
+	err := iptables.NFTSave(ctx, &bytes.Buffer{})
+	if err == nil {
+		return true, nil
+	}
+	if nftUnsupportedRegex.MatchString(err.Error()) {
+		return false, nil
+	}
+	return false, err
+}
+
+// NFTRulesetHasChains asks nft directly, with `nft list ruleset` run through
+// xtables, if the kubelet chains, or the matches of the match regex of d, are
+// present in the nftables ruleset. It returns an error if the nft binary is
+// not installed or it fails, and a *ProbeTimeoutError if it takes longer than
+// the timeout of xtables.
+func (d Detector) NFTRulesetHasChains(ctx context.Context, xtables XtablesMulti) (bool, error) {
+	out := &bytes.Buffer{}
+	if err := xtables.NFTRuleset(ctx, out); err != nil {
+		return false, err
+	}
+	return d.hasChains(out.Bytes()), nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeNFT puts an nft script with the given body first in PATH.
+func fakeNFT(t *testing.T, body string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nft"), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// fakeSbinNFT returns a sbin folder with an nft script with the given body.
+func fakeSbinNFT(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nft"), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestNFTRulesetHasChains(t *testing.T) {
+	calico, err := ChainPatternsRegex([]string{"cali-.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		body      string
+		detector  func(Installation) Detector
+		want      bool
+		wantError bool
+	}{
+		{
+			name: "hint",
+			body: "printf 'table ip mangle {\\n\\tchain KUBE-IPTABLES-HINT {\\n\\t}\\n}\\n'",
+			want: true,
+		},
+		{
+			name: "other chains",
+			body: "printf 'table ip filter {\\n\\tchain INPUT {\\n\\t}\\n}\\n'",
+		},
+		{
+			name:     "chain patterns",
+			body:     "printf 'table ip filter {\\n\\tchain cali-INPUT {\\n\\t}\\n}\\n'",
+			detector: func(installation Installation) Detector { return NewDetector(installation).WithMatchRegex(calico) },
+			want:     true,
+		},
+		{
+			name:     "not matching the chain patterns",
+			body:     "printf 'table ip mangle {\\n\\tchain KUBE-IPTABLES-HINT {\\n\\t}\\n}\\n'",
+			detector: func(installation Installation) Detector { return NewDetector(installation).WithMatchRegex(calico) },
+		},
+		{
+			name:      "failing",
+			body:      "echo 'netlink: Error: cache initialization failed' >&2; exit 1",
+			wantError: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			xtables := NewXtablesMultiInstallation(fakeSbinNFT(t, tc.body))
+			detector := NewDetector(xtables)
+			if tc.detector != nil {
+				detector = tc.detector(xtables)
+			}
+			found, err := detector.NFTRulesetHasChains(context.Background(), xtables)
+			if found != tc.want || (err != nil) != tc.wantError {
+				t.Errorf("NFTRulesetHasChains() = %v, %v, want %v, error %v", found, err, tc.want, tc.wantError)
+			}
+			if errors.Is(err, ErrProbeTimeout) {
+				t.Errorf("NFTRulesetHasChains() = %v, want it not to time out", err)
+			}
+		})
+	}
+}
+
+func TestNFTRulesetHasChainsInPath(t *testing.T) {
+	fakeNFT(t, "printf 'table ip6 mangle {\\n\\tchain KUBE-KUBELET-CANARY {\\n\\t}\\n}\\n'")
+	xtables := NewXtablesMultiInstallation(t.TempDir())
+	if found, err := NewDetector(xtables).NFTRulesetHasChains(context.Background(), xtables); !found || err != nil {
+		t.Errorf("NFTRulesetHasChains() with nft in PATH = %v, %v, want true", found, err)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := NewDetector(xtables).NFTRulesetHasChains(context.Background(), xtables); err == nil {
+		t.Error("NFTRulesetHasChains() without nft succeeded, want an error")
+	}
+}
+
+func TestNFTRulesetHasChainsThroughRunner(t *testing.T) {
+	sbinPath := fakeSbinNFT(t, "exit 1")
+	nftPath := filepath.Join(sbinPath, "nft")
+	xtables := NewXtablesMultiInstallation(sbinPath).WithCommandPrefix("nsenter", "--net=/proc/1/ns/net").WithRunner(fakeRunner{
+		outputs: map[string]string{"nsenter --net=/proc/1/ns/net " + nftPath + " list ruleset": "table ip mangle {\n\tchain KUBE-IPTABLES-HINT {\n\t}\n}\n"},
+	})
+	if found, err := NewDetector(xtables).NFTRulesetHasChains(context.Background(), xtables); !found || err != nil {
+		t.Errorf("NFTRulesetHasChains() through the runner = %v, %v, want true", found, err)
+	}
+}
+
+func TestNFTRulesetHasChainsTimeout(t *testing.T) {
+	xtables := NewXtablesMultiInstallation(fakeSbinNFT(t, "exec sleep 10")).WithTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	_, err := NewDetector(xtables).NFTRulesetHasChains(context.Background(), xtables)
+	var timeoutErr *ProbeTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Command != "nft" {
+		t.Errorf("NFTRulesetHasChains() = %v, want a *ProbeTimeoutError for nft", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("NFTRulesetHasChains() took %s despite the timeout", elapsed)
+	}
+}
@@ -13,19 +13,132 @@ limitations under the License.
 
 package iptables
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
+// The output of iptables*-save, for both legacy and nft, looks like:
+//
+//	# Generated by iptables-nft-save v1.8.7 on Thu Feb  2 10:00:00 2023
+//	*mangle
+//	:PREROUTING ACCEPT [0:0]
+//	:KUBE-IPTABLES-HINT - [0:0]
+//	-A PREROUTING -j ACCEPT
+//	COMMIT
+//	# Completed on Thu Feb  2 10:00:00 2023
+//
+// Comments, table headers and COMMIT lines differ between backends and versions, so
+// only chain declarations (":") and rule entries ("-A"/"-I") should be inspected.
+//
+// The output of `nft list ruleset` declares the same chains as:
+//
+//	table ip mangle {
+//		chain KUBE-IPTABLES-HINT {
+//		}
+//	}
 var (
-	kubeletChainsRegex = regexp.MustCompile(`(?m)^:(KUBE-IPTABLES-HINT|KUBE-KUBELET-CANARY)`)
-	ruleEntryRegex     = regexp.MustCompile(`(?m)^-`)
+	kubeletChainsRegex = regexp.MustCompile(chainPatternsExpr(DefaultChainPatterns))
+	ruleEntryRegex     = regexp.MustCompile(`(?m)^-[AI] `)
+	chainRegex         = regexp.MustCompile(`(?m)^:(\S+) `)
 )
 
+// DefaultChainPatterns are the chains created by kubelet that the detection
+// looks for unless configured otherwise.
+var DefaultChainPatterns = []string{"KUBE-IPTABLES-HINT", "KUBE-KUBELET-CANARY"}
+
+// ChainPatternsRegex builds a regular expression that matches the declaration
+// of any chain whose whole name matches one of patterns, in the output of an
+// iptables*-save command or of `nft list ruleset`. Each pattern is a regular expression, e.g. `cali-.*`
+// for the Calico chains.
+func ChainPatternsRegex(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no chain patterns given")
+	}
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("chain pattern %q: %v", pattern, err)
+		}
+	}
+	return regexp.Compile(chainPatternsExpr(patterns))
+}
+
+// chainPatternsExpr returns the expression matching the declaration of the
+// chains matching any of patterns.
+func chainPatternsExpr(patterns []string) string {
+	names := strings.Join(patterns, "|")
+	return `(?m)^(?::(?:` + names + `) |\s*chain (?:` + names + `) \{)`
+}
+
+// ParseChains returns the names of all the chains declared in an
+// iptables*-save command output.
+func ParseChains(output []byte) []string {
+	var chains []string
+	for _, match := range chainRegex.FindAllSubmatch(output, -1) {
+		chains = append(chains, string(match[1]))
+	}
+	return chains
+}
+
 // hasKubeletChains checks if the output of an iptables*-save command
 // contains any of the rules set by kubelet.
 func hasKubeletChains(output []byte) bool {
 	return kubeletChainsRegex.Match(output)
 }
 
+// CompileMatchRegex compiles a user provided regular expression to look for
+// in the iptables*-save output, and the nft ruleset, instead of the kubelet
+// chains. It's compiled in
+// multi-line mode, so ^ and $ match the start and end of each line. Expressions
+// that match an empty output are rejected, since they would match the rules of
+// any backend.
+func CompileMatchRegex(expr string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(expr); err != nil {
+		return nil, err
+	}
+	regex := regexp.MustCompile("(?m)" + expr)
+	if regex.MatchString("") {
+		return nil, fmt.Errorf("%q matches an empty output, so it would match any backend", expr)
+	}
+	return regex, nil
+}
+
+// kubeletManagedChains are the well known chains created by kubelet and
+// kube-proxy. Per service chains are left out on purpose, since their number
+// depends on the workload and not on which component manages the backend.
+var kubeletManagedChains = map[string]bool{
+	"KUBE-IPTABLES-HINT":     true,
+	"KUBE-KUBELET-CANARY":    true,
+	"KUBE-PROXY-CANARY":      true,
+	"KUBE-FIREWALL":          true,
+	"KUBE-MARK-DROP":         true,
+	"KUBE-MARK-MASQ":         true,
+	"KUBE-POSTROUTING":       true,
+	"KUBE-SERVICES":          true,
+	"KUBE-EXTERNAL-SERVICES": true,
+	"KUBE-NODEPORTS":         true,
+	"KUBE-FORWARD":           true,
+	"KUBE-PROXY-FIREWALL":    true,
+}
+
+// canaryChains are the chains kubelet and kube-proxy create, without any
+// rules, only to notice when the iptables rules are flushed.
+var canaryChains = map[string]bool{
+	"KUBE-KUBELET-CANARY": true,
+	"KUBE-PROXY-CANARY":   true,
+}
+
+// addKubeletManagedChains adds to chains the kubelet and kube-proxy chains
+// declared in an iptables*-save command output.
+func addKubeletManagedChains(chains map[string]bool, output []byte) {
+	for _, chain := range ParseChains(output) {
+		if kubeletManagedChains[chain] {
+			chains[chain] = true
+		}
+	}
+}
+
 // ruleEntriesNum counts how many rules there are in an iptables*-save command
 // output.
 func ruleEntriesNum(iptablesOutput []byte) int {
@@ -0,0 +1,41 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/commands"
+)
+
+// CommandRunner runs external commands. It allows replacing the real iptables
+// binaries, for example with a fake that returns canned save output in tests.
+type CommandRunner interface {
+	// Run runs the binary at path with args and returns its stdout. If it
+	// fails, the error includes its stderr.
+	Run(ctx context.Context, path string, args ...string) ([]byte, error)
+}
+
+// ExecRunner is the CommandRunner that runs the commands with os/exec.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, path string, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	c := exec.CommandContext(ctx, path, args...)
+	c.Stdout = &out
+	err := commands.RunAndReadError(c)
+	return out.Bytes(), err
+}
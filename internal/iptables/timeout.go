@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultProbeTimeout is how long each command run by XtablesMulti can take
+// by default. The save commands can hang if the nft subsystem is wedged.
+const DefaultProbeTimeout = 10 * time.Second
+
+// ErrProbeTimeout is returned, wrapped, when a command run by XtablesMulti
+// doesn't finish in time.
+var ErrProbeTimeout = errors.New("timed out")
+
+// ProbeTimeoutError is returned when a command run to detect the mode doesn't
+// finish in time. It matches ErrProbeTimeout with errors.Is.
+type ProbeTimeoutError struct {
+	// Command is the name of the command, like iptables-nft-save.
+	Command string
+	// Timeout is how long the command was allowed to take.
+	Timeout time.Duration
+}
+
+func (e *ProbeTimeoutError) Error() string {
+	return fmt.Sprintf("%s %s after %s", e.Command, ErrProbeTimeout, e.Timeout)
+}
+
+func (e *ProbeTimeoutError) Is(target error) bool {
+	return target == ErrProbeTimeout
+}
+
+// probeContext returns a copy of ctx that expires after timeout, or ctx itself
+// if timeout is 0.
+func probeContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// probeTimeoutError returns a *ProbeTimeoutError instead of err if command
+// failed because ctx, built by probeContext, expired.
+func probeTimeoutError(ctx context.Context, command string, timeout time.Duration, err error) error {
+	if err != nil && timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &ProbeTimeoutError{Command: command, Timeout: timeout}
+	}
+	return err
+}
+
+// TimeoutTracker wraps an Installation, keeping the first error of the save
+// commands run through it that timed out. Once one has, the following ones
+// fail right away with the same error instead of being run.
+type TimeoutTracker struct {
+	Installation
+	// mu guards err, since the save commands can run concurrently.
+	mu  sync.Mutex
+	err error
+}
+
+// NewTimeoutTracker returns a TimeoutTracker for installation.
+func NewTimeoutTracker(installation Installation) *TimeoutTracker {
+	return &TimeoutTracker{Installation: installation}
+}
+
+func (t *TimeoutTracker) LegacySave(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return t.track(t.Installation.LegacySave, ctx, out, args)
+}
+
+func (t *TimeoutTracker) LegacySaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return t.track(t.Installation.LegacySaveIP6, ctx, out, args)
+}
+
+func (t *TimeoutTracker) NFTSave(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return t.track(t.Installation.NFTSave, ctx, out, args)
+}
+
+func (t *TimeoutTracker) NFTSaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return t.track(t.Installation.NFTSaveIP6, ctx, out, args)
+}
+
+func (t *TimeoutTracker) track(save func(context.Context, *bytes.Buffer, ...string) error, ctx context.Context, out *bytes.Buffer, args []string) error {
+	if err := t.Err(); err != nil {
+		return err
+	}
+	err := save(ctx, out, args...)
+	if errors.Is(err, ErrProbeTimeout) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.err == nil {
+			t.err = err
+		}
+	}
+	return err
+}
+
+// Err returns the error of the first save command that timed out, if any.
+func (t *TimeoutTracker) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// versionNumberRegex matches the version number in `iptables --version`, with
+// or without the leading v and ignoring any distro suffix, like
+// `iptables v1.8.7 (nf_tables)` or `iptables 1.8.2-3.el8`.
+var versionNumberRegex = regexp.MustCompile(`\bv?(\d+(?:\.\d+)+)`)
+
+// Version is an iptables version number, like 1.8.7.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// ParseVersion parses a version number like 1.8.7 or 1.8. Missing parts are 0.
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q, expected <major>.<minor>.<patch>", s)
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q, expected <major>.<minor>.<patch>", s)
+		}
+		numbers[i] = n
+	}
+	return Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// Less returns true if v is older than other.
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// badVersionRange is a range of iptables versions with a known bug.
+type badVersionRange struct {
+	// from is the first version with the bug.
+	from Version
+	// fixed is the first version without the bug again.
+	fixed Version
+	// bug describes what's wrong with these versions.
+	bug string
+}
+
+// badVersions are the iptables versions with known bugs that affect Kubernetes
+// in nft mode. There was no nft mode before 1.8.0.
+var badVersions = []badVersionRange{
+	{
+		from:  Version{1, 8, 0},
+		fixed: Version{1, 8, 3},
+		bug:   "has nft compatibility bugs, like rules added with -A not found by -C",
+	},
+	{
+		from:  Version{1, 8, 3},
+		fixed: Version{1, 8, 4},
+		bug:   "gets stuck in an infinite loop if it can't load the nf_tables kernel module",
+	},
+}
+
+// BadVersionError is returned when iptables is a version with known
+// compatibility bugs.
+type BadVersionError struct {
+	// Version is the version number, like 1.8.2.
+	Version string
+	// Output is the full output of `iptables --version`.
+	Output string
+	// Bug describes what's wrong with the version.
+	Bug string
+}
+
+func (e *BadVersionError) Error() string {
+	return fmt.Sprintf("iptables %s %s (%s), upgrade to %s or newer", e.Version, e.Bug, strings.TrimSpace(e.Output), minSafeVersion)
+}
+
+// minSafeVersion is the first iptables version newer than all the ones with
+// known bugs.
+var minSafeVersion = func() Version {
+	var min Version
+	for _, r := range badVersions {
+		if min.Less(r.fixed) {
+			min = r.fixed
+		}
+	}
+	return min
+}()
+
+// CheckVersion runs `iptables --version` for the given mode and returns a
+// *BadVersionError if it's a version with known compatibility bugs, like 1.8.0
+// to 1.8.3. If the version can't be read, that error is returned instead.
+func CheckVersion(ctx context.Context, installation XtablesMulti, mode Mode) error {
+	output, err := installation.Version(ctx, mode)
+	if err != nil {
+		return err
+	}
+	return CheckVersionOutput(output)
+}
+
+// CheckVersionOutput works like CheckVersion, but checks the output of an
+// `iptables --version` that was already run. Output without a version
+// number is not considered bad.
+func CheckVersionOutput(versionOutput string) error {
+	version, err := ParseVersion(VersionNumber(versionOutput))
+	if err != nil {
+		return nil
+	}
+	for _, r := range badVersions {
+		if !version.Less(r.from) && version.Less(r.fixed) {
+			return &BadVersionError{Version: version.String(), Output: versionOutput, Bug: r.bug}
+		}
+	}
+	return nil
+}
+
+// VersionNumber returns the version number, like 1.8.7, in the output of
+// `iptables --version`, or an empty string if there is none.
+func VersionNumber(versionOutput string) string {
+	match := versionNumberRegex.FindStringSubmatch(versionOutput)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckVersionOutput(t *testing.T) {
+	for _, tc := range []struct {
+		output     string
+		wantNumber string
+		// wantBad is the version number in the *BadVersionError, if any.
+		wantBad string
+	}{
+		{output: "iptables v1.6.1\n", wantNumber: "1.6.1"},
+		{output: "iptables v1.8.0 (nf_tables)\n", wantNumber: "1.8.0", wantBad: "1.8.0"},
+		{output: "iptables v1.8.2 (legacy)\n", wantNumber: "1.8.2", wantBad: "1.8.2"},
+		{output: "iptables 1.8.2-3.el8\n", wantNumber: "1.8.2", wantBad: "1.8.2"},
+		{output: "iptables v1.8.3 (nf_tables)\n", wantNumber: "1.8.3", wantBad: "1.8.3"},
+		{output: "iptables v1.8.4 (nf_tables)\n", wantNumber: "1.8.4"},
+		{output: "iptables v1.8.7 (nf_tables)\n", wantNumber: "1.8.7"},
+		{output: "iptables v1.8.9 (nf_tables)\n", wantNumber: "1.8.9"},
+		// A missing patch number is 0.
+		{output: "iptables v1.8 (legacy)\n", wantNumber: "1.8", wantBad: "1.8.0"},
+		// Malformed outputs aren't considered bad.
+		{output: ""},
+		{output: "iptables (nf_tables)\n"},
+		{output: "iptables vX.Y.Z\n"},
+		{output: "iptables v1.8.2.1\n", wantNumber: "1.8.2.1"},
+	} {
+		t.Run(tc.output, func(t *testing.T) {
+			if got := VersionNumber(tc.output); got != tc.wantNumber {
+				t.Errorf("VersionNumber(%q) = %q, want %q", tc.output, got, tc.wantNumber)
+			}
+
+			err := CheckVersionOutput(tc.output)
+			var badVersion *BadVersionError
+			switch {
+			case tc.wantBad == "" && err != nil:
+				t.Errorf("CheckVersionOutput(%q) = %v, want no error", tc.output, err)
+			case tc.wantBad != "" && !errors.As(err, &badVersion):
+				t.Errorf("CheckVersionOutput(%q) = %v, want a *BadVersionError", tc.output, err)
+			case tc.wantBad != "" && (badVersion.Version != tc.wantBad || badVersion.Output != tc.output):
+				t.Errorf("CheckVersionOutput(%q) = %+v, want version %s", tc.output, badVersion, tc.wantBad)
+			}
+		})
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(fakeRunner{
+		outputs: map[string]string{
+			"xtables-nft-multi iptables --version":    "iptables v1.8.3 (nf_tables)\n",
+			"xtables-legacy-multi iptables --version": "iptables v1.8.4 (legacy)\n",
+		},
+	})
+
+	var badVersion *BadVersionError
+	if err := CheckVersion(context.Background(), installation, NFT); !errors.As(err, &badVersion) || badVersion.Version != "1.8.3" {
+		t.Errorf("CheckVersion(nft) = %v, want a *BadVersionError for 1.8.3", err)
+	}
+	if err := CheckVersion(context.Background(), installation, Legacy); err != nil {
+		t.Errorf("CheckVersion(legacy) = %v, want no error", err)
+	}
+
+	failing := installation.WithRunner(fakeRunner{errs: map[string]string{
+		"xtables-nft-multi iptables --version": "exit status 1",
+	}})
+	if err := CheckVersion(context.Background(), failing, NFT); err == nil || errors.As(err, &badVersion) {
+		t.Errorf("CheckVersion() with a failing command = %v, want its error", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    Version
+		wantErr bool
+	}{
+		{s: "1.8.7", want: Version{1, 8, 7}},
+		{s: "1.8", want: Version{1, 8, 0}},
+		{s: "1", want: Version{1, 0, 0}},
+		{s: "", wantErr: true},
+		{s: "1.8.x", wantErr: true},
+		{s: "1.8.2.1", wantErr: true},
+		{s: "1.-8.2", wantErr: true},
+	} {
+		got, err := ParseVersion(tc.s)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseVersion(%q) = %v, %v, want %v, error %v", tc.s, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
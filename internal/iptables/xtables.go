@@ -16,10 +16,16 @@ package iptables
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/kubernetes-sigs/iptables-wrappers/internal/commands"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/netns"
 )
 
 const (
@@ -30,7 +36,8 @@ const (
 // Installation represents the set of iptables-*-save binaries installed in a machine.
 // It is expected the machine supports both nft and legacy modes. This can be implemented by
 // calling directly iptables-*-save, xtables, etc. The implementation should accept the same
-// command arguments as the mentioned binaries.
+// command arguments as the mentioned binaries. The detection runs several
+// commands at the same time, so implementations must be safe for concurrent use.
 type Installation interface {
 	// LegacySave runs a iptables-legacy-save command
 	LegacySave(ctx context.Context, out *bytes.Buffer, args ...string) error
@@ -43,46 +50,277 @@ type Installation interface {
 }
 
 func NewXtablesMultiInstallation(sbinPath string) XtablesMulti {
-	return XtablesMulti{
-		nftBinary:    filepath.Join(sbinPath, xtablesNFTMultiBinaryName),
-		legacyBinary: filepath.Join(sbinPath, xtablesLegacyMultiBinaryName),
-	}
+	return XtablesMulti{sbinPath: sbinPath, timeout: DefaultProbeTimeout}.WithProbeConcurrency(DefaultProbeConcurrency)
 }
 
+// DefaultProbeConcurrency is how many commands XtablesMulti runs at the same
+// time by default. The detection runs the save commands of both modes and IP
+// families, and of several tables, concurrently, which on a constrained node
+// shouldn't mean as many processes at once.
+const DefaultProbeConcurrency = 4
+
 // XtablesMulti allows to run iptables commands using xtables-*-multi.
 // It implements iptablesInstallation.
 type XtablesMulti struct {
-	nftBinary    string
-	legacyBinary string
+	sbinPath string
+	// prefix is prepended to every command, allowing to run them through
+	// a different program, like nsenter.
+	prefix []string
+	// env is added to the environment of every command.
+	env []string
+	// timeout limits how long each command can take, 0 means no limit.
+	timeout time.Duration
+	// netns is the network namespace every command is run in, if set.
+	netns string
+	// runner runs the commands instead of os/exec, if set.
+	runner CommandRunner
+	// slots limits how many commands run at the same time, with one element
+	// per running command. It's shared by the copies of x. If nil, there is
+	// no limit.
+	slots chan struct{}
+}
+
+// WithCommandPrefix returns a copy of x that runs all commands prefixed by the given
+// command and arguments. For example, with `nsenter --target 1 --net`, the save
+// commands will be run in PID 1's network namespace.
+func (x XtablesMulti) WithCommandPrefix(prefix ...string) XtablesMulti {
+	x.prefix = prefix
+	return x
+}
+
+// WithEnv returns a copy of x that runs all commands with the given variables, in
+// the form "key=value", added to the current environment.
+func (x XtablesMulti) WithEnv(env ...string) XtablesMulti {
+	x.env = env
+	return x
+}
+
+// WithTimeout returns a copy of x that kills every command that takes longer than
+// timeout, returning a *ProbeTimeoutError. Each command gets its own timeout,
+// so a slow command doesn't eat the time of the next ones. With 0, commands can
+// take as long as ctx allows.
+func (x XtablesMulti) WithTimeout(timeout time.Duration) XtablesMulti {
+	x.timeout = timeout
+	return x
+}
+
+// WithNetns returns a copy of x that runs all commands in the network namespace at
+// path, like /proc/<pid>/ns/net. Each command enters it on its own, so they can
+// be run concurrently from any goroutine.
+func (x XtablesMulti) WithNetns(path string) XtablesMulti {
+	x.netns = path
+	return x
+}
+
+// WithRunner returns a copy of x that runs all commands with runner, instead of
+// with os/exec directly. The runner gets the full command line, including the
+// prefix, and is responsible for the environment and network namespace.
+func (x XtablesMulti) WithRunner(runner CommandRunner) XtablesMulti {
+	x.runner = runner
+	return x
+}
+
+// WithProbeConcurrency returns a copy of x that runs at most n commands at the
+// same time, counting the ones run by its own copies. The rest wait for one of
+// them to finish. With 0, there is no limit. By default, it's
+// DefaultProbeConcurrency.
+func (x XtablesMulti) WithProbeConcurrency(n int) XtablesMulti {
+	x.slots = nil
+	if n > 0 {
+		x.slots = make(chan struct{}, n)
+	}
+	return x
+}
+
+// SbinPath returns the folder the iptables binaries are run from.
+func (x XtablesMulti) SbinPath() string {
+	return x.sbinPath
 }
 
 func (x XtablesMulti) LegacySave(ctx context.Context, out *bytes.Buffer, args ...string) error {
-	return x.exec(ctx, out, x.legacyBinary, "iptables-save", args...)
+	return x.exec(ctx, out, Legacy, "iptables-save", args...)
 }
 
 func (x XtablesMulti) LegacySaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
-	return x.exec(ctx, out, x.legacyBinary, "ip6tables-save", args...)
+	return x.exec(ctx, out, Legacy, "ip6tables-save", args...)
 }
 
 func (x XtablesMulti) NFTSave(ctx context.Context, out *bytes.Buffer, args ...string) error {
-	return x.exec(ctx, out, x.nftBinary, "iptables-save", args...)
+	return x.exec(ctx, out, NFT, "iptables-save", args...)
 }
 
 func (x XtablesMulti) NFTSaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
-	return x.exec(ctx, out, x.nftBinary, "ip6tables-save", args...)
+	return x.exec(ctx, out, NFT, "ip6tables-save", args...)
+}
+
+// Version returns the output of `iptables --version` for the given mode.
+func (x XtablesMulti) Version(ctx context.Context, mode Mode) (string, error) {
+	out := &bytes.Buffer{}
+	if err := x.exec(ctx, out, mode, "iptables", "--version"); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// NFTRuleset writes the output of `nft list ruleset`, run like the save
+// commands, to out. nft is looked for in the sbin folder first, and then in
+// PATH. It fails if it's not installed.
+func (x XtablesMulti) NFTRuleset(ctx context.Context, out *bytes.Buffer) error {
+	binary := filepath.Join(x.sbinPath, "nft")
+	if !files.ExecutableExists(binary) {
+		var err error
+		if binary, err = exec.LookPath("nft"); err != nil {
+			return err
+		}
+	}
+	release, err := x.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := probeContext(ctx, x.timeout)
+	defer cancel()
+	err = x.run(ctx, out, binary, []string{"list", "ruleset"}, nil)
+	return probeTimeoutError(ctx, "nft", x.timeout, err)
+}
+
+func (x XtablesMulti) exec(ctx context.Context, out *bytes.Buffer, mode Mode, command string, args ...string) error {
+	release, err := x.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := probeContext(ctx, x.timeout)
+	defer cancel()
+
+	binary, multi := ModeBinary(x.sbinPath, mode, command)
+	binaryArgs := args
+	if multi {
+		binaryArgs = append([]string{command}, args...)
+	}
+	// Pass the applet name as argv[0] instead of relying on the multi binary
+	// falling back to argv[1] when argv[0] is not a known applet.
+	argv := append([]string{command}, args...)
+	return x.timeoutError(ctx, mode, command, x.run(ctx, out, binary, binaryArgs, argv))
 }
 
-func (x XtablesMulti) exec(ctx context.Context, out *bytes.Buffer, multiBinary, command string, args ...string) error {
-	allArgs := make([]string, 0, len(args)+1)
-	allArgs = append(allArgs, command)
-	allArgs = append(allArgs, args...)
+// acquire waits until x can run one more command, and returns the function to
+// call once it finishes. The wait doesn't count for the timeout of the command.
+func (x XtablesMulti) acquire(ctx context.Context) (func(), error) {
+	if x.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case x.slots <- struct{}{}:
+		return func() { <-x.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run runs binary with binaryArgs, through the prefix, runner, environment and
+// network namespace of x. Without a prefix nor a runner, argv, if set, is the
+// full argv of the process.
+func (x XtablesMulti) run(ctx context.Context, out *bytes.Buffer, binary string, binaryArgs, argv []string) error {
+	allArgs := make([]string, 0, len(x.prefix)+len(binaryArgs))
+	if len(x.prefix) > 0 {
+		allArgs = append(allArgs, x.prefix[1:]...)
+		allArgs = append(allArgs, binary)
+		binary = x.prefix[0]
+	}
+	allArgs = append(allArgs, binaryArgs...)
+
+	if x.runner != nil {
+		output, err := x.runner.Run(ctx, binary, allArgs...)
+		out.Write(output)
+		return err
+	}
 
-	c := exec.CommandContext(ctx, multiBinary, allArgs...)
+	c := exec.CommandContext(ctx, binary, allArgs...)
+	if len(x.prefix) == 0 && argv != nil {
+		c.Args = argv
+	}
+	if len(x.env) > 0 {
+		c.Env = append(os.Environ(), x.env...)
+	}
 	c.Stdout = out
 
+	if x.netns != "" {
+		return netns.Do(x.netns, func() error { return commands.RunAndReadError(c) })
+	}
 	return commands.RunAndReadError(c)
 }
 
+// timeoutError returns a *ProbeTimeoutError instead of err if the command
+// failed because it took longer than the timeout.
+func (x XtablesMulti) timeoutError(ctx context.Context, mode Mode, command string, err error) error {
+	return probeTimeoutError(ctx, filepath.Base(AppletPath(x.sbinPath, mode, command)), x.timeout, err)
+}
+
+// ModeBinary returns the binary to run applet with in the given mode. That's the
+// `xtables-<mode>-multi` binary when it's installed, in which case it returns true.
+// Otherwise it's the applet's own binary for the mode, e.g. `iptables-nft-save` for
+// `iptables-save`, which some images provide as a standalone binary or a shell script.
+func ModeBinary(sbinPath string, mode Mode, applet string) (string, bool) {
+	appletPath := AppletPath(sbinPath, mode, applet)
+	if !MultiHasApplet(mode, applet) {
+		return appletPath, false
+	}
+
+	multiPath := XtablesPath(sbinPath, mode)
+	if files.ExecutableExists(multiPath) {
+		return multiPath, true
+	}
+
+	if files.ExecutableExists(appletPath) {
+		return appletPath, false
+	}
+
+	// Neither is installed, return the multi binary so errors refer to it.
+	return multiPath, true
+}
+
+// MultiHasApplet checks if the `xtables-<mode>-multi` binary provides applet.
+// Only the nft one includes arptables and ebtables, their legacy versions are
+// standalone binaries like `ebtables-legacy`.
+func MultiHasApplet(mode Mode, applet string) bool {
+	return mode != Legacy || !IsArpEbtablesCommand(applet)
+}
+
+// AppletPath returns the path to the binary for applet in the given mode,
+// e.g. `/usr/sbin/iptables-nft-save` for `iptables-save` in nft mode.
+func AppletPath(sbinPath string, mode Mode, applet string) string {
+	name, suffix := applet, ""
+	if i := strings.Index(applet, "-"); i >= 0 {
+		name, suffix = applet[:i], applet[i:]
+	}
+	return filepath.Join(sbinPath, name+"-"+string(mode)+suffix)
+}
+
+// ModeAvailable checks if the `xtables-<mode>-multi` binary for mode is installed in
+// the sbin folder of installation and that it works, running it like the save
+// commands. If it's not installed it returns false, if it's installed but it fails
+// to run it returns false and the error.
+func ModeAvailable(ctx context.Context, installation XtablesMulti, mode Mode) (bool, error) {
+	if !ModeInstalled(installation.sbinPath, mode) {
+		return false, nil
+	}
+	if _, err := installation.Version(ctx, mode); err != nil {
+		binary, _ := ModeBinary(installation.sbinPath, mode, "iptables")
+		return false, fmt.Errorf("%s is not functional: %v", binary, err)
+	}
+	return true, nil
+}
+
+// ModeInstalled checks if the binary running the iptables commands in mode is
+// installed in sbinPath, without running it.
+func ModeInstalled(sbinPath string, mode Mode) bool {
+	binary, _ := ModeBinary(sbinPath, mode, "iptables")
+	return files.ExecutableExists(binary)
+}
+
 // XtablesPath returns the path to the `xtable-<mode>-multi binary
 func XtablesPath(sbinPath string, mode Mode) string {
 	return filepath.Join(sbinPath, "xtables-"+string(mode)+"-multi")
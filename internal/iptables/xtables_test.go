@@ -0,0 +1,89 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestModeAvailable(t *testing.T) {
+	sbinPath := t.TempDir()
+	// The binaries fail when run directly, so they only work through the
+	// runner of the installation.
+	for _, name := range []string{"xtables-nft-multi", "xtables-legacy-multi"} {
+		if err := os.WriteFile(filepath.Join(sbinPath, name), []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	installation := NewXtablesMultiInstallation(sbinPath).WithRunner(fakeRunner{
+		outputs: map[string]string{"xtables-nft-multi iptables --version": "iptables v1.8.9 (nf_tables)\n"},
+		errs:    map[string]string{"xtables-legacy-multi iptables --version": "exit status 1"},
+	})
+
+	if available, err := ModeAvailable(context.Background(), installation, NFT); !available || err != nil {
+		t.Errorf("ModeAvailable(nft) = %v, %v, want true", available, err)
+	}
+	if available, err := ModeAvailable(context.Background(), installation, Legacy); available || err == nil {
+		t.Errorf("ModeAvailable(legacy) = %v, %v, want false and the error", available, err)
+	}
+
+	missing := NewXtablesMultiInstallation(t.TempDir()).WithRunner(fakeRunner{})
+	if available, err := ModeAvailable(context.Background(), missing, NFT); available || err != nil {
+		t.Errorf("ModeAvailable() without the binary = %v, %v, want false without error", available, err)
+	}
+}
+
+// countingRunner is a CommandRunner whose commands take a while, counting
+// the most that ran at the same time.
+type countingRunner struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (r *countingRunner) Run(ctx context.Context, _ string, _ ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.running++
+	if r.running > r.max {
+		r.max = r.running
+	}
+	r.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	r.mu.Lock()
+	r.running--
+	r.mu.Unlock()
+	return []byte(saveOutput("mangle", []string{"KUBE-IPTABLES-HINT"}, 1)), nil
+}
+
+func TestXtablesMultiProbeConcurrency(t *testing.T) {
+	for _, limit := range []int{1, 2, DefaultProbeConcurrency} {
+		runner := &countingRunner{}
+		installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(runner).WithProbeConcurrency(limit)
+		// The kubelet chains are found in both modes, so the detection runs
+		// the save commands of every table and family.
+		if _, found := NewDetector(installation).WithAllTables(true).WithNFTKernelProbe(nil).KubeletModeDetailed(context.Background()); !found {
+			t.Fatalf("KubeletModeDetailed() didn't find the kubelet chains")
+		}
+		if runner.max != limit {
+			t.Errorf("with a limit of %d, %d commands ran at the same time", limit, runner.max)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package netns runs code inside other network namespaces.
+package netns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Do runs fn with the current OS thread switched to the network namespace at
+// path, like /proc/<pid>/ns/net or /run/netns/<name>, and switches it back
+// afterwards. The commands fn runs inherit the namespace, as long as they are
+// started from the same goroutine. fn must not start goroutines that rely on
+// being in the namespace, since only the calling thread is switched.
+func Do(path string, fn func() error) error {
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening network namespace: %v", err)
+	}
+	defer target.Close()
+
+	// The namespace is a property of the thread, so the goroutine must stay
+	// on it until the original namespace is restored.
+	runtime.LockOSThread()
+	original, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("opening the current network namespace: %v", err)
+	}
+	defer original.Close()
+
+	if err := setns(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("entering network namespace %s: %v", path, err)
+	}
+
+	fnErr := fn()
+
+	if err := setns(original); err != nil {
+		// Leave the thread locked, so it's terminated when the goroutine
+		// exits instead of being reused in the wrong namespace.
+		return fmt.Errorf("restoring the original network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// setns switches the current thread to the network namespace of ns.
+func setns(ns *os.File) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, ns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
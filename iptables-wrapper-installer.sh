@@ -16,7 +16,7 @@
 
 # Usage:
 #
-#   iptables-wrapper-installer.sh [--no-sanity-check]
+#   iptables-wrapper-installer.sh [--no-sanity-check] [--no-cleanup] [--manifest FILE]
 #
 # Installs a wrapper iptables script in a container that will figure out
 # whether iptables-legacy or iptables-nft is in use on the host and then
@@ -27,6 +27,11 @@
 #
 # Unless "--no-cleanup" is passed, it will remove this script and
 # iptables-wrapper in the current directory.
+#
+# If "--manifest FILE" is passed, it will write to FILE the list of links
+# pointed at the wrapper, one per line, alongside the wrapper version and
+# the alternatives system used, so the install can be audited or reverted
+# with "iptables-wrapper uninstall --manifest FILE".
 
 # NOTE: This can only use POSIX /bin/sh features; the build container
 # might not contain bash.
@@ -66,6 +71,7 @@ fi
 
 no_sanity_check=""
 no_cleanup=""
+manifest=""
 
 while [ $# -gt 0 ]; do
     case "$1" in
@@ -75,6 +81,14 @@ while [ $# -gt 0 ]; do
     --no-cleanup)
         no_cleanup=1
         ;;
+    --manifest)
+        if [ $# -lt 2 ]; then
+            echo "ERROR: --manifest requires a file argument" 1>&2
+            exit 1
+        fi
+        manifest="$2"
+        shift
+        ;;
     *)
         echo "ERROR: unknown option: $1" 1>&2
         exit 1
@@ -142,6 +156,19 @@ case "${altstyle}" in
 	;;
 esac
 
+# Write the install manifest. It's written to a temporary file first so
+# readers never see a partial manifest.
+if [ -n "${manifest}" ]; then
+    {
+        printf 'version\t%s\n' "$("${sbin}/iptables-wrapper" version)"
+        printf 'altstyle\t%s\n' "${altstyle}"
+        for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+            printf 'link\t%s\t%s\n' "${sbin}/${cmd}" "${sbin}/iptables-wrapper"
+        done
+    } > "${manifest}.tmp"
+    mv -f "${manifest}.tmp" "${manifest}"
+fi
+
 # Cleanup
 if [ -z "${no_cleanup}" ]; then
     rm -f "$0" "${iptables_wrapper_path}"
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// lockPolicyFail returns the lock contention error as is.
+	lockPolicyFail = "fail"
+	// lockPolicyRetry retries the command a number of times, given as
+	// retry-N, while the lock is held.
+	lockPolicyRetry = "retry"
+	// lockPolicyWait runs the command again with --wait, blocking until
+	// the lock is released.
+	lockPolicyWait = "wait"
+)
+
+// exitResourceProblem is the exit code iptables uses when another process is
+// holding the xtables lock.
+const exitResourceProblem = 4
+
+// lockRetryInterval is how long to wait between retries with lockPolicyRetry.
+const lockRetryInterval = time.Second
+
+// lockPolicy is how the wrapper handles the re-executed command failing
+// because the xtables lock is held.
+type lockPolicy struct {
+	name    string
+	retries int
+}
+
+// parseLockPolicy parses the lock policy from the environment, lockPolicyFail by default.
+func parseLockPolicy() (lockPolicy, error) {
+	value := os.Getenv(lockPolicyEnv)
+	switch {
+	case value == "" || value == lockPolicyFail:
+		return lockPolicy{name: lockPolicyFail}, nil
+	case value == lockPolicyWait:
+		return lockPolicy{name: lockPolicyWait}, nil
+	case strings.HasPrefix(value, lockPolicyRetry+"-"):
+		retries, err := strconv.Atoi(strings.TrimPrefix(value, lockPolicyRetry+"-"))
+		if err != nil || retries < 1 {
+			return lockPolicy{}, fmt.Errorf("invalid %s %q, the number of retries must be a positive number", lockPolicyEnv, value)
+		}
+		return lockPolicy{name: lockPolicyRetry, retries: retries}, nil
+	default:
+		return lockPolicy{}, fmt.Errorf("invalid %s %q, must be %s, %s-N or %s", lockPolicyEnv, value, lockPolicyFail, lockPolicyRetry, lockPolicyWait)
+	}
+}
+
+// mayRetry tells if the policy can run the command more than once.
+func (p lockPolicy) mayRetry() bool {
+	return p.name != lockPolicyFail
+}
+
+// run runs the command built by newCmd, applying the policy if it fails because
+// the xtables lock is held. newCmd must return a new command every time, with
+// extraArgs added before the received arguments.
+func (p lockPolicy) run(newCmd func(extraArgs ...string) *exec.Cmd) error {
+	err := runForwardingSignals(newCmd())
+	for attempt := 1; lockHeld(err); attempt++ {
+		switch {
+		case p.name == lockPolicyWait:
+			fmt.Fprintln(os.Stderr, "Warning: the xtables lock is held, waiting for it")
+			return runForwardingSignals(newCmd("--wait"))
+		case p.name == lockPolicyRetry && attempt <= p.retries:
+			fmt.Fprintf(os.Stderr, "Warning: the xtables lock is held, retrying (%d/%d)\n", attempt, p.retries)
+			time.Sleep(lockRetryInterval)
+			err = runForwardingSignals(newCmd())
+		default:
+			return err
+		}
+	}
+	return err
+}
+
+// lockHeld checks if err is the result of a command failing because the
+// xtables lock is held.
+func lockHeld(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == exitResourceProblem
+}
+
+// replayableStdin reads stdin upfront and returns a function that returns a
+// new reader of its content every time. If stdin is a terminal, it's not read
+// and the function always returns it.
+func replayableStdin() (func() io.Reader, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice != 0 {
+		return func() io.Reader { return os.Stdin }, nil
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("reading stdin: %v", err)
+	}
+	return func() io.Reader { return bytes.NewReader(data) }, nil
+}
@@ -23,12 +23,15 @@ The process is as follows:
     kubernetes versions, and it uses the results to guess which mode is in use.
  2. Updates the alternatives/symlinks to point to the proper binaries for the detected mode.
     Depending on the OS it uses `update-alternatives`, `alternatives` or it manually creates symlinks.
- 3. Re-execs the original command received by this binary.
+ 3. Re-execs the original command received by this binary, replacing the wrapper process
+    with it when possible.
 
 We assume this binary has been symlinked to some/all iptables binaries and whatever was received
-here was intended to be an iptables-* command. If that is not the case and this command is either
-executed directly or through a symlink that doesn't point to an iptables binary,
-it will enter an infinite loop, calling itself recursively.
+here was intended to be an iptables-* command. If it's executed through a symlink that isn't an
+iptables command, like `conntrack`, it refuses to run instead of re-executing itself.
+
+When executed directly as `iptables-wrapper`, it doesn't proxy any command and instead runs
+one of its own subcommands, like `iptables-wrapper version`.
 
 It's important to note that this proxy behavior will only happen on the first iptables-*
 execution. Following invocations will use directly the binaries for the selected mode.
@@ -36,19 +39,72 @@ execution. Following invocations will use directly the binaries for the selected
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+	"github.com/kubernetes-sigs/iptables-wrappers/pkg/install"
 )
 
+// wrapperBinaryName is the name the wrapper is installed as. When invoked with
+// this name, instead of an iptables one, the wrapper runs its own subcommands.
+const wrapperBinaryName = "iptables-wrapper"
+
+// exitNoModeDetected is the exit code used when the iptables mode can't be
+// detected and no default mode is configured, so it can be told apart from
+// the errors of the iptables command itself.
+const exitNoModeDetected = 3
+
+// maxDepth is how many times the wrapper can be nested before it assumes
+// it's calling itself. The commands it re-executes are never expected to
+// run an iptables command themselves.
+const maxDepth = 1
+
 func main() {
 	ctx := context.Background()
 
-	sbinPath, err := iptables.DetectBinaryDir()
+	// The applet to run is taken from argv[0], which can be missing if the
+	// wrapper has been executed with an empty argv.
+	if len(os.Args) == 0 || os.Args[0] == "" {
+		fmt.Fprintln(os.Stderr, "Error: iptables-wrapper was executed without argv[0], it must be run through an iptables command symlink or as iptables-wrapper")
+		os.Exit(2)
+	}
+
+	if err := setupLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if filepath.Base(os.Args[0]) == wrapperBinaryName {
+		os.Exit(runCommand(ctx, os.Args[1:]))
+	}
+
+	forward(ctx)
+}
+
+// forward detects the iptables mode in use, updates the iptables binaries to point to it
+// and re-executes the received command with the selected binary.
+func forward(ctx context.Context) {
+	// If the re-executed command leads back to the wrapper, e.g. because it was
+	// invoked through a symlink that isn't an iptables command, it would call
+	// itself forever.
+	depth, _ := strconv.Atoi(os.Getenv(depthEnv))
+	if depth >= maxDepth && !envEnabled(allowRecursionEnv) {
+		fmt.Fprintf(os.Stderr, "Error: iptables-wrapper is calling itself recursively through %s, make sure it's only symlinked from iptables commands (set %s=1 to allow it)\n", filepath.Base(os.Args[0]), allowRecursionEnv)
+		os.Exit(1)
+	}
+
+	sbinPath, err := detectBinaryDir()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		os.Exit(1)
@@ -56,32 +112,304 @@ func main() {
 
 	// We use `xtables-<mode>-multi` binaries by default to inspect the installed rules,
 	// but this can be changed to directly use `iptables-<mode>-save` binaries.
-	mode := iptables.DetectMode(ctx, iptables.NewXtablesMultiInstallation(sbinPath))
+	xtables, err := newInstallation(sbinPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if prefix := strings.Fields(os.Getenv(probePrefixEnv)); len(prefix) > 0 {
+		if _, err := exec.LookPath(prefix[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid %s: %s\n", probePrefixEnv, err)
+			os.Exit(1)
+		}
+		xtables = xtables.WithCommandPrefix(prefix...)
+	}
+	if env := probeEnv(); len(env) > 0 {
+		xtables = xtables.WithEnv(env...)
+	}
+	netnsPath := os.Getenv(netnsEnv)
+	if netnsPath != "" {
+		if _, err := os.Stat(netnsPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid %s: %s\n", netnsEnv, err)
+			os.Exit(1)
+		}
+		// The probes run concurrently on other threads, so they have to enter
+		// the namespace on their own.
+		xtables = xtables.WithNetns(netnsPath)
+	}
+
+	var installation iptables.Installation = xtables
+	debugDir := os.Getenv(debugDirEnv)
+	var recorder *recordingInstallation
+	if debugDir != "" {
+		recorder = &recordingInstallation{Installation: installation}
+		installation = recorder
+	}
+	detector, err := newDetector(installation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	families, err := appletFamilies()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	authoritative, err := authoritativeFamily()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if applet := filepath.Base(os.Args[0]); !knownApplet(applet, families, envList(noSwitchAppletsEnv)) {
+		fmt.Fprintf(os.Stderr, "Error: %s is not an iptables command, iptables-wrapper must only be symlinked from iptables commands\n", applet)
+		os.Exit(1)
+	}
+	outputMode, err := childOutputMode()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	lock, err := parseLockPolicy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	cache, err := newModeCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	readOnly := envEnabled(readOnlyEnv)
+	// Some invocations, like `iptables --version`, don't need the iptables binaries
+	// to be switched for the whole node, so they are run directly like in read-only mode.
+	// The arptables and ebtables commands aren't switched, so they are always run directly.
+	skipSwitch := readOnly || isNonMutating(os.Args, envList(noSwitchAppletsEnv)) || iptables.IsArpEbtablesCommand(os.Args[0])
+
+	var family iptables.Family
+	if readOnly {
+		// Since in read-only mode nothing is switched for the whole node, we can
+		// use the mode of the rules for the IP family of the invoked applet.
+		family = iptables.AppletFamily(os.Args[0], families)
+	} else if authoritative != "" {
+		// The authoritative family decides the mode, even if the other one
+		// has kubelet chains in the other mode.
+		family = authoritative
+	}
+	// The cache holds a single mode for the current network namespace, used for
+	// both IP families, and a forced mode must not end up cached for other tools.
+	if netnsPath != "" || os.Getenv(forceModeEnv) != "" {
+		cache = nil
+	}
+	var mode iptables.Mode
+	cached := false
+	if cache != nil {
+		if mode, cached, err = cache.read(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: reading the mode cache: %s\n", err)
+		} else if cached {
+			slog.Debug("Using the cached iptables mode", "mode", mode, "file", cache.path)
+		}
+	}
+	if !cached {
+		err = inNetns(netnsPath, func() error {
+			mode, err = resolveMode(ctx, xtables, installation, family, strictEnabled())
+			return err
+		})
+	}
+	// A freshly detected mode is only cached once it's known to be the one the
+	// commands use: when switching, the families can change it.
+	detected := !cached && err == nil
+	if recorder != nil {
+		d := decision{Time: time.Now(), Applet: filepath.Base(os.Args[0]), SbinPath: sbinPath, Mode: mode, Probes: recorder.probes}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if err := writeDebugArtifacts(debugDir, d); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: writing debug artifacts: %s\n", err)
+		}
+	}
+	if errors.Is(err, errNoModeDetected) {
+		fmt.Fprintf(os.Stderr, "Error: refusing to run %s: %s\n", filepath.Base(os.Args[0]), err)
+		os.Exit(exitNoModeDetected)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// The known bugs of the old iptables versions only affect nft mode. If the
+	// version can't be read, running the command will tell what's wrong.
+	if mode == iptables.NFT && !envEnabled(noVersionCheckEnv) {
+		var badVersion *iptables.BadVersionError
+		if err := iptables.CheckVersion(ctx, xtables, mode); errors.As(err, &badVersion) {
+			fmt.Fprintf(os.Stderr, "Error: refusing to run %s: %s (set %s=1 to run it anyway)\n", filepath.Base(os.Args[0]), badVersion, noVersionCheckEnv)
+			os.Exit(1)
+		}
+	}
+
+	if metricsPath := os.Getenv(metricsFileEnv); metricsPath != "" {
+		if err := writeModeMetric(metricsPath, mode); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: writing mode metric: %s\n", err)
+		}
+	}
+	if eventPath := os.Getenv(eventFileEnv); eventPath != "" {
+		if err := writeModeEvent(eventPath, mode); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: writing mode event: %s\n", err)
+		}
+	}
+	if socketPath := os.Getenv(decisionSocketEnv); socketPath != "" {
+		sendModeDecision(socketPath, filepath.Base(os.Args[0]), mode)
+	}
 
 	// This re-executes the exact same command passed to this program
 	binaryPath := os.Args[0]
-	var args []string
-	if len(os.Args) > 1 {
-		args = os.Args[1:]
+	args := os.Args[1:]
+
+	if skipSwitch {
+		// Without switching we never touch the alternatives/symlinks, we just run
+		// the command directly with the binary for the detected mode.
+		binaryPath = modeBinary(sbinPath, mode, filepath.Base(os.Args[0]))
+		slog.Debug("Running the mode binary directly, without switching", "mode", mode, "binary", binaryPath)
+		// In read-only mode, the mode was detected for the family of the
+		// command, so it may not hold for the whole node.
+		if detected && !readOnly {
+			writeModeCache(cache, mode)
+		}
+	} else {
+		// A forced mode overrides the detection, and a cached one was only
+		// cached if both families agreed on it, so neither probes them again.
+		detectFamilies := !cached && os.Getenv(forceModeEnv) == ""
+		switchMode, familyModes, warning, err := switchModes(ctx, detector, mode, authoritative, envEnabled(independentFamiliesEnv), strictEnabled(), detectFamilies)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: refusing to switch iptables mode: %s\n", err)
+			os.Exit(1)
+		}
+		if warning != "" {
+			warnf("%s", warning)
+		}
+		mode = switchMode
+
+		if iptables.FirewalldRunning() {
+			if strictEnabled() {
+				fmt.Fprintln(os.Stderr, "Error: refusing to switch iptables mode: firewalld is running")
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stderr, "Warning: firewalld is running, switching the iptables mode underneath it can cause conflicts")
+		}
+
+		selector := iptables.BuildAlternativeSelectorWithRunner(sbinPath, iptables.ExecRunner{}, warnf, families, nil)
+		useMode := func() error { return selector.UseMode(ctx, mode) }
+		// The single mode of the cache can't hold families switched to
+		// different modes.
+		cacheable := true
+		if familyModes != nil {
+			useMode = func() error { return useFamilyModes(ctx, selector, familyModes) }
+			cacheable = familyModes[iptables.IPv4] == familyModes[iptables.IPv6]
+			// If switching fails, run the command with the mode for its own family.
+			mode = familyModes[iptables.AppletFamily(os.Args[0], families)]
+		}
+
+		if err := lockedUseMode(ctx, sbinPath, useMode); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to redirect iptables binaries. %s: %s\n", fallbackHint(), err)
+			// fake it, though this will probably also fail if they aren't root
+			binaryPath = modeBinary(sbinPath, mode, filepath.Base(os.Args[0]))
+		} else {
+			slog.Info("Switched the iptables mode", "mode", mode)
+			// The switch invalidates a cached mode it didn't come from.
+			switch {
+			case cache == nil:
+			case !cacheable:
+				if _, err := resetModeCache(); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+				}
+			case detected:
+				writeModeCache(cache, mode)
+			}
+			if err := runPostSwitchHook(ctx, mode); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: post switch hook failed: %s\n", err)
+			}
+			// When the wrapper is installed outside the sbin folder, e.g. with
+			// `install --bindir`, the invoked command still points to the wrapper
+			// after switching, so run the one in the sbin folder instead.
+			if invoked, err := exec.LookPath(os.Args[0]); err == nil && filepath.Dir(invoked) != sbinPath {
+				binaryPath = filepath.Join(sbinPath, filepath.Base(os.Args[0]))
+			}
+		}
+	}
+
+	stdout, err := childOutput(childStdoutEnv, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	stderr, err := childOutput(childStderrEnv, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
 	}
 
-	selector := iptables.BuildAlternativeSelector(sbinPath)
-	if err := selector.UseMode(ctx, mode); err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to redirect iptables binaries. (Are you running in an unprivileged pod?): %s\n", err)
-		// fake it, though this will probably also fail if they aren't root
-		binaryPath = iptables.XtablesPath(sbinPath, mode)
-		args = os.Args
+	// iptables-restore reads the rules from stdin. If the command might be retried,
+	// stdin is read upfront so it can be passed again to every attempt.
+	stdin := func() io.Reader { return os.Stdin }
+	if lock.mayRetry() && !envEnabled(printCommandEnv) {
+		if stdin, err = replayableStdin(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
 	}
 
-	cmdIPTables := exec.CommandContext(ctx, binaryPath, args...)
-	cmdIPTables.Stdout = os.Stdout
-	cmdIPTables.Stderr = os.Stderr
+	var stdoutBuf, stderrBuf bytes.Buffer
+	newCmd := func(extraArgs ...string) *exec.Cmd {
+		cmdIPTables := childCmd(ctx, binaryPath, filepath.Base(os.Args[0]), append(extraArgs, args...), depth)
+		cmdIPTables.Stdin = stdin()
+
+		if outputMode == outputModeBuffer {
+			// Only the output of the last attempt is kept.
+			stdoutBuf.Reset()
+			stderrBuf.Reset()
+			cmdIPTables.Stdout = &stdoutBuf
+			cmdIPTables.Stderr = &stderrBuf
+		} else {
+			cmdIPTables.Stdout = stdout
+			cmdIPTables.Stderr = stderr
+		}
+		return cmdIPTables
+	}
+
+	if envEnabled(printCommandEnv) {
+		cmdIPTables := newCmd()
+		fmt.Println(strings.Join(append([]string{cmdIPTables.Path}, cmdIPTables.Args...), " "))
+		return
+	}
+
+	// Unless the wrapper has to handle the command output or its result, replace the
+	// wrapper process with the command, so signals, the exit code and the terminal
+	// are handled by iptables itself.
+	// The command is run from the thread switched to the network namespace, so
+	// it's started in it.
+	err = inNetns(netnsPath, func() error {
+		if outputMode == outputModeStream && !lock.mayRetry() && os.Getenv(childStdoutEnv) == "" && os.Getenv(childStderrEnv) == "" {
+			cmdIPTables := newCmd()
+			if cmdIPTables.Err == nil {
+				// This only returns if the process can't be replaced, in which case
+				// the command is run as a child process below.
+				_ = replaceProcess(cmdIPTables.Path, cmdIPTables.Args, cmdIPTables.Env)
+			}
+		}
 
-	if err := cmdIPTables.Run(); err != nil {
+		return lock.run(newCmd)
+	})
+	if outputMode == outputModeBuffer {
+		// The buffered output is written whatever the result of the command,
+		// so the exit code is handled the same way in both modes.
+		_, _ = stdout.Write(stdoutBuf.Bytes())
+		_, _ = stderr.Write(stderrBuf.Bytes())
+	}
+	if err != nil {
 		code := 1
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
-			code = exitErr.ExitCode()
+			code = exitCode(exitErr)
 		} else {
 			// If it's not an ExitError, the command probably didn't finish and something
 			// else failed, which means it might not had outputted anything. In that case,
@@ -91,3 +419,217 @@ func main() {
 		os.Exit(code)
 	}
 }
+
+// writeModeCache writes mode to cache, if it's enabled, only warning if it
+// fails since the mode can still be used.
+func writeModeCache(cache *modeCache, mode iptables.Mode) {
+	if cache == nil {
+		return
+	}
+	if err := cache.write(mode); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: writing the mode cache: %s\n", err)
+	}
+}
+
+// childCmd builds the iptables command run by the wrapper, as applet, with
+// binaryPath. Its environment is the wrapper's, so the variables iptables
+// itself reads, like XTABLES_LIBDIR or XTABLES_LOCKFILE, reach it unchanged,
+// with the depth of the nested wrappers increased.
+func childCmd(ctx context.Context, binaryPath, applet string, args []string, depth int) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, binaryPath, args...)
+	// xtables-<mode>-multi binaries select the command to run based on the base name
+	// of argv[0], so make sure it's always the applet name and not the multi binary
+	// path when running it directly.
+	cmd.Args[0] = applet
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", depthEnv, depth+1))
+	return cmd
+}
+
+// lockedUseMode runs useMode holding the lock on the iptables commands in
+// sbinPath, so it doesn't interleave with an install or another mode switch.
+func lockedUseMode(ctx context.Context, sbinPath string, useMode func() error) error {
+	unlock, err := install.LockDir(ctx, sbinPath, warnf)
+	if errors.Is(err, install.ErrLockTimeout) {
+		return err
+	} else if err != nil {
+		// The lock file can't be created, e.g. because the sbin folder is read
+		// only and the commands are switched through alternatives elsewhere.
+		slog.Debug("Switching the iptables mode without locking", "error", err)
+		return useMode()
+	}
+	defer unlock()
+	return useMode()
+}
+
+// warnf prints a warning to stderr.
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", args...)
+}
+
+// modeBinary returns the binary to run applet directly with in the given mode. Some
+// images don't ship the `xtables-<mode>-multi` binaries, only per applet binaries or
+// scripts, in which case those are run on a best effort basis.
+func modeBinary(sbinPath string, mode iptables.Mode, applet string) string {
+	binary, multi := iptables.ModeBinary(sbinPath, mode, applet)
+	if !multi && iptables.MultiHasApplet(mode, applet) {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not installed, running %s instead\n", iptables.XtablesPath(sbinPath, mode), binary)
+	}
+	return binary
+}
+
+// kubernetesSecretsDir is mounted in all the pods with a service account.
+const kubernetesSecretsDir = "/var/run/secrets/kubernetes.io"
+
+// fallbackHint returns the hint shown when the iptables binaries can't be
+// redirected. It can be set through the environment, otherwise it depends on
+// whether we are running in a Kubernetes pod or not.
+func fallbackHint() string {
+	if hint := os.Getenv(fallbackHintEnv); hint != "" {
+		return hint
+	}
+	if _, err := os.Stat(kubernetesSecretsDir); err == nil {
+		return "(Are you running in an unprivileged pod?)"
+	}
+	return "(Are you running as root?)"
+}
+
+// knownApplet checks if applet is one of the iptables commands the wrapper
+// redirects, or one configured through the environment, either with a family
+// override or as an applet that doesn't switch the mode.
+func knownApplet(applet string, families map[string]iptables.Family, noSwitchApplets []string) bool {
+	if _, ok := families[applet]; ok {
+		return true
+	}
+	for _, names := range [][]string{iptables.Commands, iptables.ArpEbtablesCommands, noSwitchApplets} {
+		for _, name := range names {
+			if name == applet {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// infoFlags are the iptables flags that only print information about the command.
+var infoFlags = map[string]bool{"--version": true, "-V": true, "--help": true, "-h": true}
+
+// isNonMutating checks if the invocation in argv doesn't need to switch the iptables
+// mode for the whole node: either the applet is one of the configured applets or it's
+// only asking for the version or help.
+func isNonMutating(argv []string, applets []string) bool {
+	applet := filepath.Base(argv[0])
+	for _, a := range applets {
+		if a == applet {
+			return true
+		}
+	}
+
+	if len(argv) == 1 {
+		return false
+	}
+	for _, arg := range argv[1:] {
+		if !infoFlags[arg] {
+			return false
+		}
+	}
+	return true
+}
+
+// familiesMode returns the mode to switch both IP families to, given the
+// selected mode. Unless the IPv4 and IPv6 kubelet chains were created with
+// different modes, it's mode, wherever it came from. If they were, it's the
+// mode of the authoritative family, if one is set, along with a warning.
+// Otherwise, it fails if strict is true, or keeps mode with a warning.
+func familiesMode(ctx context.Context, detector iptables.Detector, mode iptables.Mode, authoritative iptables.Family, strict bool) (iptables.Mode, string, error) {
+	modes := detector.FamilyModes(ctx)
+	v4Mode, v4Found := modes[iptables.IPv4]
+	v6Mode, v6Found := modes[iptables.IPv6]
+	if !v4Found || !v6Found || v4Mode == v6Mode {
+		return mode, "", nil
+	}
+
+	disagreement := fmt.Sprintf("IPv4 rules are in %s mode but IPv6 rules are in %s mode", v4Mode, v6Mode)
+	if authoritative != "" {
+		return modes[authoritative], fmt.Sprintf("%s, using the %s mode of the authoritative %s rules", disagreement, modes[authoritative], authoritative), nil
+	}
+	if strict {
+		return "", "", errors.New(disagreement)
+	}
+	return mode, fmt.Sprintf("%s, using %s mode for both", disagreement, mode), nil
+}
+
+// switchModes returns the mode to switch the node to and, if the families are
+// switched independently, the mode of each of them, along with the warning of
+// familiesMode, if any. Without detect, mode is used for both families as is,
+// without inspecting their rules again.
+func switchModes(ctx context.Context, detector iptables.Detector, mode iptables.Mode, authoritative iptables.Family, independent, strict, detect bool) (iptables.Mode, map[iptables.Family]iptables.Mode, string, error) {
+	switch {
+	case !detect:
+		return mode, nil, "", nil
+	case independent:
+		return mode, detectFamilyModes(ctx, detector, mode), "", nil
+	default:
+		mode, warning, err := familiesMode(ctx, detector, mode, authoritative, strict)
+		return mode, nil, warning, err
+	}
+}
+
+// detectFamilyModes detects the mode in use for each IP family independently. For
+// the families where no kubelet chains can be found, it uses defaultMode.
+func detectFamilyModes(ctx context.Context, detector iptables.Detector, defaultMode iptables.Mode) map[iptables.Family]iptables.Mode {
+	modes := detector.FamilyModes(ctx)
+	for _, family := range []iptables.Family{iptables.IPv4, iptables.IPv6} {
+		if _, found := modes[family]; !found {
+			modes[family] = defaultMode
+		}
+	}
+	return modes
+}
+
+// useFamilyModes configures each IP family with its own mode.
+func useFamilyModes(ctx context.Context, selector iptables.AlternativeSelector, modes map[iptables.Family]iptables.Mode) error {
+	for _, family := range []iptables.Family{iptables.IPv4, iptables.IPv6} {
+		if err := selector.UseFamilyMode(ctx, family, modes[family]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// outputModeStream connects the re-executed command output directly to
+	// the wrapper's, so it's written as it's produced.
+	outputModeStream = "stream"
+	// outputModeBuffer keeps the re-executed command output in memory and
+	// writes it once the command exits.
+	outputModeBuffer = "buffer"
+)
+
+// childOutputMode returns how the output of the re-executed command is handled,
+// stream by default.
+func childOutputMode() (string, error) {
+	switch mode := os.Getenv(outputModeEnv); mode {
+	case "":
+		return outputModeStream, nil
+	case outputModeStream, outputModeBuffer:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q, must be %s or %s", outputModeEnv, mode, outputModeStream, outputModeBuffer)
+	}
+}
+
+// childOutput returns the file the re-executed command should write one of its output
+// streams to. If the environment variable env is set, it opens the file it points to
+// in append mode, otherwise it returns def. The file is left open until the wrapper exits.
+func childOutput(env string, def *os.File) (*os.File, error) {
+	path := os.Getenv(env)
+	if path == "" {
+		return def, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", env, err)
+	}
+	return f, nil
+}
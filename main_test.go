@@ -0,0 +1,148 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// fakeRunner is a CommandRunner that returns canned output, or error, for
+// each command line, with the binary by name, like
+// "xtables-legacy-multi iptables-save", and records the command lines it ran.
+type fakeRunner struct {
+	outputs map[string]string
+	errs    map[string]string
+
+	mu  sync.Mutex
+	ran []string
+}
+
+func (r *fakeRunner) Run(_ context.Context, path string, args ...string) ([]byte, error) {
+	cmdline := strings.Join(append([]string{filepath.Base(path)}, args...), " ")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ran = append(r.ran, cmdline)
+	if msg, ok := r.errs[cmdline]; ok {
+		return nil, errors.New(msg)
+	}
+	return []byte(r.outputs[cmdline]), nil
+}
+
+// newFakeDetector returns a Detector for the save outputs in runner, without
+// probing the kernel.
+func newFakeDetector(t *testing.T, runner *fakeRunner) iptables.Detector {
+	return iptables.NewDetector(iptables.NewXtablesMultiInstallation(t.TempDir()).WithRunner(runner)).WithNFTKernelProbe(nil)
+}
+
+const hintSave = "*mangle\n:KUBE-IPTABLES-HINT - [0:0]\nCOMMIT\n"
+
+func TestFamiliesMode(t *testing.T) {
+	agreeing := map[string]string{
+		"xtables-legacy-multi iptables-save":  hintSave,
+		"xtables-legacy-multi ip6tables-save": hintSave,
+	}
+	disagreeing := map[string]string{
+		"xtables-legacy-multi iptables-save":         hintSave,
+		"xtables-nft-multi ip6tables-save -t mangle": hintSave,
+	}
+	for _, tc := range []struct {
+		name          string
+		outputs       map[string]string
+		mode          iptables.Mode
+		authoritative iptables.Family
+		strict        bool
+		want          iptables.Mode
+		wantWarning   bool
+		wantErr       bool
+	}{
+		// The mode passed in can come from the kernel command line, the
+		// cache or the nft probe, and is kept unless the families disagree.
+		{name: "agreeing", outputs: agreeing, mode: iptables.NFT, authoritative: iptables.IPv4, want: iptables.NFT},
+		{name: "only IPv4", outputs: map[string]string{"xtables-legacy-multi iptables-save": hintSave}, mode: iptables.NFT, authoritative: iptables.IPv4, want: iptables.NFT},
+		{name: "no chains", mode: iptables.Legacy, authoritative: iptables.IPv6, want: iptables.Legacy},
+		{name: "disagreeing with IPv4 authoritative", outputs: disagreeing, mode: iptables.NFT, authoritative: iptables.IPv4, strict: true, want: iptables.Legacy, wantWarning: true},
+		{name: "disagreeing with IPv6 authoritative", outputs: disagreeing, mode: iptables.Legacy, authoritative: iptables.IPv6, want: iptables.NFT, wantWarning: true},
+		{name: "disagreeing strict", outputs: disagreeing, mode: iptables.NFT, strict: true, wantErr: true},
+		{name: "disagreeing lenient", outputs: disagreeing, mode: iptables.NFT, want: iptables.NFT, wantWarning: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			detector := newFakeDetector(t, &fakeRunner{outputs: tc.outputs})
+			mode, warning, err := familiesMode(context.Background(), detector, tc.mode, tc.authoritative, tc.strict)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("familiesMode() error = %v, want error %v", err, tc.wantErr)
+			}
+			if mode != tc.want || (warning != "") != tc.wantWarning {
+				t.Errorf("familiesMode() = %s, %q, want %s, warning %v", mode, warning, tc.want, tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestSwitchModes(t *testing.T) {
+	disagreeing := map[string]string{
+		"xtables-legacy-multi iptables-save":         hintSave,
+		"xtables-nft-multi ip6tables-save -t mangle": hintSave,
+	}
+	for _, independent := range []bool{false, true} {
+		// A cached mode is switched to as is, without probing anything.
+		runner := &fakeRunner{outputs: disagreeing}
+		mode, familyModes, warning, err := switchModes(context.Background(), newFakeDetector(t, runner), iptables.NFT, "", independent, true, false)
+		if mode != iptables.NFT || familyModes != nil || warning != "" || err != nil {
+			t.Errorf("switchModes(independent %v) without detection = %s, %v, %q, %v, want nft only", independent, mode, familyModes, warning, err)
+		}
+		if len(runner.ran) != 0 {
+			t.Errorf("switchModes(independent %v) without detection ran %q, want no probes", independent, runner.ran)
+		}
+	}
+
+	runner := &fakeRunner{outputs: disagreeing}
+	mode, familyModes, _, err := switchModes(context.Background(), newFakeDetector(t, runner), iptables.NFT, "", true, true, true)
+	want := map[iptables.Family]iptables.Mode{iptables.IPv4: iptables.Legacy, iptables.IPv6: iptables.NFT}
+	if mode != iptables.NFT || !reflect.DeepEqual(familyModes, want) || err != nil {
+		t.Errorf("switchModes() for independent families = %s, %v, %v, want nft, %v", mode, familyModes, err, want)
+	}
+	if len(runner.ran) == 0 {
+		t.Errorf("switchModes() for independent families didn't probe the rules")
+	}
+}
+
+func TestChildCmd(t *testing.T) {
+	t.Setenv("XTABLES_LIBDIR", "/opt/xtables")
+	t.Setenv(depthEnv, "1")
+	cmd := childCmd(context.Background(), "/usr/sbin/xtables-nft-multi", "iptables-save", []string{"-t", "mangle"}, 1)
+
+	if want := []string{"iptables-save", "-t", "mangle"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("childCmd() args = %q, want %q", cmd.Args, want)
+	}
+	env := map[string]string{}
+	for _, entry := range cmd.Env {
+		// The last value of a variable is the one the command gets.
+		name, value, _ := strings.Cut(entry, "=")
+		env[name] = value
+	}
+	if env["XTABLES_LIBDIR"] != "/opt/xtables" {
+		t.Errorf("childCmd() XTABLES_LIBDIR = %q, want it passed through", env["XTABLES_LIBDIR"])
+	}
+	if env[depthEnv] != "2" {
+		t.Errorf("childCmd() %s = %q, want 2", depthEnv, env[depthEnv])
+	}
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// writeModeMetric writes the selected mode in the Prometheus text format to path,
+// to be exposed by the node-exporter textfile collector. The file is replaced
+// atomically, since the collector can read it at any time.
+func writeModeMetric(path string, mode iptables.Mode) error {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# HELP iptables_wrapper_mode The iptables mode selected by iptables-wrapper.")
+	fmt.Fprintln(&b, "# TYPE iptables_wrapper_mode gauge")
+	for _, m := range []iptables.Mode{iptables.Legacy, iptables.NFT} {
+		value := 0
+		if m == mode {
+			value = 1
+		}
+		fmt.Fprintf(&b, "iptables_wrapper_mode{mode=%q} %d\n", m, value)
+	}
+
+	return files.WriteFileAtomic(path, b.Bytes(), 0o644)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+func TestWriteModeMetric(t *testing.T) {
+	for _, tc := range []struct {
+		mode iptables.Mode
+		want string
+	}{
+		{
+			mode: iptables.NFT,
+			want: `# HELP iptables_wrapper_mode The iptables mode selected by iptables-wrapper.
+# TYPE iptables_wrapper_mode gauge
+iptables_wrapper_mode{mode="legacy"} 0
+iptables_wrapper_mode{mode="nft"} 1
+`,
+		},
+		{
+			mode: iptables.Legacy,
+			want: `# HELP iptables_wrapper_mode The iptables mode selected by iptables-wrapper.
+# TYPE iptables_wrapper_mode gauge
+iptables_wrapper_mode{mode="legacy"} 1
+iptables_wrapper_mode{mode="nft"} 0
+`,
+		},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "iptables_wrapper.prom")
+			// An existing file is replaced, not appended to.
+			if err := os.WriteFile(path, []byte("stale\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := writeModeMetric(path, tc.mode); err != nil {
+				t.Fatalf("writeModeMetric() failed: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("writeModeMetric() wrote:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+const (
+	// kernelCmdlineFirst makes the kernel command line mode take precedence
+	// over the detection.
+	kernelCmdlineFirst = "first"
+	// kernelCmdlineFallback makes the kernel command line mode only be used
+	// if no kubelet chains are found.
+	kernelCmdlineFallback = "fallback"
+
+	// defaultModeNone disables the default mode, making the wrapper
+	// fail instead of guessing when the mode can't be detected.
+	defaultModeNone = "none"
+)
+
+// errNoModeDetected is returned when the mode can't be detected and there
+// is no default mode to use.
+var errNoModeDetected = errors.New("unable to detect the iptables mode and no default mode is configured")
+
+// resolveMode selects the iptables mode to use, combining the kubelet chains detection
+// with the other strategies configured through the environment. If family is not empty,
+// the detection uses only the rules for that IP family, falling back to all rules.
+// If strict is true, it fails instead of guessing when both modes have kubelet chains.
+// The save commands are run through installation, which is xtables or wraps it.
+func resolveMode(ctx context.Context, xtables iptables.XtablesMulti, installation iptables.Installation, family iptables.Family, strict bool) (iptables.Mode, error) {
+	// A forced mode skips the detection entirely, without running any command.
+	if forced := os.Getenv(forceModeEnv); forced != "" {
+		mode, err := iptables.ParseMode(forced)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %v", forceModeEnv, err)
+		}
+		slog.Debug("Using the forced iptables mode", "mode", mode)
+		return mode, nil
+	}
+
+	// A probe that timed out can't tell if there are kubelet chains, so it's
+	// safer to fail than to pick a mode based on the other probes.
+	tracker := iptables.NewTimeoutTracker(installation)
+	mode, err := detectMode(ctx, xtables, tracker, family, strict)
+	if err := tracker.Err(); err != nil {
+		return "", fmt.Errorf("detecting the iptables mode: %w", err)
+	}
+	if err == nil {
+		slog.Info("Selected the iptables mode", "mode", mode, "family", family)
+	}
+	return mode, err
+}
+
+// detectMode runs the detection strategies configured through the environment,
+// in order of priority, until one of them finds the mode.
+func detectMode(ctx context.Context, xtables iptables.XtablesMulti, installation iptables.Installation, family iptables.Family, strict bool) (iptables.Mode, error) {
+	detector, err := newDetector(installation)
+	if err != nil {
+		return "", err
+	}
+	// The kernel support for nf_tables is checked once, for both the
+	// available modes and the detector.
+	nftProbe := iptables.NewNFTKernelProbe(installation)
+	detector = detector.WithNFTKernelProbe(nftProbe)
+
+	// If only one of the modes can be used, there is nothing to detect.
+	available, err := availableModes(ctx, xtables, nftProbe)
+	if err != nil {
+		return "", err
+	}
+	if len(available) == 1 {
+		slog.Debug("Only one iptables mode is available", "mode", available[0])
+		return available[0], nil
+	}
+
+	cmdlinePriority := os.Getenv(kernelCmdlineEnv)
+	var cmdlineMode iptables.Mode
+	cmdlineFound := false
+	switch cmdlinePriority {
+	case "":
+	case kernelCmdlineFirst, kernelCmdlineFallback:
+		cmdlineMode, cmdlineFound, err = iptables.ModeFromKernelCmdline(iptables.KernelCmdlinePath)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("invalid %s %q, must be %s or %s", kernelCmdlineEnv, cmdlinePriority, kernelCmdlineFirst, kernelCmdlineFallback)
+	}
+
+	if cmdlineFound && cmdlinePriority == kernelCmdlineFirst {
+		slog.Debug("Found the iptables mode in the kernel command line", "mode", cmdlineMode)
+		return cmdlineMode, nil
+	}
+
+	// nft knows about the whole nftables ruleset, including the tables created by
+	// iptables-nft, so it can find kubelet chains the save commands miss. If it's
+	// not installed or it fails, continue with the other strategies.
+	nftRulesetFound := false
+	if envEnabled(nftProbeEnv) {
+		found, err := detector.NFTRulesetHasChains(ctx, xtables)
+		if errors.Is(err, iptables.ErrProbeTimeout) {
+			return "", fmt.Errorf("detecting the iptables mode: %w", err)
+		}
+		if found {
+			slog.Debug("Found the kubelet chains in the nft ruleset")
+		}
+		nftRulesetFound = found
+	}
+
+	if family != "" {
+		if mode, found := detector.FamilyMode(ctx, family); found {
+			slog.Debug("Found the kubelet chains for the IP family", "family", family, "mode", mode)
+			return mode, nil
+		}
+	}
+	result, found := detector.KubeletModeDetailed(ctx)
+	if nftRulesetFound {
+		// The chains in the nft ruleset are one more sign of nft, which
+		// conflicts with the save commands only finding them in legacy.
+		if !found {
+			result, found = iptables.DetectionResult{Mode: iptables.NFT}, true
+		} else if result.Mode != iptables.NFT {
+			result.Ambiguous = true
+		}
+	}
+	if found {
+		slog.Debug("Found the kubelet chains", "mode", result.Mode, "family", result.MatchedFamily, "ambiguous", result.Ambiguous)
+		if result.Ambiguous {
+			// Usually left behind by switching the node to the other mode
+			// without flushing the rules of the previous one.
+			conflict := fmt.Sprintf("kubelet chains found in both modes, with %d legacy and %d nft rules", result.LegacyLines, result.NFTLines)
+			if strict {
+				return "", fmt.Errorf("%s, refusing to guess", conflict)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %s, picking %s\n", conflict, result.Mode)
+		}
+		return result.Mode, nil
+	}
+
+	if cmdlineFound {
+		slog.Debug("Found the iptables mode in the kernel command line", "mode", cmdlineMode)
+		return cmdlineMode, nil
+	}
+
+	// Some chains can be known to only be created by user managed legacy rules.
+	if chains := envList(legacyHintChainsEnv); len(chains) > 0 && iptables.HasLegacyChains(ctx, installation, chains) {
+		slog.Debug("Found the legacy hint chains", "chains", chains)
+		return iptables.Legacy, nil
+	}
+
+	// Without any other signal, pick the mode with more rules, like the
+	// original shell wrapper did. If both have the same, it can't be told.
+	if legacyLines, nftLines := iptables.RuleLines(ctx, installation); legacyLines > nftLines {
+		return iptables.Legacy, nil
+	} else if nftLines > legacyLines {
+		return iptables.NFT, nil
+	}
+
+	mode, err := defaultMode()
+	if errors.Is(err, errNoModeDetected) {
+		return "", fmt.Errorf("%w: %s", err, noModeDetails(cmdlinePriority != ""))
+	} else if err != nil {
+		return "", err
+	}
+	return functionalMode(ctx, xtables, mode, available), nil
+}
+
+// functionalMode returns mode, unless its binary fails to run and the other
+// of the available modes works. Only the default mode, picked without any
+// rules to tell it, is checked this way, since the detection strategies
+// already ran the save commands of the mode they found.
+func functionalMode(ctx context.Context, xtables iptables.XtablesMulti, mode iptables.Mode, available []iptables.Mode) iptables.Mode {
+	ok, err := iptables.ModeAvailable(ctx, xtables, mode)
+	if ok || err == nil {
+		return mode
+	}
+	for _, other := range available {
+		if other == mode {
+			continue
+		}
+		if ok, _ := iptables.ModeAvailable(ctx, xtables, other); ok {
+			fmt.Fprintf(os.Stderr, "Warning: %s, using %s mode instead\n", err, other)
+			return other
+		}
+	}
+	return mode
+}
+
+// newDetector builds the kubelet chains detector for installation, configured
+// through the environment.
+func newDetector(installation iptables.Installation) (iptables.Detector, error) {
+	detector := iptables.NewDetector(installation).WithAllTables(envEnabled(allTablesEnv))
+	expr, patterns := os.Getenv(matchRegexEnv), envList(detectPatternsEnv)
+	switch {
+	case expr != "" && len(patterns) > 0:
+		return iptables.Detector{}, fmt.Errorf("%s and %s can't be used together", matchRegexEnv, detectPatternsEnv)
+	case expr != "":
+		regex, err := iptables.CompileMatchRegex(expr)
+		if err != nil {
+			return iptables.Detector{}, fmt.Errorf("invalid %s: %v", matchRegexEnv, err)
+		}
+		detector = detector.WithMatchRegex(regex)
+	case len(patterns) > 0:
+		regex, err := iptables.ChainPatternsRegex(patterns)
+		if err != nil {
+			return iptables.Detector{}, fmt.Errorf("invalid %s: %v", detectPatternsEnv, err)
+		}
+		detector = detector.WithMatchRegex(regex)
+	}
+	return detector, nil
+}
+
+// noModeDetails explains what was probed when no mode could be detected, and
+// how to fix it.
+func noModeDetails(cmdlineProbed bool) string {
+	var details strings.Builder
+	if expr := os.Getenv(matchRegexEnv); expr != "" {
+		fmt.Fprintf(&details, "no matches of %s %q were found", matchRegexEnv, expr)
+	} else if patterns := envList(detectPatternsEnv); len(patterns) > 0 {
+		fmt.Fprintf(&details, "no chains matching %s (%s) were found", detectPatternsEnv, strings.Join(patterns, ", "))
+	} else {
+		details.WriteString("no kubelet chains (KUBE-IPTABLES-HINT or KUBE-KUBELET-CANARY) were found")
+	}
+	details.WriteString(" in the nft mangle tables nor in the legacy tables, for IPv4 and IPv6, and both modes have the same number of rules")
+	if envEnabled(allTablesEnv) {
+		details.WriteString(", nor in the other nft tables")
+	}
+	if envEnabled(nftProbeEnv) {
+		details.WriteString(", nor in the nft ruleset")
+	}
+	if cmdlineProbed {
+		details.WriteString(", and the kernel command line has no iptables_wrapper.mode parameter")
+	}
+	details.WriteString("\nTo fix it, either:\n")
+	details.WriteString("  - wait for kubelet to create its chains and retry\n")
+	details.WriteString("  - check the wrapper runs in the host network namespace, e.g. with hostNetwork: true\n")
+	details.WriteString("  - force a mode with " + defaultModeEnv + "=nft or " + defaultModeEnv + "=legacy")
+	return details.String()
+}
+
+// availableModes returns the modes whose binaries are installed in xtables,
+// leaving out nft if nftProbe tells the kernel can't support it. They aren't
+// run, to not exec them on every invocation, see functionalMode. If none is
+// available, it returns an error including why.
+func availableModes(ctx context.Context, xtables iptables.XtablesMulti, nftProbe *iptables.NFTKernelProbe) ([]iptables.Mode, error) {
+	var available []iptables.Mode
+	var reasons []string
+	for _, mode := range []iptables.Mode{iptables.NFT, iptables.Legacy} {
+		if !iptables.ModeInstalled(xtables.SbinPath(), mode) {
+			reasons = append(reasons, iptables.XtablesPath(xtables.SbinPath(), mode)+" is not installed")
+			continue
+		}
+		if mode == iptables.NFT {
+			// The nft binaries can be installed while the kernel lacks nf_tables
+			// support. In that case, nft mode can't be used at all. If we can't
+			// tell, assume it's supported.
+			if supported, reason := nftProbe.Supported(ctx); !supported {
+				slog.Info("Not using nft mode, the kernel doesn't support nf_tables", "reason", reason)
+				reasons = append(reasons, "the kernel doesn't support nf_tables: "+reason)
+				continue
+			}
+		}
+		available = append(available, mode)
+	}
+
+	if len(available) == 0 {
+		return nil, fmt.Errorf("no iptables mode is available: %s", strings.Join(reasons, "; "))
+	}
+	return available, nil
+}
+
+// defaultMode returns the mode to use when it can't be detected. Unless
+// configured otherwise, it defaults to nft.
+func defaultMode() (iptables.Mode, error) {
+	switch value := os.Getenv(defaultModeEnv); value {
+	case "":
+		return iptables.NFT, nil
+	case defaultModeNone:
+		return "", errNoModeDetected
+	default:
+		mode, err := iptables.ParseMode(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %v", defaultModeEnv, err)
+		}
+		return mode, nil
+	}
+}
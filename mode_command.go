@@ -0,0 +1,122 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// modeCommand prints the mode the wrapper would select, without switching it
+// or running any iptables command.
+func modeCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("mode", flag.ContinueOnError)
+	warningsAsErrors := warningsAsErrorsFlag(flags)
+	strict := flags.Bool("strict", strictEnabled(), "fail instead of guessing when both modes have kubelet chains (default $"+strictEnv+" or $"+strictShortEnv+")")
+	netnsPath := netnsFlag(flags)
+	resetCache := flags.Bool("reset-cache", false, "remove the mode cache file first, so the next runs of the wrapper detect the mode again")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: mode doesn't accept arguments\n")
+		return 2
+	}
+
+	if *resetCache {
+		path, err := resetModeCache()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		if path != "" {
+			slog.Info("Removed the mode cache", "file", path)
+		}
+	}
+
+	sbinPath, err := detectBinaryDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	installation, err := newInstallation(sbinPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if *netnsPath != "" {
+		// The probes run concurrently on other threads, so they have to enter
+		// the namespace on their own.
+		installation = installation.WithNetns(*netnsPath)
+	}
+
+	authoritative, err := authoritativeFamily()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	var mode iptables.Mode
+	var warnings []string
+	err = inNetns(*netnsPath, func() error {
+		if mode, err = resolveMode(ctx, installation, installation, authoritative, *strict); err != nil {
+			return err
+		}
+		warnings, mode = modeWarnings(ctx, installation, mode, authoritative)
+		return nil
+	})
+	if errors.Is(err, errNoModeDetected) {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return exitNoModeDetected
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(mode)
+
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	if len(warnings) > 0 && *warningsAsErrors {
+		fmt.Fprintf(os.Stderr, "Error: %d warnings found\n", len(warnings))
+		return 1
+	}
+	return 0
+}
+
+// modeWarnings returns the conditions that don't prevent selecting a mode, but
+// that can make it the wrong one for some of the rules, and the mode the
+// wrapper would switch both IP families to, see familiesMode.
+func modeWarnings(ctx context.Context, installation iptables.XtablesMulti, mode iptables.Mode, authoritative iptables.Family) ([]string, iptables.Mode) {
+	var warnings []string
+	if available, err := availableModes(ctx, installation, iptables.NewNFTKernelProbe(installation)); err == nil && len(available) == 1 {
+		warnings = append(warnings, fmt.Sprintf("only %s mode is available", available[0]))
+	}
+	if detector, err := newDetector(installation); err == nil && os.Getenv(forceModeEnv) == "" {
+		// Disagreeing families are only a warning here, even with --strict.
+		switchMode, warning, _ := familiesMode(ctx, detector, mode, authoritative, false)
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		mode = switchMode
+	}
+	return warnings, mode
+}
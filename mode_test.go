@@ -0,0 +1,89 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// newFakeSbin returns a folder with the xtables multi binaries for modes.
+func newFakeSbin(t *testing.T, modes ...iptables.Mode) string {
+	sbinPath := t.TempDir()
+	for _, mode := range modes {
+		if err := os.WriteFile(iptables.XtablesPath(sbinPath, mode), []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sbinPath
+}
+
+func TestAvailableModes(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		installed []iptables.Mode
+		want      []iptables.Mode
+	}{
+		{name: "both", installed: []iptables.Mode{iptables.Legacy, iptables.NFT}, want: []iptables.Mode{iptables.NFT, iptables.Legacy}},
+		{name: "legacy", installed: []iptables.Mode{iptables.Legacy}, want: []iptables.Mode{iptables.Legacy}},
+		{name: "none"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			xtables := iptables.NewXtablesMultiInstallation(newFakeSbin(t, tc.installed...)).WithRunner(runner)
+			probe := iptables.NewNFTKernelProbe(xtables)
+			available, err := availableModes(context.Background(), xtables, probe)
+			if (err != nil) != (tc.want == nil) {
+				t.Fatalf("availableModes() error = %v", err)
+			}
+			if !reflect.DeepEqual(available, tc.want) {
+				t.Errorf("availableModes() = %v, want %v", available, tc.want)
+			}
+			for _, cmdline := range runner.ran {
+				if strings.HasSuffix(cmdline, "--version") {
+					t.Errorf("availableModes() ran %q, want only the installed binaries checked", cmdline)
+				}
+			}
+		})
+	}
+}
+
+func TestFunctionalMode(t *testing.T) {
+	sbinPath := newFakeSbin(t, iptables.Legacy, iptables.NFT)
+	available := []iptables.Mode{iptables.NFT, iptables.Legacy}
+	xtables := iptables.NewXtablesMultiInstallation(sbinPath).WithRunner(&fakeRunner{
+		outputs: map[string]string{"xtables-legacy-multi iptables --version": "iptables v1.8.9 (legacy)\n"},
+		errs:    map[string]string{"xtables-nft-multi iptables --version": "exit status 1"},
+	})
+	if mode := functionalMode(context.Background(), xtables, iptables.NFT, available); mode != iptables.Legacy {
+		t.Errorf("functionalMode(nft) with a broken nft binary = %s, want legacy", mode)
+	}
+	if mode := functionalMode(context.Background(), xtables, iptables.Legacy, available); mode != iptables.Legacy {
+		t.Errorf("functionalMode(legacy) = %s, want legacy", mode)
+	}
+
+	// Without a working alternative, the mode is kept so its error is seen.
+	xtables = xtables.WithRunner(&fakeRunner{errs: map[string]string{
+		"xtables-nft-multi iptables --version":    "exit status 1",
+		"xtables-legacy-multi iptables --version": "exit status 1",
+	}})
+	if mode := functionalMode(context.Background(), xtables, iptables.NFT, available); mode != iptables.NFT {
+		t.Errorf("functionalMode(nft) with both broken = %s, want nft", mode)
+	}
+}
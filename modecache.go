@@ -0,0 +1,99 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// defaultModeCacheFile is where the selected mode is cached by default.
+const defaultModeCacheFile = "/run/iptables-mode"
+
+// modeCache is a file the selected mode is written to, so the next runs of
+// the wrapper, and any other tool on the node, can reuse it without running
+// the detection again while it's fresh.
+type modeCache struct {
+	path string
+	ttl  time.Duration
+}
+
+// newModeCache returns the mode cache configured through the environment, or
+// nil if it's disabled, which is the default.
+func newModeCache() (*modeCache, error) {
+	ttl, err := envDuration(modeCacheTTLEnv)
+	if err != nil || ttl == 0 {
+		return nil, err
+	}
+	return &modeCache{path: modeCachePath(), ttl: ttl}, nil
+}
+
+// modeCachePath returns the path of the mode cache file, configured through
+// the environment.
+func modeCachePath() string {
+	if path := os.Getenv(modeCacheFileEnv); path != "" {
+		return path
+	}
+	return defaultModeCacheFile
+}
+
+// resetModeCache removes the mode cache file, even if the cache is disabled,
+// so a stale mode isn't reused once it's enabled again. It returns the path
+// of the file it removed, or an empty string if there was none.
+func resetModeCache() (string, error) {
+	path := modeCachePath()
+	if err := os.Remove(path); errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("removing the mode cache: %v", err)
+	}
+	return path, nil
+}
+
+// read returns the cached mode, if the file was written less than the TTL ago.
+// A missing file is a cache miss.
+func (c *modeCache) read() (iptables.Mode, bool, error) {
+	info, err := os.Stat(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if age := time.Since(info.ModTime()); age > c.ttl {
+		return "", false, nil
+	}
+
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		return "", false, err
+	}
+	mode, err := iptables.ParseMode(strings.TrimSpace(string(content)))
+	if err != nil {
+		return "", false, fmt.Errorf("invalid mode cache file %s: %v", c.path, err)
+	}
+	return mode, true, nil
+}
+
+// write caches mode, replacing the file atomically since other processes can
+// read it at any time.
+func (c *modeCache) write(mode iptables.Mode) error {
+	return files.WriteFileAtomic(c.path, []byte(string(mode)+"\n"), 0o644)
+}
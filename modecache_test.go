@@ -0,0 +1,72 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+func TestModeCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iptables-mode")
+	t.Setenv(modeCacheFileEnv, path)
+	t.Setenv(modeCacheTTLEnv, "1h")
+	cache, err := newModeCache()
+	if err != nil || cache == nil {
+		t.Fatalf("newModeCache() = %v, %v, want an enabled cache", cache, err)
+	}
+
+	if _, found, err := cache.read(); found || err != nil {
+		t.Errorf("read() without a file = %v, %v, want a miss", found, err)
+	}
+	if err := cache.write(iptables.Legacy); err != nil {
+		t.Fatalf("write() failed: %v", err)
+	}
+	if mode, found, err := cache.read(); mode != iptables.Legacy || !found || err != nil {
+		t.Errorf("read() = %s, %v, %v, want the cached legacy mode", mode, found, err)
+	}
+
+	// A stale file is a miss.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := cache.read(); found || err != nil {
+		t.Errorf("read() of a stale file = %v, %v, want a miss", found, err)
+	}
+}
+
+func TestResetModeCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iptables-mode")
+	t.Setenv(modeCacheFileEnv, path)
+	// The file is removed even if the cache is disabled.
+	t.Setenv(modeCacheTTLEnv, "")
+	if err := os.WriteFile(path, []byte("nft\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := resetModeCache(); removed != path || err != nil {
+		t.Errorf("resetModeCache() = %q, %v, want %q", removed, err, path)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the mode cache file is still there: %v", err)
+	}
+	if removed, err := resetModeCache(); removed != "" || err != nil {
+		t.Errorf("resetModeCache() again = %q, %v, want nothing removed", removed, err)
+	}
+}
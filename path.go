@@ -0,0 +1,61 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// pathCommand prints the absolute path of the `xtables-<mode>-multi` binary for
+// a mode, for scripts that want to run it directly instead of through the wrapper.
+func pathCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("path", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: path expects a mode, nft or legacy\n")
+		return 2
+	}
+	mode, err := iptables.ParseMode(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	sbinPath, err := detectBinaryDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	path, err := filepath.Abs(iptables.XtablesPath(sbinPath, mode))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if !files.ExecutableExists(path) {
+		fmt.Fprintf(os.Stderr, "Error: %s is not installed\n", path)
+		return 1
+	}
+
+	fmt.Println(path)
+	return 0
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+)
+
+const (
+	// LockFileName is the file, in the folder with the iptables commands, that
+	// is locked while they are changed, so concurrent installs and mode
+	// switches are serialized instead of interleaved.
+	LockFileName = ".iptables-wrapper.lock"
+	// LockTimeout is how long to wait for the lock when someone else holds it.
+	LockTimeout = 30 * time.Second
+)
+
+// ErrLockTimeout is wrapped by the error LockDir returns when the lock is
+// still held by someone else after LockTimeout. Callers can match it with
+// errors.Is to tell a busy lock from one that can't be taken at all, e.g.
+// because dir is read only.
+var ErrLockTimeout = files.ErrLockTimeout
+
+// LockDir takes the lock on the iptables commands in dir and returns the
+// function that releases it. If someone else holds it, logf, if not nil, is
+// told it's waiting for it. After LockTimeout, it returns an error wrapping
+// ErrLockTimeout.
+func LockDir(ctx context.Context, dir string, logf func(format string, args ...interface{})) (func(), error) {
+	path := filepath.Join(dir, LockFileName)
+	return files.Lock(ctx, path, LockTimeout, func() {
+		if logf != nil {
+			logf("%s is locked by another installation or mode switch, waiting for it", path)
+		}
+	})
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockDirTimeout(t *testing.T) {
+	dir := t.TempDir()
+	unlock, err := LockDir(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatalf("LockDir() error = %v", err)
+	}
+	defer unlock()
+
+	waited := false
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = LockDir(ctx, dir, func(string, ...interface{}) { waited = true })
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("LockDir() on a held lock error = %v, want ErrLockTimeout", err)
+	}
+	if !waited {
+		t.Error("LockDir() on a held lock didn't log that it's waiting")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+)
+
+// Alternatives styles recorded in a Manifest, the same as the installer
+// script's.
+const (
+	// AltStyleNone means the links were created directly.
+	AltStyleNone = "none"
+	// AltStyleDebian means the wrapper was registered with update-alternatives.
+	AltStyleDebian = "debian"
+	// AltStyleFedora means the wrapper was registered with alternatives.
+	AltStyleFedora = "fedora"
+)
+
+// alternativesRemovals are the commands that unregister the wrapper from the
+// alternatives groups the installer script registers it in, by style.
+var alternativesRemovals = map[string]struct {
+	command string
+	groups  []string
+}{
+	AltStyleDebian: {command: "update-alternatives", groups: []string{"iptables", "ip6tables"}},
+	AltStyleFedora: {command: "alternatives", groups: []string{"iptables"}},
+}
+
+// Manifest lists what an install pointed at the wrapper, so it can be audited
+// or reverted. It's written by the install subcommand and the installer
+// script with --manifest, one tab-separated entry per line:
+//
+//	version	<wrapper version>
+//	altstyle	<none, debian or fedora>
+//	link	<path>	<target>	[<previous>	<backup>]
+//
+// previous and backup are only written if the link replaced a symlink or a
+// backed up file, see Link.
+type Manifest struct {
+	// Version is the version of the installed wrapper.
+	Version string
+	// AltStyle is how the links were created, one of the AltStyle constants.
+	AltStyle string
+	// Links are the commands pointed at the wrapper. Only their Path, Target,
+	// Previous and Backup are recorded.
+	Links []Link
+}
+
+// ReadManifest parses the manifest at path.
+func ReadManifest(path string) (Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var m Manifest
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		switch {
+		case fields[0] == "version" && len(fields) == 2:
+			m.Version = fields[1]
+		case fields[0] == "altstyle" && len(fields) == 2:
+			m.AltStyle = fields[1]
+		case fields[0] == "link" && (len(fields) == 3 || len(fields) == 5) && fields[1] != "" && fields[2] != "":
+			link := Link{Path: fields[1], Target: fields[2]}
+			if len(fields) == 5 {
+				link.Previous, link.Backup = fields[3], fields[4]
+			}
+			m.Links = append(m.Links, link)
+		default:
+			return Manifest{}, fmt.Errorf("%s:%d: invalid manifest entry %q", path, n, line)
+		}
+	}
+	if m.AltStyle == "" {
+		m.AltStyle = AltStyleNone
+	}
+	return m, nil
+}
+
+// WriteManifest writes m to path, atomically so readers never see a partial
+// manifest.
+func WriteManifest(path string, m Manifest) error {
+	altStyle := m.AltStyle
+	if altStyle == "" {
+		altStyle = AltStyleNone
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "version\t%s\n", m.Version)
+	fmt.Fprintf(&b, "altstyle\t%s\n", altStyle)
+	for _, link := range m.Links {
+		if link.Previous == "" && link.Backup == "" {
+			fmt.Fprintf(&b, "link\t%s\t%s\n", link.Path, link.Target)
+		} else {
+			fmt.Fprintf(&b, "link\t%s\t%s\t%s\t%s\n", link.Path, link.Target, link.Previous, link.Backup)
+		}
+	}
+	return files.WriteFileAtomic(path, []byte(b.String()), 0o644)
+}
+
+// UnlinkManifest reverts the install recorded in m, and returns the links it
+// restored or removed and the ones it skipped. Unlike UnlinkAll, it only
+// touches the links listed in m: the ones that still run their recorded
+// target, as symlinks, copies or hard links, are restored to the symlink or
+// backed up file they replaced, or removed if they didn't replace any, the
+// ones replaced since are skipped and the ones that don't exist are ignored. If the wrapper was registered with
+// an alternatives system, it's unregistered instead, which points the links
+// back to the next best alternative. The folders of the links are locked
+// meanwhile, see LockDir.
+func (s Symlinker) UnlinkManifest(ctx context.Context, m Manifest) ([]Link, error) {
+	for _, dir := range manifestDirs(m) {
+		unlock, err := LockDir(ctx, dir, s.logf)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	if m.AltStyle != AltStyleNone {
+		return s.unregisterAlternatives(ctx, m)
+	}
+
+	links := make([]Link, 0, len(m.Links))
+	for _, listed := range m.Links {
+		if err := ctx.Err(); err != nil {
+			return links, err
+		}
+
+		link := Link{Path: listed.Path, Target: listed.Target, Previous: listed.Previous, Backup: listed.Backup}
+		if _, err := os.Lstat(link.Path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return links, err
+		}
+		if same, err := files.SameContent(link.Path, link.Target); err != nil || !same {
+			link.Skipped = fmt.Sprintf("doesn't run %s anymore", link.Target)
+			links = append(links, link)
+			continue
+		}
+
+		if err := restoreLink(link); err != nil {
+			return links, err
+		}
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+// restoreLink replaces link with the backed up file or the symlink it replaced,
+// atomically so the command never stops existing, or removes it if it didn't
+// replace any.
+func restoreLink(link Link) error {
+	switch {
+	case link.Backup != "":
+		if err := os.Rename(link.Backup, link.Path); err != nil {
+			return fmt.Errorf("restoring %s: %v", link.Path, err)
+		}
+	case link.Previous != "":
+		if err := files.SymlinkAtomic(link.Previous, link.Path); err != nil {
+			return fmt.Errorf("restoring %s: %v", link.Path, err)
+		}
+	default:
+		if err := os.Remove(link.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing %s: %v", link.Path, err)
+		}
+	}
+	return nil
+}
+
+// unregisterAlternatives removes the wrapper from the alternatives groups the
+// installer script registered it in, and returns the links of m as removed.
+func (s Symlinker) unregisterAlternatives(ctx context.Context, m Manifest) ([]Link, error) {
+	removal, ok := alternativesRemovals[m.AltStyle]
+	if !ok {
+		return nil, fmt.Errorf("unknown alternatives style %q in manifest", m.AltStyle)
+	}
+	if len(m.Links) == 0 {
+		return nil, nil
+	}
+
+	// The installer script points all the links at the same wrapper.
+	wrapper := m.Links[0].Target
+	for _, group := range removal.groups {
+		if _, err := s.runner.Run(ctx, removal.command, "--remove", group, wrapper); err != nil {
+			return nil, fmt.Errorf("unregistering %s from the %s alternatives: %v", wrapper, group, err)
+		}
+	}
+	return append([]Link{}, m.Links...), nil
+}
+
+// manifestDirs returns the folders of the links in m, sorted so concurrent
+// callers take their locks in the same order.
+func manifestDirs(m Manifest) []string {
+	seen := map[string]bool{}
+	var dirs []string
+	for _, link := range m.Links {
+		dir := filepath.Dir(link.Path)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest")
+	m := Manifest{
+		Version:  "v1.2.3",
+		AltStyle: AltStyleNone,
+		Links: []Link{
+			{Path: "/usr/sbin/iptables", Target: "/usr/sbin/iptables-wrapper", Previous: "/etc/alternatives/iptables"},
+			{Path: "/usr/sbin/iptables-save", Target: "/usr/sbin/iptables-wrapper", Backup: "/usr/sbin/iptables-save" + backupSuffix},
+			{Path: "/usr/sbin/iptables-restore", Target: "/usr/sbin/iptables-wrapper"},
+		},
+	}
+	if err := WriteManifest(path, m); err != nil {
+		t.Fatalf("WriteManifest() failed: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"version\tv1.2.3",
+		"altstyle\tnone",
+		"link\t/usr/sbin/iptables\t/usr/sbin/iptables-wrapper\t/etc/alternatives/iptables\t",
+		"link\t/usr/sbin/iptables-save\t/usr/sbin/iptables-wrapper\t\t/usr/sbin/iptables-save" + backupSuffix,
+		// Without anything to restore, it's the same as the installer script's.
+		"link\t/usr/sbin/iptables-restore\t/usr/sbin/iptables-wrapper",
+	}, "\n") + "\n"
+	if string(content) != want {
+		t.Errorf("WriteManifest() wrote:\n%s\nwant:\n%s", content, want)
+	}
+
+	got, err := ReadManifest(path)
+	if err != nil {
+		t.Fatalf("ReadManifest() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("ReadManifest() = %+v, want %+v", got, m)
+	}
+}
+
+func TestReadManifestInvalid(t *testing.T) {
+	for _, content := range []string{
+		"link\t/usr/sbin/iptables\n",
+		"link\t/usr/sbin/iptables\t/usr/sbin/iptables-wrapper\t/etc/alternatives/iptables\n",
+		"unknown\tentry\n",
+	} {
+		path := filepath.Join(t.TempDir(), "manifest")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadManifest(path); err == nil {
+			t.Errorf("ReadManifest(%q) succeeded, want an error", content)
+		}
+	}
+}
+
+func TestUnlinkManifestRestores(t *testing.T) {
+	s := newTestSymlinker(t).WithCommands([]string{"iptables", "iptables-save", "iptables-restore"}).WithBackup(true)
+	// iptables was a symlink to a real binary, iptables-save a real binary
+	// and iptables-restore didn't exist.
+	realBinary := filepath.Join(s.dir, "xtables-nft-multi")
+	if err := os.WriteFile(realBinary, []byte("real"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realBinary, filepath.Join(s.dir, "iptables")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, "iptables-save"), []byte("real save"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := s.LinkAll(context.Background())
+	if err != nil {
+		t.Fatalf("LinkAll() failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "manifest")
+	if err := WriteManifest(path, Manifest{Version: "test", Links: links}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := s.UnlinkManifest(context.Background(), m)
+	if err != nil {
+		t.Fatalf("UnlinkManifest() failed: %v", err)
+	}
+	if len(restored) != 3 {
+		t.Fatalf("UnlinkManifest() returned %d links, want 3", len(restored))
+	}
+	for _, link := range restored {
+		if link.Skipped != "" {
+			t.Errorf("%s: skipped %q, want it restored", link.Path, link.Skipped)
+		}
+	}
+
+	if target, err := os.Readlink(filepath.Join(s.dir, "iptables")); err != nil || target != realBinary {
+		t.Errorf("iptables points to %q (%v), want it restored to %q", target, err, realBinary)
+	}
+	if content, err := os.ReadFile(filepath.Join(s.dir, "iptables-save")); err != nil || string(content) != "real save" {
+		t.Errorf("iptables-save has %q (%v), want the backed up binary", content, err)
+	}
+	if _, err := os.Lstat(filepath.Join(s.dir, "iptables-save"+backupSuffix)); !os.IsNotExist(err) {
+		t.Errorf("the iptables-save backup was left behind: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(s.dir, "iptables-restore")); !os.IsNotExist(err) {
+		t.Errorf("iptables-restore wasn't removed: %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package install points the iptables commands of a system at the
+// iptables-wrapper binary, and reverts it, the same way the install and
+// uninstall subcommands do.
+package install
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// Link represents a symlink managed by the Symlinker.
+type Link struct {
+	// Path is the location of the symlink.
+	Path string
+	// Target is the file the symlink points to.
+	Target string
+	// Skipped is the reason the link was left untouched, if it was.
+	Skipped string
+	// Updated is true if something else was replaced to create the link.
+	Updated bool
+	// Unchanged is true if the link already pointed to Target, in which case
+	// it was left as is.
+	Unchanged bool
+	// Previous is what Path pointed to before it was replaced, if it was a
+	// symlink, so it can be restored.
+	Previous string
+	// Backup is where the file at Path was kept before it was replaced, if it
+	// was a regular file and backups are enabled, see WithBackup.
+	Backup string
+}
+
+// backupSuffix is added to the path of the commands to name their backups.
+const backupSuffix = ".iptables-wrapper-orig"
+
+// LinkMode is how the Symlinker makes the iptables commands run the wrapper.
+type LinkMode string
+
+const (
+	// Symlink makes the commands symlinks to the wrapper binary.
+	Symlink LinkMode = "symlink"
+	// Copy makes the commands copies of the wrapper binary, for filesystems or
+	// image builders that don't keep symlinks. Each copy takes as much disk
+	// space as the wrapper.
+	Copy LinkMode = "copy"
+	// Hardlink makes the commands hard links to the wrapper binary, for
+	// filesystems that don't allow symlinks. Unlike copies, they don't take
+	// any extra space, but they must be in the same filesystem as the wrapper.
+	Hardlink LinkMode = "hardlink"
+)
+
+// ParseLinkMode parses a string into a LinkMode.
+func ParseLinkMode(s string) (LinkMode, error) {
+	switch mode := LinkMode(s); mode {
+	case Symlink, Copy, Hardlink:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown link mode %q, must be %s, %s or %s", s, Symlink, Copy, Hardlink)
+	}
+}
+
+// Symlinker installs the wrapper by replacing the iptables commands in a
+// folder with symlinks to the wrapper binary, or copies of it.
+type Symlinker struct {
+	dir             string
+	wrapperPath     string
+	alternativesDir string
+	// takeover makes the Symlinker replace commands managed by alternatives.
+	takeover bool
+	// commands are the iptables commands linked to the wrapper.
+	commands []string
+	// arpEbtables makes the Symlinker also link the arptables and ebtables commands.
+	arpEbtables bool
+	// mode is how the commands are made to run the wrapper.
+	mode LinkMode
+	// logf, if set, is told when the Symlinker waits for the lock on dir.
+	logf func(format string, args ...interface{})
+	// runner runs the alternatives commands when reverting a manifest.
+	runner iptables.CommandRunner
+	// backup makes the Symlinker keep the regular files it replaces.
+	backup bool
+	// perm, if set, are the permissions of the copies of the wrapper.
+	perm fs.FileMode
+}
+
+// NewSymlinker builds a Symlinker that links the iptables commands in dir
+// to the wrapper binary at wrapperPath.
+func NewSymlinker(dir, wrapperPath string) Symlinker {
+	return Symlinker{
+		dir:             dir,
+		wrapperPath:     wrapperPath,
+		alternativesDir: iptables.AlternativesDir,
+		commands:        iptables.Commands,
+		mode:            Symlink,
+		runner:          iptables.ExecRunner{},
+	}
+}
+
+// WithAlternativesTakeover returns a copy of s that, if takeover is true, replaces
+// the commands managed by an alternatives system that point to a real iptables
+// binary. By default those are skipped.
+func (s Symlinker) WithAlternativesTakeover(takeover bool) Symlinker {
+	s.takeover = takeover
+	return s
+}
+
+// WithCommands returns a copy of s that only links the given iptables commands,
+// for images that need the wrapper for some of them only. By default all of
+// iptables.Commands are linked.
+func (s Symlinker) WithCommands(commands []string) Symlinker {
+	s.commands = commands
+	return s
+}
+
+// WithArpEbtables returns a copy of s that, if enabled is true, also links the
+// iptables.ArpEbtablesCommands. By default they are left untouched, since
+// most images don't need them.
+func (s Symlinker) WithArpEbtables(enabled bool) Symlinker {
+	s.arpEbtables = enabled
+	return s
+}
+
+// WithLinkMode returns a copy of s that makes the commands run the wrapper
+// through mode. By default they are symlinks.
+func (s Symlinker) WithLinkMode(mode LinkMode) Symlinker {
+	s.mode = mode
+	return s
+}
+
+// WithFilePerm returns a copy of s that gives the copies of the wrapper, in the
+// Copy link mode, the permissions perm, e.g. 0o550 for images that restrict
+// who can run them. By default they keep the permissions of the wrapper. The
+// other link modes ignore it: symlinks have no permissions of their own on
+// Linux, and hard links share the wrapper's.
+func (s Symlinker) WithFilePerm(perm fs.FileMode) Symlinker {
+	s.perm = perm.Perm()
+	return s
+}
+
+// WithLogf returns a copy of s that tells logf when it has to wait for another
+// installation or mode switch to release the lock on the folder.
+func (s Symlinker) WithLogf(logf func(format string, args ...interface{})) Symlinker {
+	s.logf = logf
+	return s
+}
+
+// WithBackup returns a copy of s that, if backup is true, keeps the regular
+// files it replaces next to them, with the iptables-wrapper-orig extension, so
+// UnlinkManifest can restore them. By default they are replaced.
+func (s Symlinker) WithBackup(backup bool) Symlinker {
+	s.backup = backup
+	return s
+}
+
+// WithRunner returns a copy of s that runs the alternatives commands with
+// runner. By default they are run with os/exec.
+func (s Symlinker) WithRunner(runner iptables.CommandRunner) Symlinker {
+	s.runner = runner
+	return s
+}
+
+// LinkAll replaces all the iptables commands with symlinks to the wrapper and
+// returns the links it created or updated, the ones it skipped and the ones
+// that were already correct. Running it again is a no-op. The folder is locked
+// meanwhile, see LockDir.
+func (s Symlinker) LinkAll(ctx context.Context) ([]Link, error) {
+	unlock, err := LockDir(ctx, s.dir, s.logf)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	commands := s.commands
+	if s.arpEbtables {
+		commands = append(append([]string{}, commands...), iptables.ArpEbtablesCommands...)
+	}
+
+	links := make([]Link, 0, len(commands))
+	for _, cmd := range commands {
+		if err := ctx.Err(); err != nil {
+			return links, err
+		}
+
+		link := Link{Path: filepath.Join(s.dir, cmd), Target: s.wrapperPath}
+		if !s.takeover && s.managedByAlternatives(link.Path) {
+			link.Skipped = "managed by alternatives"
+			links = append(links, link)
+			continue
+		}
+
+		if s.upToDate(link.Path) {
+			link.Unchanged = true
+			links = append(links, link)
+			continue
+		}
+
+		info, err := os.Lstat(link.Path)
+		link.Updated = err == nil
+		switch {
+		case err == nil && info.Mode()&os.ModeSymlink != 0:
+			if link.Previous, err = os.Readlink(link.Path); err != nil {
+				return links, err
+			}
+		case err == nil && info.Mode().IsRegular() && s.backup && !s.isCopy(link.Path):
+			link.Backup = link.Path + backupSuffix
+			if err := backupFile(link.Path, link.Backup); err != nil {
+				return links, fmt.Errorf("backing up %s: %v", link.Path, err)
+			}
+		}
+		// A folder can't be replaced by renaming the new symlink over it.
+		if err == nil && info.IsDir() {
+			if err := os.RemoveAll(link.Path); err != nil {
+				return links, fmt.Errorf("removing %s: %v", link.Path, err)
+			}
+		}
+		// The command is replaced atomically, so it's never missing for a
+		// concurrent invocation, and concurrent installs don't conflict.
+		create := files.SymlinkAtomic
+		switch s.mode {
+		case Copy:
+			create = func(target, path string) error { return files.CopyFileAtomicPerm(target, path, s.perm) }
+		case Hardlink:
+			create = files.LinkAtomic
+		}
+		if err := create(link.Target, link.Path); errors.Is(err, syscall.EXDEV) {
+			return links, fmt.Errorf("creating %s %s: %s and %s are in different filesystems, use the %s or %s link modes instead", cmd, s.mode, s.dir, link.Target, Symlink, Copy)
+		} else if err != nil {
+			return links, fmt.Errorf("creating %s %s: %v", cmd, s.mode, err)
+		}
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+// UnlinkAll removes the iptables commands that are symlinks to the wrapper or
+// copies of it, and returns the links it removed and the ones it skipped.
+// Commands that are other files or symlinks to anything else are skipped, and
+// the ones that don't exist are ignored. The folder is locked meanwhile, see
+// LockDir.
+func (s Symlinker) UnlinkAll(ctx context.Context) ([]Link, error) {
+	unlock, err := LockDir(ctx, s.dir, s.logf)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	commands := append(append([]string{}, iptables.Commands...), iptables.ArpEbtablesCommands...)
+	links := make([]Link, 0, len(commands))
+	for _, cmd := range commands {
+		if err := ctx.Err(); err != nil {
+			return links, err
+		}
+
+		link := Link{Path: filepath.Join(s.dir, cmd)}
+		info, err := os.Lstat(link.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return links, err
+		}
+
+		switch {
+		case info.Mode().IsRegular():
+			// Installed with the Copy or Hardlink link modes.
+			if s.isCopy(link.Path) {
+				link.Target = s.wrapperPath
+			} else {
+				link.Skipped = "not a symlink nor a copy of the wrapper"
+			}
+		case info.Mode()&os.ModeSymlink == 0:
+			link.Skipped = "not a symlink"
+		default:
+			if link.Target, err = os.Readlink(link.Path); err != nil {
+				return links, err
+			}
+			if !s.pointsToWrapper(link.Path) {
+				link.Skipped = "doesn't point to the wrapper"
+			}
+		}
+		if link.Skipped != "" {
+			links = append(links, link)
+			continue
+		}
+
+		if err := os.Remove(link.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return links, fmt.Errorf("removing %s: %v", link.Path, err)
+		}
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+// backupFile keeps the file at path at backup, as a hard link if possible, so
+// it doesn't take any extra space, or as a copy otherwise.
+func backupFile(path, backup string) error {
+	if err := files.LinkAtomic(path, backup); err == nil {
+		return nil
+	}
+	return files.CopyFileAtomic(path, backup)
+}
+
+// upToDate checks if path already runs the wrapper the way the Symlinker
+// would make it.
+func (s Symlinker) upToDate(path string) bool {
+	switch s.mode {
+	case Copy:
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() || (s.perm != 0 && info.Mode().Perm() != s.perm) {
+			return false
+		}
+		return s.isCopy(path)
+	case Hardlink:
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return false
+		}
+		wrapper, err := os.Stat(s.wrapperPath)
+		return err == nil && os.SameFile(info, wrapper)
+	default:
+		target, err := os.Readlink(path)
+		return err == nil && target == s.wrapperPath
+	}
+}
+
+// isCopy checks if path has the same content as the wrapper binary, which
+// includes being a hard link to it.
+func (s Symlinker) isCopy(path string) bool {
+	same, err := files.SameContent(path, s.wrapperPath)
+	return err == nil && same
+}
+
+// pointsToWrapper checks if path resolves to the wrapper binary.
+func (s Symlinker) pointsToWrapper(path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	wrapper, err := filepath.EvalSymlinks(s.wrapperPath)
+	return err == nil && resolved == wrapper
+}
+
+// managedByAlternatives checks if path is a symlink managed by an alternatives
+// system that doesn't already point to the wrapper.
+func (s Symlinker) managedByAlternatives(path string) bool {
+	target, err := os.Readlink(path)
+	if err != nil || filepath.Dir(target) != s.alternativesDir {
+		return false
+	}
+
+	return !s.pointsToWrapper(path)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package install
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSymlinker builds a Symlinker for a temporary sbin folder, with a fake
+// wrapper binary and alternatives folder next to it.
+func newTestSymlinker(t *testing.T) Symlinker {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"sbin", "alternatives"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wrapperPath := filepath.Join(root, "iptables-wrapper")
+	if err := os.WriteFile(wrapperPath, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSymlinker(filepath.Join(root, "sbin"), wrapperPath)
+	s.alternativesDir = filepath.Join(root, "alternatives")
+	return s
+}
+
+func TestLinkAll(t *testing.T) {
+	s := newTestSymlinker(t)
+	// An existing real binary is replaced.
+	if err := os.WriteFile(filepath.Join(s.dir, "iptables"), []byte("real"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := s.LinkAll(context.Background())
+	if err != nil {
+		t.Fatalf("LinkAll() failed: %v", err)
+	}
+	if len(links) != len(s.commands) {
+		t.Fatalf("LinkAll() returned %d links, want %d", len(links), len(s.commands))
+	}
+	for _, link := range links {
+		if link.Skipped != "" || link.Unchanged {
+			t.Errorf("%s: got skipped %q, unchanged %v, want it linked", link.Path, link.Skipped, link.Unchanged)
+		}
+		if wantUpdated := filepath.Base(link.Path) == "iptables"; link.Updated != wantUpdated {
+			t.Errorf("%s: got updated %v, want %v", link.Path, link.Updated, wantUpdated)
+		}
+		if target, err := os.Readlink(link.Path); err != nil || target != s.wrapperPath {
+			t.Errorf("%s points to %q (%v), want %q", link.Path, target, err, s.wrapperPath)
+		}
+	}
+}
+
+func TestLinkAllAgainIsNoop(t *testing.T) {
+	s := newTestSymlinker(t)
+	if _, err := s.LinkAll(context.Background()); err != nil {
+		t.Fatalf("LinkAll() failed: %v", err)
+	}
+	before, err := os.Lstat(filepath.Join(s.dir, "iptables"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := s.LinkAll(context.Background())
+	if err != nil {
+		t.Fatalf("LinkAll() again failed: %v", err)
+	}
+	for _, link := range links {
+		if !link.Unchanged || link.Updated {
+			t.Errorf("%s: got unchanged %v, updated %v, want it left as is", link.Path, link.Unchanged, link.Updated)
+		}
+	}
+	after, err := os.Lstat(filepath.Join(s.dir, "iptables"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("LinkAll() again replaced the iptables symlink")
+	}
+}
+
+func TestLinkAllCopyFilePerm(t *testing.T) {
+	s := newTestSymlinker(t).WithLinkMode(Copy)
+	// Without a file mode, the copies keep the permissions of the wrapper.
+	if _, err := s.LinkAll(context.Background()); err != nil {
+		t.Fatalf("LinkAll() failed: %v", err)
+	}
+	path := filepath.Join(s.dir, "iptables")
+	if info, err := os.Lstat(path); err != nil || info.Mode().Perm() != 0o755 {
+		t.Fatalf("the copy has mode %v (%v), want the wrapper's 0755", info.Mode(), err)
+	}
+
+	// The requested permissions are set regardless of the umask, and the
+	// copies with other permissions are updated.
+	links, err := s.WithFilePerm(0o510).LinkAll(context.Background())
+	if err != nil {
+		t.Fatalf("LinkAll() with a file mode failed: %v", err)
+	}
+	for _, link := range links {
+		if link.Unchanged || !link.Updated {
+			t.Errorf("%s: got unchanged %v, updated %v, want it updated", link.Path, link.Unchanged, link.Updated)
+		}
+		info, err := os.Lstat(link.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm() != 0o510 {
+			t.Errorf("%s has mode %v, want a regular file with mode 0510", link.Path, info.Mode())
+		}
+	}
+
+	links, err = s.WithFilePerm(0o510).LinkAll(context.Background())
+	if err != nil {
+		t.Fatalf("LinkAll() with a file mode again failed: %v", err)
+	}
+	for _, link := range links {
+		if !link.Unchanged {
+			t.Errorf("%s: got unchanged %v, want it left as is", link.Path, link.Unchanged)
+		}
+	}
+}
+
+func TestLinkAllAlternatives(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		takeover bool
+		// toWrapper makes the alternative point to the wrapper instead of a
+		// real iptables binary.
+		toWrapper   bool
+		wantSkipped bool
+	}{
+		{name: "skipped", wantSkipped: true},
+		{name: "taken over", takeover: true},
+		{name: "already the wrapper", toWrapper: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSymlinker(t).WithAlternativesTakeover(tc.takeover)
+			target := filepath.Join(s.dir, "iptables-nft")
+			if err := os.WriteFile(target, []byte("real"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if tc.toWrapper {
+				target = s.wrapperPath
+			}
+			// Like /usr/sbin/iptables -> /etc/alternatives/iptables -> target.
+			alternative := filepath.Join(s.alternativesDir, "iptables")
+			if err := os.Symlink(target, alternative); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(s.dir, "iptables")
+			if err := os.Symlink(alternative, path); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := s.managedByAlternatives(path); got != !tc.toWrapper {
+				t.Errorf("managedByAlternatives(%s) = %v, want %v", path, got, !tc.toWrapper)
+			}
+
+			links, err := s.LinkAll(context.Background())
+			if err != nil {
+				t.Fatalf("LinkAll() failed: %v", err)
+			}
+			for _, link := range links {
+				if link.Path != path {
+					continue
+				}
+				if (link.Skipped != "") != tc.wantSkipped {
+					t.Errorf("%s: got skipped %q, want skipped %v", link.Path, link.Skipped, tc.wantSkipped)
+				}
+				if !tc.wantSkipped && !link.Updated {
+					t.Errorf("%s: the alternatives link wasn't reported as updated", link.Path)
+				}
+			}
+
+			want := s.wrapperPath
+			if tc.wantSkipped {
+				want = alternative
+			}
+			if got, err := os.Readlink(path); err != nil || got != want {
+				t.Errorf("%s points to %q (%v), want %q", path, got, err, want)
+			}
+			// The alternatives system's own link is never touched.
+			if got, err := os.Readlink(alternative); err != nil || got != target {
+				t.Errorf("%s points to %q (%v), want it left pointing to %q", alternative, got, err, target)
+			}
+		})
+	}
+}
+
+func TestUnlinkAll(t *testing.T) {
+	s := newTestSymlinker(t)
+	if _, err := s.LinkAll(context.Background()); err != nil {
+		t.Fatalf("LinkAll() failed: %v", err)
+	}
+	// Commands that don't run the wrapper are left untouched.
+	other := filepath.Join(s.dir, "iptables-save")
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, []byte("real"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := s.UnlinkAll(context.Background())
+	if err != nil {
+		t.Fatalf("UnlinkAll() failed: %v", err)
+	}
+	if len(links) != len(s.commands) {
+		t.Fatalf("UnlinkAll() returned %d links, want %d", len(links), len(s.commands))
+	}
+	for _, link := range links {
+		_, statErr := os.Lstat(link.Path)
+		if link.Path == other {
+			if link.Skipped == "" || statErr != nil {
+				t.Errorf("%s: got skipped %q (%v), want it skipped and kept", link.Path, link.Skipped, statErr)
+			}
+			continue
+		}
+		if link.Skipped != "" || !os.IsNotExist(statErr) {
+			t.Errorf("%s: got skipped %q (%v), want it removed", link.Path, link.Skipped, statErr)
+		}
+	}
+
+	// Running it again only finds the command it skipped.
+	links, err = s.UnlinkAll(context.Background())
+	if err != nil {
+		t.Fatalf("UnlinkAll() again failed: %v", err)
+	}
+	if len(links) != 1 || links[0].Path != other {
+		t.Errorf("UnlinkAll() again returned %v, want only %s", links, other)
+	}
+}
@@ -0,0 +1,327 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package iptables detects which iptables mode, nft or legacy, a node uses and
+// configures the iptables commands of a system to use it, the same way the
+// iptables-wrapper binary does.
+//
+// This is the public API of the module: its signatures follow semantic
+// versioning and won't change in a backwards incompatible way without a new
+// major version. Its types are defined here, not aliased from internal
+// packages, so changes there can't leak into it. Everything under internal can
+// change at any time.
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// Mode represents the two different modes iptables can be configured to: nft
+// or legacy.
+type Mode string
+
+const (
+	// Legacy is the iptables mode that uses the legacy xtables kernel API.
+	Legacy Mode = "legacy"
+	// NFT is the iptables mode that uses the nf_tables kernel API.
+	NFT Mode = "nft"
+)
+
+// Family represents the IP family iptables rules are configured for.
+type Family string
+
+const (
+	// IPv4 is the family of the iptables commands.
+	IPv4 Family = "ipv4"
+	// IPv6 is the family of the ip6tables commands.
+	IPv6 Family = "ipv6"
+)
+
+// ErrProbeTimeout is returned, wrapped, when a command run by XtablesMulti
+// doesn't finish in time.
+var ErrProbeTimeout = iptables.ErrProbeTimeout
+
+// ProbeTimeoutError is returned when a command run to detect the mode doesn't
+// finish in time. It matches ErrProbeTimeout with errors.Is.
+type ProbeTimeoutError struct {
+	// Command is the name of the command, like iptables-nft-save.
+	Command string
+	// Timeout is how long the command was allowed to take.
+	Timeout time.Duration
+}
+
+func (e *ProbeTimeoutError) Error() string {
+	return fmt.Sprintf("%s %s after %s", e.Command, ErrProbeTimeout, e.Timeout)
+}
+
+func (e *ProbeTimeoutError) Is(target error) bool {
+	return target == ErrProbeTimeout
+}
+
+// publicError converts the internal errors with a public counterpart.
+func publicError(err error) error {
+	var timeoutErr *iptables.ProbeTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return &ProbeTimeoutError{Command: timeoutErr.Command, Timeout: timeoutErr.Timeout}
+	}
+	return err
+}
+
+// Installation represents the set of iptables-*-save binaries installed in a
+// machine, used to inspect the rules of both modes. Implementations must be
+// safe for concurrent use.
+type Installation interface {
+	// LegacySave runs a iptables-legacy-save command.
+	LegacySave(ctx context.Context, out *bytes.Buffer, args ...string) error
+	// LegacySaveIP6 runs a ip6tables-legacy-save command.
+	LegacySaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error
+	// NFTSave runs a iptables-nft-save command.
+	NFTSave(ctx context.Context, out *bytes.Buffer, args ...string) error
+	// NFTSaveIP6 runs a ip6tables-nft-save command.
+	NFTSaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error
+}
+
+// CommandRunner runs external commands. It allows replacing the real iptables
+// binaries, for example with a fake that returns canned save output in tests.
+type CommandRunner interface {
+	// Run runs the binary at path with args and returns its stdout. If it
+	// fails, the error includes its stderr.
+	Run(ctx context.Context, path string, args ...string) ([]byte, error)
+}
+
+// XtablesMulti is the Installation that runs the save commands through the
+// xtables-<mode>-multi binaries.
+type XtablesMulti struct {
+	x iptables.XtablesMulti
+}
+
+// NewXtablesMultiInstallation returns the Installation for the iptables
+// commands in sbinPath, usually the result of DetectBinaryDir.
+func NewXtablesMultiInstallation(sbinPath string) XtablesMulti {
+	return XtablesMulti{x: iptables.NewXtablesMultiInstallation(sbinPath)}
+}
+
+// WithCommandPrefix returns a copy of x that runs all commands prefixed by the
+// given command and arguments, like `nsenter --target 1 --net`.
+func (x XtablesMulti) WithCommandPrefix(prefix ...string) XtablesMulti {
+	return XtablesMulti{x: x.x.WithCommandPrefix(prefix...)}
+}
+
+// WithEnv returns a copy of x that runs all commands with the given variables,
+// in the form "key=value", added to the current environment.
+func (x XtablesMulti) WithEnv(env ...string) XtablesMulti {
+	return XtablesMulti{x: x.x.WithEnv(env...)}
+}
+
+// WithTimeout returns a copy of x that kills every command that takes longer
+// than timeout, returning a *ProbeTimeoutError. With 0, commands can take
+// as long as ctx allows.
+func (x XtablesMulti) WithTimeout(timeout time.Duration) XtablesMulti {
+	return XtablesMulti{x: x.x.WithTimeout(timeout)}
+}
+
+// WithProbeConcurrency returns a copy of x that runs at most n commands at
+// the same time, counting the ones run by its own copies. With 0, there is
+// no limit. By default, it's 4.
+func (x XtablesMulti) WithProbeConcurrency(n int) XtablesMulti {
+	return XtablesMulti{x: x.x.WithProbeConcurrency(n)}
+}
+
+// WithNetns returns a copy of x that runs all commands in the network
+// namespace at path, like /proc/<pid>/ns/net.
+func (x XtablesMulti) WithNetns(path string) XtablesMulti {
+	return XtablesMulti{x: x.x.WithNetns(path)}
+}
+
+// WithRunner returns a copy of x that runs all commands with runner, instead
+// of with os/exec directly. The runner gets the full command line, including
+// the prefix, and is responsible for the environment and network namespace.
+func (x XtablesMulti) WithRunner(runner CommandRunner) XtablesMulti {
+	return XtablesMulti{x: x.x.WithRunner(runner)}
+}
+
+// LegacySave runs a iptables-legacy-save command.
+func (x XtablesMulti) LegacySave(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return publicError(x.x.LegacySave(ctx, out, args...))
+}
+
+// LegacySaveIP6 runs a ip6tables-legacy-save command.
+func (x XtablesMulti) LegacySaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return publicError(x.x.LegacySaveIP6(ctx, out, args...))
+}
+
+// NFTSave runs a iptables-nft-save command.
+func (x XtablesMulti) NFTSave(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return publicError(x.x.NFTSave(ctx, out, args...))
+}
+
+// NFTSaveIP6 runs a ip6tables-nft-save command.
+func (x XtablesMulti) NFTSaveIP6(ctx context.Context, out *bytes.Buffer, args ...string) error {
+	return publicError(x.x.NFTSaveIP6(ctx, out, args...))
+}
+
+// Version returns the output of `iptables --version` for the given mode.
+func (x XtablesMulti) Version(ctx context.Context, mode Mode) (string, error) {
+	version, err := x.x.Version(ctx, iptables.Mode(mode))
+	return version, publicError(err)
+}
+
+// AlternativeSelector configures a system to use the iptables commands of a
+// mode.
+type AlternativeSelector interface {
+	// UseMode configures the system to use the selected iptables mode.
+	UseMode(ctx context.Context, mode Mode) error
+	// UseFamilyMode configures the system to use the selected iptables mode
+	// only for the commands of the given IP family.
+	UseFamilyMode(ctx context.Context, family Family, mode Mode) error
+}
+
+// alternativeSelector adapts an internal AlternativeSelector to the public
+// one.
+type alternativeSelector struct {
+	selector iptables.AlternativeSelector
+}
+
+func (a alternativeSelector) UseMode(ctx context.Context, mode Mode) error {
+	return a.selector.UseMode(ctx, iptables.Mode(mode))
+}
+
+func (a alternativeSelector) UseFamilyMode(ctx context.Context, family Family, mode Mode) error {
+	return a.selector.UseFamilyMode(ctx, iptables.Family(family), iptables.Mode(mode))
+}
+
+// DetectBinaryDir returns the folder where the iptables binaries are
+// installed, the first of /usr/sbin, /sbin, /usr/bin, /bin and
+// /run/current-system/sw/bin that has them. If none has, it returns an error.
+func DetectBinaryDir() (string, error) {
+	return iptables.DetectBinaryDir()
+}
+
+// DetectMode inspects the current iptables rules through installation and
+// returns the mode in use. It looks for the chains created by kubelet first
+// and, if there are none, picks the mode with more rules. Without any rules it
+// returns NFT. It never returns NFT if the kernel can't support nf_tables.
+func DetectMode(ctx context.Context, installation Installation) Mode {
+	return Mode(iptables.DetectMode(ctx, installation))
+}
+
+// DetectionResult explains how DetectModeDetailed picked a mode.
+type DetectionResult struct {
+	// Mode is the detected mode.
+	Mode Mode
+	// LegacyLines and NFTLines are the number of rules in each mode. They are
+	// only counted when no kubelet chains are found or they are found in
+	// legacy, otherwise they are zero.
+	LegacyLines int
+	NFTLines    int
+	// MatchedFamily is the IP family the kubelet chains were found for in the
+	// detected mode, IPv4 if they were found for both. It is empty if the mode
+	// was picked from the number of rules.
+	MatchedFamily Family
+	// Ambiguous is true if the other mode was also a candidate: there are
+	// kubelet chains in both, or neither has them and both have the same
+	// number of rules.
+	Ambiguous bool
+	// NFTUnsupported is why nft was refused in favour of legacy, even though
+	// it was detected, because the kernel can't support it.
+	NFTUnsupported string
+}
+
+// DetectModeDetailed works like DetectMode but also returns why the mode was
+// picked: the IP family the kubelet chains were found for, the number of rules
+// in each mode when there are no kubelet chains, whether the other mode was
+// also a candidate and why nft was refused, if it was.
+func DetectModeDetailed(ctx context.Context, installation Installation) DetectionResult {
+	return publicResult(iptables.DetectModeDetailed(ctx, installation))
+}
+
+// TryDetectModeDetailed works like DetectModeDetailed, but returns a
+// *ProbeTimeoutError instead of a result if any of the save commands times
+// out. A command that timed out can't tell if there are kubelet chains, so
+// the mode picked without it could be wrong.
+func TryDetectModeDetailed(ctx context.Context, installation Installation) (DetectionResult, error) {
+	result, err := iptables.TryDetectModeDetailed(ctx, installation)
+	if err != nil {
+		return DetectionResult{}, publicError(err)
+	}
+	return publicResult(result), nil
+}
+
+// Detector detects the iptables mode like DetectModeDetailed, with options
+// for embedding it in larger binaries.
+type Detector struct {
+	d iptables.Detector
+}
+
+// NewDetector returns a Detector that inspects the rules through installation.
+func NewDetector(installation Installation) Detector {
+	return Detector{d: iptables.NewDetector(installation)}
+}
+
+// WithLogger returns a copy of d that logs the detection to logger instead of
+// to slog.Default(). A nil logger restores the default.
+func (d Detector) WithLogger(logger *slog.Logger) Detector {
+	return Detector{d: d.d.WithLogger(logger)}
+}
+
+// Mode works like DetectMode.
+func (d Detector) Mode(ctx context.Context) Mode {
+	return Mode(d.d.Mode(ctx))
+}
+
+// ModeDetailed works like DetectModeDetailed.
+func (d Detector) ModeDetailed(ctx context.Context) DetectionResult {
+	return publicResult(d.d.ModeDetailed(ctx))
+}
+
+// TryModeDetailed works like TryDetectModeDetailed.
+func (d Detector) TryModeDetailed(ctx context.Context) (DetectionResult, error) {
+	result, err := d.d.TryModeDetailed(ctx)
+	if err != nil {
+		return DetectionResult{}, publicError(err)
+	}
+	return publicResult(result), nil
+}
+
+// publicResult converts an internal DetectionResult.
+func publicResult(result iptables.DetectionResult) DetectionResult {
+	return DetectionResult{
+		Mode:           Mode(result.Mode),
+		LegacyLines:    result.LegacyLines,
+		NFTLines:       result.NFTLines,
+		MatchedFamily:  Family(result.MatchedFamily),
+		Ambiguous:      result.Ambiguous,
+		NFTUnsupported: result.NFTUnsupported,
+	}
+}
+
+// BuildAlternativeSelector returns the AlternativeSelector for the iptables
+// commands in sbinPath. It uses the alternatives or update-alternatives
+// commands if installed and otherwise, or if they fail, replaces the commands
+// with symlinks.
+func BuildAlternativeSelector(sbinPath string) AlternativeSelector {
+	return alternativeSelector{selector: iptables.BuildAlternativeSelector(sbinPath)}
+}
+
+// BuildAlternativeSelectorWithLogger works like BuildAlternativeSelector, but
+// the selector logs to logger instead of to slog.Default().
+func BuildAlternativeSelectorWithLogger(sbinPath string, logger *slog.Logger) AlternativeSelector {
+	return alternativeSelector{selector: iptables.BuildAlternativeSelectorWithRunner(sbinPath, iptables.ExecRunner{}, nil, nil, logger)}
+}
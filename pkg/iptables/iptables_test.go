@@ -0,0 +1,129 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// fakeRunner returns canned output for each command line, with the binary by
+// name, like "xtables-nft-multi iptables --version".
+type fakeRunner map[string]string
+
+func (r fakeRunner) Run(_ context.Context, path string, args ...string) ([]byte, error) {
+	return []byte(r[strings.Join(append([]string{filepath.Base(path)}, args...), " ")]), nil
+}
+
+var _ Installation = XtablesMulti{}
+
+func TestConstantsMatchInternal(t *testing.T) {
+	for _, tc := range []struct{ public, internal string }{
+		{string(Legacy), string(iptables.Legacy)},
+		{string(NFT), string(iptables.NFT)},
+		{string(IPv4), string(iptables.IPv4)},
+		{string(IPv6), string(iptables.IPv6)},
+	} {
+		if tc.public != tc.internal {
+			t.Errorf("public constant %q doesn't match the internal %q", tc.public, tc.internal)
+		}
+	}
+}
+
+func TestDetectModeDetailedWithRunner(t *testing.T) {
+	installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(fakeRunner{
+		"xtables-legacy-multi ip6tables-save": "*mangle\n:KUBE-IPTABLES-HINT - [0:0]\nCOMMIT\n",
+	})
+
+	result := DetectModeDetailed(context.Background(), installation)
+	want := DetectionResult{Mode: Legacy, MatchedFamily: IPv6}
+	if result != want {
+		t.Errorf("DetectModeDetailed() = %+v, want %+v", result, want)
+	}
+	if mode := DetectMode(context.Background(), installation); mode != Legacy {
+		t.Errorf("DetectMode() = %s, want %s", mode, Legacy)
+	}
+}
+
+// hangingRunner's commands only finish when their context is done.
+type hangingRunner struct{}
+
+func (hangingRunner) Run(ctx context.Context, _ string, _ ...string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTryDetectModeDetailedTimeout(t *testing.T) {
+	installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(hangingRunner{}).WithTimeout(10 * time.Millisecond)
+
+	_, err := TryDetectModeDetailed(context.Background(), installation)
+	var timeoutErr *ProbeTimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, ErrProbeTimeout) || timeoutErr.Timeout != 10*time.Millisecond {
+		t.Errorf("TryDetectModeDetailed() = %v, want a *ProbeTimeoutError after 10ms", err)
+	}
+	if _, err := installation.Version(context.Background(), NFT); !errors.As(err, &timeoutErr) {
+		t.Errorf("Version() = %v, want a *ProbeTimeoutError", err)
+	}
+}
+
+func TestVersionWithRunner(t *testing.T) {
+	installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(fakeRunner{
+		"xtables-nft-multi iptables --version": "iptables v1.8.9 (nf_tables)\n",
+	})
+
+	version, err := installation.Version(context.Background(), NFT)
+	if err != nil {
+		t.Fatalf("Version() failed: %v", err)
+	}
+	if version != "iptables v1.8.9 (nf_tables)\n" {
+		t.Errorf("Version() = %q", version)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	// Nothing should be logged to the default logger.
+	var defaultLogs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&defaultLogs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	installation := NewXtablesMultiInstallation(t.TempDir()).WithRunner(fakeRunner{})
+	// Without any rules, the detection counts them and checks the kernel
+	// support for the nft mode it picks.
+	NewDetector(installation).WithLogger(logger).ModeDetailed(context.Background())
+	BuildAlternativeSelectorWithLogger(t.TempDir(), logger)
+
+	for _, msg := range []string{
+		"Looked for the kubelet chains",
+		"Counted the iptables rules",
+		"Checked the kernel support for nf_tables",
+		"Selecting the iptables mode with symlinks",
+	} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("the injected logger didn't get %q, got:\n%s", msg, logs.String())
+		}
+	}
+	if defaultLogs.Len() > 0 {
+		t.Errorf("the default logger got:\n%s", defaultLogs.String())
+	}
+}
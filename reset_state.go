@@ -0,0 +1,38 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// resetStateCommand removes the state the wrapper reads back on its next runs,
+// so they start from a fresh detection, and prints what it removed. That's
+// the mode cache file, whether the cache is enabled or not. The metrics and
+// event files and the debug folder are only outputs for other tools, so they
+// are left alone.
+func resetStateCommand(_ context.Context, args []string) int {
+	flags := flag.NewFlagSet("reset-state", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: reset-state doesn't accept arguments\n")
+		return 2
+	}
+	return removeModeCache()
+}
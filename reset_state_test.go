@@ -0,0 +1,43 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResetStateCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iptables-mode")
+	t.Setenv(modeCacheFileEnv, path)
+	if err := os.WriteFile(path, []byte("legacy\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := resetStateCommand(context.Background(), nil); code != 0 {
+		t.Errorf("resetStateCommand() = %d, want 0", code)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the mode cache file is still there: %v", err)
+	}
+	// Without any state left, it's a no-op.
+	if code := resetStateCommand(context.Background(), nil); code != 0 {
+		t.Errorf("resetStateCommand() without a mode cache = %d, want 0", code)
+	}
+	if code := resetStateCommand(context.Background(), []string{"extra"}); code != 2 {
+		t.Errorf("resetStateCommand(extra) = %d, want 2", code)
+	}
+}
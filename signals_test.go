@@ -0,0 +1,50 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRunForwardingSignals(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		script string
+		want   int
+	}{
+		{name: "exit code", script: "exit 3", want: 3},
+		{name: "killed", script: "kill -TERM $$", want: 143},
+		// The SIGTERM sent to the wrapper, the parent, is forwarded to the
+		// command, which is killed by it.
+		{name: "forwarded", script: "kill -TERM $PPID; sleep 10", want: 143},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			err := runForwardingSignals(exec.Command("sh", "-c", tc.script))
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("runForwardingSignals() error = %v, want an ExitError", err)
+			}
+			if code := exitCode(exitErr); code != tc.want {
+				t.Errorf("exitCode() = %d, want %d", code, tc.want)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("runForwardingSignals() took %s, the signal wasn't forwarded", elapsed)
+			}
+		})
+	}
+}
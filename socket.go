@@ -0,0 +1,52 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// decisionSocketTimeout bounds how long sending the decision can delay the
+// iptables command, for both connecting and writing.
+const decisionSocketTimeout = 100 * time.Millisecond
+
+// socketDecision is the line of JSON sent to the decision socket.
+type socketDecision struct {
+	Time   time.Time     `json:"time"`
+	Applet string        `json:"applet"`
+	Mode   iptables.Mode `json:"mode"`
+}
+
+// sendModeDecision sends the selected mode, as a single line of JSON, to the
+// Unix socket at path, for a local monitoring agent. It's best effort: if the
+// socket doesn't exist, nobody is listening or it's too slow, the decision
+// is dropped without an error, so the iptables command is never held back.
+func sendModeDecision(path, applet string, mode iptables.Mode) {
+	data, err := json.Marshal(socketDecision{Time: time.Now().UTC(), Applet: applet, Mode: mode})
+	if err != nil {
+		return
+	}
+
+	conn, err := net.DialTimeout("unix", path, decisionSocketTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(decisionSocketTimeout))
+	_, _ = conn.Write(append(data, '\n'))
+}
@@ -105,11 +105,20 @@ if ! build "${tag}" ${build_arg}; then
     FAIL "build failed unexpectedly"
 fi
 
-if ! docker run --privileged "iptables-wrapper-test-${tag}" /bin/sh ${dash_x:-} /test.sh legacy; then
-    FAIL "failed legacy iptables / new rules test"
+for scenario in hint canary ipv6 stale hinted mixed rules split shim; do
+    if ! docker run --privileged "iptables-wrapper-test-${tag}" /bin/sh ${dash_x:-} /test.sh legacy ${scenario}; then
+	FAIL "failed legacy iptables / ${scenario} rules test"
+    fi
+    if ! docker run --privileged "iptables-wrapper-test-${tag}" /bin/sh ${dash_x:-} /test.sh nft ${scenario}; then
+	FAIL "failed nft iptables / ${scenario} rules test"
+    fi
+done
+
+if ! docker run --privileged "iptables-wrapper-test-${tag}" /bin/sh ${dash_x:-} /test.sh legacy user; then
+    FAIL "failed legacy iptables / user rules test"
 fi
-if ! docker run --privileged "iptables-wrapper-test-${tag}" /bin/sh ${dash_x:-} /test.sh nft; then
-    FAIL "failed nft iptables / new rules test"
+if ! docker run --privileged "iptables-wrapper-test-${tag}" /bin/sh ${dash_x:-} /test.sh nft tables; then
+    FAIL "failed nft iptables / tables rules test"
 fi
 
 PASS "success"
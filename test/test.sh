@@ -16,7 +16,42 @@
 
 set -eu
 
+# Usage: test.sh MODE [SCENARIO]
+#
+# Sets up the kubelet chains for SCENARIO in MODE, and junk rules in the
+# other mode, and checks the wrapper resolves iptables to MODE. SCENARIO
+# is one of:
+#
+#   hint:   KUBE-IPTABLES-HINT in the IPv4 mangle table (default)
+#   canary: KUBE-KUBELET-CANARY in the IPv4 mangle table, as created by
+#           kubelets that don't create the hint chain
+#   ipv6:   KUBE-IPTABLES-HINT only in the IPv6 mangle table, as on a
+#           node where IPv4 rules haven't been created yet
+#   stale:  KUBE-IPTABLES-HINT and kube-proxy chains in MODE, plus a
+#           leftover KUBE-KUBELET-CANARY in the other mode, as on a node
+#           that was switched from one mode to the other
+#   hinted: KUBE-IPTABLES-HINT in MODE, and more kubelet and kube-proxy
+#           canary chains in the other mode, as the hint outweighs them
+#   mixed:  KUBE-KUBELET-CANARY and kube-proxy chains outside of the
+#           mangle table in MODE, split across IPv4 and IPv6, and a
+#           leftover KUBE-IPTABLES-HINT in the other mode
+#   rules:  no kubelet chains, but more rules in MODE than in the other
+#           mode, as on a node where kubelet hasn't started yet
+#   user:   no kubelet chains, and a USER-FIREWALL chain with fewer rules
+#           than the other mode in legacy, with USER-FIREWALL configured
+#           as a legacy hint chain. Only valid for the legacy MODE
+#   tables: KUBE-KUBELET-CANARY and kube-proxy chains only in the nat
+#           table, with all the nft tables checked for kubelet chains.
+#           Only valid for the nft MODE
+#   split:  KUBE-IPTABLES-HINT in the IPv4 mangle table in MODE and in the
+#           IPv6 mangle table in the other mode, with the families
+#           switched independently, as on hybrid hosts
+#   shim:   KUBE-IPTABLES-HINT in the IPv4 mangle table, with the MODE
+#           commands replaced by shell scripts and no xtables-MODE-multi
+#           binary, as in images that wrap iptables in scripts
+
 mode=$1
+scenario=${2:-hint}
 
 case "${mode}" in
     legacy)
@@ -50,27 +85,1340 @@ ensure_iptables_undecided() {
 
 ensure_iptables_resolved() {
     expected=$1
-    iptables=$(realpath "${sbin}/iptables")
+    cmd=${2:-iptables}
+    iptables=$(realpath "${sbin}/${cmd}")
     if [ "${iptables}" = "${sbin}/iptables-wrapper" ]; then
-	echo "iptables link is not yet resolved!" 1>&2
+	echo "${cmd} link is not yet resolved!" 1>&2
 	exit 1
     fi
-    version=$(iptables -V | sed -e 's/.*(\(.*\)).*/\1/')
+    version=$(${cmd} -V | sed -e 's/.*(\(.*\)).*/\1/')
     case "${version}/${expected}" in
 	legacy/legacy|nf_tables/nft)
 	    return
 	    ;;
 	*)
-	    echo "iptables link resolved incorrectly (expected ${expected}, got ${version})" 1>&2
+	    echo "${cmd} link resolved incorrectly (expected ${expected}, got ${version})" 1>&2
 	    exit 1
 	    ;;
     esac
 }
 
+ensure_validate_rules_works() {
+    valid=$(mktemp)
+    invalid=$(mktemp)
+    printf '*filter\n:TEST-VALID - [0:0]\n-A TEST-VALID -j ACCEPT\nCOMMIT\n' > "${valid}"
+    printf '*filter\n-A TEST-MISSING -j ACCEPT\nCOMMIT\n' > "${invalid}"
+    if ! "${sbin}/iptables-wrapper" validate-rules "${valid}" > /dev/null; then
+	echo "validate-rules rejected a valid ruleset" 1>&2
+	exit 1
+    fi
+    if "${sbin}/iptables-wrapper" validate-rules "${invalid}" > /dev/null 2>&1; then
+	echo "validate-rules accepted an invalid ruleset" 1>&2
+	exit 1
+    fi
+    rm -f "${valid}" "${invalid}"
+}
+
+ensure_match_regex_works() {
+    iptables-${wrongmode} -t filter -N ACME-CANARY
+    detected=$(IPTABLES_WRAPPER_MATCH_REGEX='^:ACME-CANARY ' "${sbin}/iptables-wrapper" mode)
+    if [ "${detected}" != "${wrongmode}" ]; then
+	echo "IPTABLES_WRAPPER_MATCH_REGEX didn't detect ${wrongmode}, got ${detected}" 1>&2
+	exit 1
+    fi
+    iptables-${wrongmode} -t filter -X ACME-CANARY
+    iptables-${wrongmode} -t filter -N cali-INPUT
+    detected=$(IPTABLES_DETECT_PATTERNS='cali-.*' "${sbin}/iptables-wrapper" mode)
+    if [ "${detected}" != "${wrongmode}" ]; then
+	echo "IPTABLES_DETECT_PATTERNS didn't detect ${wrongmode}, got ${detected}" 1>&2
+	exit 1
+    fi
+    iptables-${wrongmode} -t filter -X cali-INPUT
+    for regex in '(' '.*'; do
+	if output=$(IPTABLES_WRAPPER_MATCH_REGEX="${regex}" "${sbin}/iptables-wrapper" mode 2>&1); then
+	    echo "IPTABLES_WRAPPER_MATCH_REGEX=${regex} was accepted" 1>&2
+	    exit 1
+	fi
+	if ! echo "${output}" | grep -q "invalid IPTABLES_WRAPPER_MATCH_REGEX"; then
+	    echo "unclear error for IPTABLES_WRAPPER_MATCH_REGEX=${regex}: ${output}" 1>&2
+	    exit 1
+	fi
+    done
+}
+
+ensure_netns_flag_works() {
+    if [ "$("${sbin}/iptables-wrapper" mode --netns /proc/self/ns/net)" != "${mode}" ]; then
+	echo "iptables-wrapper mode --netns with the current namespace didn't print ${mode}" 1>&2
+	exit 1
+    fi
+    if "${sbin}/iptables-wrapper" mode --netns /nonexistent > /dev/null 2>&1; then
+	echo "iptables-wrapper mode --netns accepted a missing namespace" 1>&2
+	exit 1
+    fi
+    # Creating a namespace needs unshare and privileges, skip it otherwise.
+    if ! command -v unshare > /dev/null || ! unshare --net true 2> /dev/null; then
+	echo "skipping --netns with an empty network namespace, unshare is not usable"
+	return
+    fi
+    unshare --net sleep 30 &
+    holder=$!
+    sleep 1
+    status=0
+    IPTABLES_WRAPPER_DEFAULT_MODE=none "${sbin}/iptables-wrapper" mode --netns "/proc/${holder}/ns/net" > /dev/null 2>&1 || status=$?
+    if [ "${status}" != 3 ]; then
+	kill "${holder}"
+	echo "expected exit code 3 from mode --netns in an empty network namespace, got ${status}" 1>&2
+	exit 1
+    fi
+    # The iptables command runs in the namespace too, so it must not see the
+    # kubelet chains of the current one.
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables-save"
+    if IPTABLES_NETNS="/proc/${holder}/ns/net" IPTABLES_WRAPPER_READONLY=1 IPTABLES_MODE="${mode}" "${linkdir}/iptables-save" | grep -q KUBE-; then
+	kill "${holder}"
+	echo "iptables-save with IPTABLES_NETNS listed the rules of the current network namespace" 1>&2
+	exit 1
+    fi
+    kill "${holder}"
+    if IPTABLES_NETNS=/nonexistent IPTABLES_WRAPPER_READONLY=1 "${linkdir}/iptables-save" > /dev/null 2>&1; then
+	echo "iptables-save accepted a missing IPTABLES_NETNS" 1>&2
+	exit 1
+    fi
+    rm -rf "${linkdir}"
+}
+
+ensure_sbin_dir_override_works() {
+    if [ "${scenario}" != split ] && [ "$(IPTABLES_SBIN_DIR="${sbin}" "${sbin}/iptables-wrapper" mode)" != "${mode}" ]; then
+	echo "iptables-wrapper mode with IPTABLES_SBIN_DIR=${sbin} didn't print ${mode}" 1>&2
+	exit 1
+    fi
+    empty=$(mktemp -d)
+    if output=$(IPTABLES_SBIN_DIR="${empty}" "${sbin}/iptables-wrapper" mode 2>&1); then
+	echo "iptables-wrapper mode passed with IPTABLES_SBIN_DIR pointing to an empty folder" 1>&2
+	exit 1
+    fi
+    if ! echo "${output}" | grep -qF "${empty}"; then
+	echo "the IPTABLES_SBIN_DIR error didn't list the folder searched: ${output}" 1>&2
+	exit 1
+    fi
+    rmdir "${empty}"
+}
+
+ensure_log_level_works() {
+    if [ "${scenario}" = split ]; then
+	return
+    fi
+    errfile=$(mktemp)
+    if [ "$(IPTABLES_WRAPPER_LOG_LEVEL=debug "${sbin}/iptables-wrapper" mode 2> "${errfile}")" != "${mode}" ]; then
+	echo "iptables-wrapper mode with IPTABLES_WRAPPER_LOG_LEVEL=debug didn't only print ${mode}" 1>&2
+	exit 1
+    fi
+    if ! grep -q "msg=\"Selected the iptables mode\" mode=${mode}" "${errfile}"; then
+	echo "the debug logs didn't include the selected mode: $(cat "${errfile}")" 1>&2
+	exit 1
+    fi
+    if "${sbin}/iptables-wrapper" mode 2>&1 >/dev/null | grep -q "level="; then
+	echo "iptables-wrapper mode logged without IPTABLES_WRAPPER_LOG_LEVEL" 1>&2
+	exit 1
+    fi
+    if IPTABLES_WRAPPER_LOG_LEVEL=verbose "${sbin}/iptables-wrapper" mode > /dev/null 2>&1; then
+	echo "iptables-wrapper mode passed with an invalid IPTABLES_WRAPPER_LOG_LEVEL" 1>&2
+	exit 1
+    fi
+    rm -f "${errfile}"
+}
+
+ensure_nft_kernel_support_is_detected() {
+    # The tests run nft mode too, so the kernel must support nf_tables.
+    if ! "${sbin}/iptables-wrapper" whatif 2>/dev/null | grep -qE '^nft-kernel +- +no sign of missing nf_tables support'; then
+	echo "iptables-wrapper whatif claimed the kernel doesn't support nf_tables" 1>&2
+	exit 1
+    fi
+}
+
+ensure_applet_name_is_preserved() {
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables-save"
+    # The multi binaries dispatch on argv[0], so both when the mode binary is
+    # run directly and when the switched command is, it must be the applet.
+    for readonly in 1 0; do
+	set -- $(IPTABLES_WRAPPER_READONLY=${readonly} IPTABLES_WRAPPER_PRINT_CMD=1 "${linkdir}/iptables-save")
+	if [ "${2:-}" != iptables-save ]; then
+	    echo "iptables-save was run as ${2:-nothing} with IPTABLES_WRAPPER_READONLY=${readonly}" 1>&2
+	    exit 1
+	fi
+    done
+    rm -rf "${linkdir}"
+}
+
+ensure_stale_canaries_are_reported() {
+    warnings=$("${sbin}/iptables-wrapper" whatif 2>&1 > /dev/null)
+    case "${scenario}" in
+	canary)
+	    # The lone canary chain is the stale canary fixture.
+	    if ! echo "${warnings}" | grep -q "^Warning: the ${mode} ipv4 rules only have canary chains"; then
+		echo "iptables-wrapper whatif didn't warn about the lone canary chain" 1>&2
+		exit 1
+	    fi
+	    ;;
+	hint)
+	    if echo "${warnings}" | grep -q "canary chains"; then
+		echo "iptables-wrapper whatif warned about canary chains without any" 1>&2
+		exit 1
+	    fi
+	    ;;
+    esac
+}
+
+ensure_decision_socket_works() {
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables"
+    socket="${linkdir}/decision.sock"
+    # A missing socket must be silently ignored.
+    if ! IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_DECISION_SOCKET="${socket}" "${linkdir}/iptables" -V > /dev/null 2>&1; then
+	echo "iptables failed with a missing decision socket" 1>&2
+	exit 1
+    fi
+    # Listening needs a Unix socket server, which not every test image has.
+    if ! command -v python3 > /dev/null; then
+	rm -rf "${linkdir}"
+	return
+    fi
+    received="${linkdir}/received"
+    python3 -c '
+import socket, sys
+server = socket.socket(socket.AF_UNIX)
+server.bind(sys.argv[1])
+server.listen(1)
+server.settimeout(10)
+conn, _ = server.accept()
+sys.stdout.write(conn.makefile().readline())
+' "${socket}" > "${received}" &
+    listener=$!
+    while [ ! -S "${socket}" ]; do
+	sleep 0.1
+    done
+    IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_DECISION_SOCKET="${socket}" "${linkdir}/iptables" -V > /dev/null
+    wait "${listener}"
+    if ! grep -q "\"mode\":\"${mode}\"" "${received}"; then
+	echo "the decision socket didn't receive mode ${mode}: $(cat "${received}")" 1>&2
+	exit 1
+    fi
+    rm -rf "${linkdir}"
+}
+
+ensure_bindir_install_works() {
+    bindir=$(mktemp -d)/bin
+    output=$("${sbin}/iptables-wrapper" install --bindir "${bindir}")
+    for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+	if [ "$(realpath "${bindir}/${cmd}")" != "${sbin}/iptables-wrapper" ]; then
+	    echo "install --bindir did not link ${bindir}/${cmd} to the wrapper" 1>&2
+	    exit 1
+	fi
+    done
+    if ! echo "${output}" | grep -qF "export PATH=${bindir}:\$PATH"; then
+	echo "install --bindir did not print the PATH hint" 1>&2
+	exit 1
+    fi
+    # Installing again leaves the correct links untouched.
+    output=$("${sbin}/iptables-wrapper" install --bindir "${bindir}")
+    if ! echo "${output}" | grep -q "^0 created, 0 updated, 6 unchanged, 0 skipped$"; then
+	echo "installing again changed the links: ${output}" 1>&2
+	exit 1
+    fi
+    rm -rf "$(dirname "${bindir}")"
+}
+
+ensure_install_presets_work() {
+    bindir=$(mktemp -d)
+    "${sbin}/iptables-wrapper" install --dir "${bindir}" --preset save-restore > /dev/null
+    installed=$(ls "${bindir}" | sort | tr '\n' ' ')
+    if [ "${installed}" != "ip6tables-restore ip6tables-save iptables-restore iptables-save " ]; then
+	echo "install --preset save-restore installed the wrong commands: ${installed}" 1>&2
+	exit 1
+    fi
+    if "${sbin}/iptables-wrapper" install --dir "${bindir}" --preset no-such-preset > /dev/null 2>&1; then
+	echo "install accepted an unknown preset" 1>&2
+	exit 1
+    fi
+    rm -rf "${bindir}"
+}
+
+ensure_copy_install_works() {
+    bindir=$(mktemp -d)
+    IPTABLES_INSTALL_MODE=copy "${sbin}/iptables-wrapper" install --dir "${bindir}" > /dev/null
+    for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+	if [ -L "${bindir}/${cmd}" ] || [ ! -x "${bindir}/${cmd}" ] || ! cmp -s "${bindir}/${cmd}" "${sbin}/iptables-wrapper"; then
+	    echo "install --mode copy did not copy the wrapper to ${bindir}/${cmd}" 1>&2
+	    exit 1
+	fi
+    done
+    output=$("${sbin}/iptables-wrapper" install --dir "${bindir}" --mode copy)
+    if ! echo "${output}" | grep -q "^0 created, 0 updated, 6 unchanged, 0 skipped$"; then
+	echo "installing the copies again changed them: ${output}" 1>&2
+	exit 1
+    fi
+    if ! "${sbin}/iptables-wrapper" verify --dir "${bindir}" | grep -q "PASS: iptables-save points to the wrapper"; then
+	echo "verify didn't accept the copies of the wrapper" 1>&2
+	exit 1
+    fi
+    # A copy dispatches on its own name like a symlink, and its recursion
+    # guard still works.
+    set -- $(IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_PRINT_CMD=1 "${bindir}/iptables-save")
+    if [ "${2:-}" != iptables-save ]; then
+	echo "the iptables-save copy of the wrapper ran ${2:-nothing}" 1>&2
+	exit 1
+    fi
+    if IPTABLES_WRAPPER_DEPTH=1 "${bindir}/iptables" -V > /dev/null 2>&1; then
+	echo "the iptables copy of the wrapper didn't refuse to call itself" 1>&2
+	exit 1
+    fi
+    "${sbin}/iptables-wrapper" uninstall --dir "${bindir}" > /dev/null
+    if [ -n "$(ls "${bindir}")" ]; then
+	echo "uninstall left copies behind: $(ls "${bindir}")" 1>&2
+	exit 1
+    fi
+    rm -rf "${bindir}"
+}
+
+ensure_hardlink_install_works() {
+    # Hard links only work within a filesystem, so use a copy of the wrapper
+    # next to the folder they are created in.
+    tmpdir=$(mktemp -d)
+    cp "${sbin}/iptables-wrapper" "${tmpdir}/iptables-wrapper"
+    mkdir "${tmpdir}/bin"
+    "${tmpdir}/iptables-wrapper" install --dir "${tmpdir}/bin" --mode hardlink > /dev/null
+    for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+	if [ -L "${tmpdir}/bin/${cmd}" ] || ! [ "${tmpdir}/bin/${cmd}" -ef "${tmpdir}/iptables-wrapper" ]; then
+	    echo "install --mode hardlink did not link ${tmpdir}/bin/${cmd} to the wrapper" 1>&2
+	    exit 1
+	fi
+    done
+    # The applet and its IP family are taken from the name of the hard link.
+    errfile=$(mktemp)
+    set -- $(IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_PRINT_CMD=1 IPTABLES_WRAPPER_LOG_LEVEL=info "${tmpdir}/bin/ip6tables-save" 2> "${errfile}")
+    if [ "${2:-}" != ip6tables-save ]; then
+	echo "the ip6tables-save hard link to the wrapper ran ${2:-nothing}" 1>&2
+	exit 1
+    fi
+    if ! grep -q "msg=\"Selected the iptables mode\" mode=[a-z]* family=ipv6" "${errfile}"; then
+	echo "the ip6tables-save hard link to the wrapper didn't detect the IPv6 mode: $(cat "${errfile}")" 1>&2
+	exit 1
+    fi
+    "${tmpdir}/iptables-wrapper" uninstall --dir "${tmpdir}/bin" > /dev/null
+    if [ -n "$(ls "${tmpdir}/bin")" ]; then
+	echo "uninstall left hard links behind: $(ls "${tmpdir}/bin")" 1>&2
+	exit 1
+    fi
+    rm -rf "${tmpdir}" "${errfile}"
+}
+
+ensure_arp_ebtables_install_works() {
+    bindir=$(mktemp -d)
+    "${sbin}/iptables-wrapper" install --dir "${bindir}" --preset ipv4 > /dev/null
+    if [ -e "${bindir}/ebtables" ]; then
+	echo "install linked ebtables without --arp-ebtables" 1>&2
+	exit 1
+    fi
+    "${sbin}/iptables-wrapper" install --dir "${bindir}" --preset ipv4 --arp-ebtables > /dev/null
+    for cmd in arptables arptables-save arptables-restore ebtables ebtables-save ebtables-restore; do
+	if [ "$(realpath "${bindir}/${cmd}")" != "${sbin}/iptables-wrapper" ]; then
+	    echo "install --arp-ebtables did not link ${bindir}/${cmd} to the wrapper" 1>&2
+	    exit 1
+	fi
+    done
+    "${sbin}/iptables-wrapper" uninstall --dir "${bindir}" > /dev/null
+    if [ -n "$(ls "${bindir}")" ]; then
+	echo "uninstall left commands behind: $(ls "${bindir}")" 1>&2
+	exit 1
+    fi
+    rm -rf "${bindir}"
+}
+
+ensure_concurrent_installs_work() {
+    bindir=$(mktemp -d)
+    pids=""
+    for i in 1 2 3 4; do
+	"${sbin}/iptables-wrapper" install --dir "${bindir}" > /dev/null &
+	pids="${pids} $!"
+    done
+    for pid in ${pids}; do
+	if ! wait "${pid}"; then
+	    echo "concurrent installs into the same folder failed" 1>&2
+	    exit 1
+	fi
+    done
+    rm -rf "${bindir}"
+
+    # While the folder is locked, e.g. by a mode switch, installs wait for it.
+    if ! command -v flock > /dev/null; then
+	echo "skipping the install lock test, flock is not installed"
+	return
+    fi
+    bindir=$(mktemp -d)
+    flock "${bindir}/.iptables-wrapper.lock" sleep 3 &
+    holder=$!
+    sleep 1
+    "${sbin}/iptables-wrapper" install --dir "${bindir}" > /dev/null 2> "${bindir}/.stderr" &
+    installer=$!
+    sleep 1
+    if [ -n "$(ls "${bindir}")" ]; then
+	echo "install changed the commands while the folder was locked: $(ls "${bindir}")" 1>&2
+	exit 1
+    fi
+    if ! wait "${installer}" || [ ! -L "${bindir}/iptables" ]; then
+	echo "install failed after the folder was unlocked: $(cat "${bindir}/.stderr")" 1>&2
+	exit 1
+    fi
+    if ! grep -q "is locked by another installation or mode switch" "${bindir}/.stderr"; then
+	echo "install didn't warn about the locked folder: $(cat "${bindir}/.stderr")" 1>&2
+	exit 1
+    fi
+    wait "${holder}"
+    rm -rf "${bindir}"
+}
+
+ensure_links_are_replaced_atomically() {
+    bindir=$(mktemp -d)
+    "${sbin}/iptables-wrapper" install --dir "${bindir}" > /dev/null
+    (
+	# Alternate between two paths to the wrapper, so the links always change.
+	for i in $(seq 10); do
+	    "${sbin}/iptables-wrapper" install --dir "${bindir}" --wrapper "${sbin}/../$(basename "${sbin}")/iptables-wrapper" > /dev/null
+	    "${sbin}/iptables-wrapper" install --dir "${bindir}" > /dev/null
+	done
+    ) &
+    installs=$!
+    # The links are renamed over the old ones, so they never go missing.
+    while kill -0 "${installs}" 2> /dev/null; do
+	if [ ! -L "${bindir}/iptables" ]; then
+	    echo "${bindir}/iptables was missing while it was reinstalled" 1>&2
+	    exit 1
+	fi
+    done
+    wait "${installs}"
+    if ls -A "${bindir}" | grep -q '\.tmp'; then
+	echo "reinstalling left temporary links behind: $(ls -A "${bindir}")" 1>&2
+	exit 1
+    fi
+    rm -rf "${bindir}"
+}
+
+ensure_verify_works() {
+    if ! output=$("${sbin}/iptables-wrapper" verify); then
+	echo "iptables-wrapper verify failed before the mode was selected: ${output}" 1>&2
+	exit 1
+    fi
+}
+
+ensure_uninstall_works() {
+    bindir=$(mktemp -d)
+    "${sbin}/iptables-wrapper" install --dir "${bindir}" > /dev/null
+    # These must be left untouched.
+    rm "${bindir}/iptables-save" "${bindir}/ip6tables-save"
+    echo "not a link" > "${bindir}/iptables-save"
+    ln -s /bin/true "${bindir}/ip6tables-save"
+
+    "${sbin}/iptables-wrapper" uninstall --dir "${bindir}" > /dev/null 2>&1
+    for cmd in iptables iptables-restore ip6tables ip6tables-restore; do
+	if [ -e "${bindir}/${cmd}" ] || [ -L "${bindir}/${cmd}" ]; then
+	    echo "uninstall did not remove ${bindir}/${cmd}" 1>&2
+	    exit 1
+	fi
+    done
+    if [ ! -f "${bindir}/iptables-save" ] || [ "$(readlink "${bindir}/ip6tables-save")" != /bin/true ]; then
+	echo "uninstall removed files that don't point to the wrapper" 1>&2
+	exit 1
+    fi
+    if ! "${sbin}/iptables-wrapper" uninstall --dir "${bindir}" > /dev/null 2>&1; then
+	echo "uninstall is not idempotent" 1>&2
+	exit 1
+    fi
+    rm -rf "${bindir}"
+}
+
+ensure_verify_self_works() {
+    bindir=$(mktemp -d)
+    if ! "${sbin}/iptables-wrapper" install --verify-self --bindir "${bindir}" > /dev/null; then
+	echo "install --verify-self rejected the wrapper" 1>&2
+	exit 1
+    fi
+    # /bin/sh is dynamically linked in all the test images.
+    if "${sbin}/iptables-wrapper" install --verify-self --bindir "${bindir}" --wrapper /bin/sh > /dev/null 2>&1; then
+	echo "install --verify-self accepted a dynamically linked wrapper" 1>&2
+	exit 1
+    fi
+    rm -rf "${bindir}"
+}
+
+ensure_recursion_guard_works() {
+    if IPTABLES_WRAPPER_DEPTH=1 iptables -V > /dev/null 2>&1; then
+	echo "the wrapper ran when called from itself" 1>&2
+	exit 1
+    fi
+    if ! IPTABLES_WRAPPER_DEPTH=1 IPTABLES_WRAPPER_ALLOW_RECURSION=1 iptables -V > /dev/null; then
+	echo "the wrapper refused to run with IPTABLES_WRAPPER_ALLOW_RECURSION" 1>&2
+	exit 1
+    fi
+}
+
+ensure_no_mode_error_has_hints() {
+    status=0
+    output=$(IPTABLES_WRAPPER_DEFAULT_MODE=none iptables -V 2>&1) || status=$?
+    if [ "${status}" != 3 ]; then
+	echo "expected exit code 3 when no mode is detected, got ${status}" 1>&2
+	exit 1
+    fi
+    if ! echo "${output}" | grep -q "no kubelet chains" || ! echo "${output}" | grep -q "IPTABLES_WRAPPER_DEFAULT_MODE=nft"; then
+	echo "the no mode detected error doesn't explain how to fix it: ${output}" 1>&2
+	exit 1
+    fi
+}
+
+ensure_output_modes_match() {
+    for args in "-V" "-t no-such-table -L"; do
+	stream_status=0
+	buffer_status=0
+	# shellcheck disable=SC2086
+	stream=$(IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_OUTPUT_MODE=stream iptables ${args} 2>&1) || stream_status=$?
+	# shellcheck disable=SC2086
+	buffer=$(IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_OUTPUT_MODE=buffer iptables ${args} 2>&1) || buffer_status=$?
+	if [ "${stream}" != "${buffer}" ] || [ "${stream_status}" != "${buffer_status}" ]; then
+	    echo "iptables ${args} differs between stream (${stream_status}: ${stream}) and buffer (${buffer_status}: ${buffer}) output modes" 1>&2
+	    exit 1
+	fi
+    done
+}
+
+ensure_probe_env_is_applied() {
+    log=$(mktemp)
+    probe=$(mktemp)
+    printf '#!/bin/sh\necho "${PROBE_TEST:-unset}" >> %s\nexec "$@"\n' "${log}" > "${probe}"
+    chmod +x "${probe}"
+    IPTABLES_WRAPPER_PROBE_PREFIX="${probe}" IPTABLES_WRAPPER_PROBE_ENV_PROBE_TEST=set iptables -V > /dev/null
+    if ! grep -q '^set$' "${log}" || grep -q '^unset$' "${log}"; then
+	echo "IPTABLES_WRAPPER_PROBE_ENV_PROBE_TEST was not applied to every probe" 1>&2
+	exit 1
+    fi
+    rm -f "${log}" "${probe}"
+}
+
+ensure_detect_timeout_is_applied() {
+    probe=$(mktemp)
+    printf '#!/bin/sh\nexec sleep 30\n' > "${probe}"
+    chmod +x "${probe}"
+    start=$(date +%s)
+    status=0
+    output=$(IPTABLES_WRAPPER_PROBE_PREFIX="${probe}" IPTABLES_DETECT_TIMEOUT=1s iptables -V 2>&1) || status=$?
+    elapsed=$(($(date +%s) - start))
+    if [ "${status}" = 0 ] || ! echo "${output}" | grep -q "timed out after 1s"; then
+	echo "a hanging probe didn't make detection fail with a timeout (${status}): ${output}" 1>&2
+	exit 1
+    fi
+    if [ "${elapsed}" -gt 10 ]; then
+	echo "detection with a hanging probe took ${elapsed}s despite IPTABLES_DETECT_TIMEOUT=1s" 1>&2
+	exit 1
+    fi
+    rm -f "${probe}"
+}
+
+ensure_forced_mode_works() {
+    if IPTABLES_MODE=bogus iptables -V > /dev/null 2>&1; then
+	echo "the wrapper accepted an invalid IPTABLES_MODE" 1>&2
+	exit 1
+    fi
+    for forced in legacy nft; do
+	version=$(IPTABLES_MODE=${forced} iptables -V | sed -e 's/.*(\(.*\)).*/\1/')
+	case "${version}/${forced}" in
+	    legacy/legacy|nf_tables/nft)
+		;;
+	    *)
+		echo "IPTABLES_MODE=${forced} ran the ${version} backend" 1>&2
+		exit 1
+		;;
+	esac
+    done
+}
+
+ensure_restore_reads_stdin() {
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables-restore"
+    printf '*filter\n:TEST-STDIN - [0:0]\nCOMMIT\n' | IPTABLES_WRAPPER_READONLY=1 "${linkdir}/iptables-restore" --noflush
+    if ! iptables-${mode} -t filter -n -L TEST-STDIN > /dev/null 2>&1; then
+	echo "the ruleset piped to iptables-restore didn't reach it" 1>&2
+	exit 1
+    fi
+    rm -rf "${linkdir}"
+}
+
+ensure_lock_policies_work() {
+    # Only the legacy backend takes the xtables lock.
+    if [ "${mode}" != legacy ]; then
+	return
+    fi
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables"
+    lock="${XTABLES_LOCKFILE:-/run/xtables.lock}"
+
+    for policy in fail retry-5 wait; do
+	flock "${lock}" sleep 3 &
+	holder=$!
+	sleep 1
+	status=0
+	IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_LOCK_POLICY=${policy} "${linkdir}/iptables" -t filter -N TEST-LOCK-${policy} > /dev/null 2>&1 || status=$?
+	wait "${holder}"
+	case "${policy}/${status}" in
+	    fail/4|retry-5/0|wait/0)
+		;;
+	    *)
+		echo "unexpected exit code ${status} with IPTABLES_WRAPPER_LOCK_POLICY=${policy}" 1>&2
+		exit 1
+		;;
+	esac
+    done
+    rm -rf "${linkdir}"
+}
+
+ensure_mode_cache_works() {
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables-save"
+    cache="${linkdir}/iptables-mode"
+    # In read-only mode, the mode is detected for the family of the command,
+    # so it isn't cached for the whole node.
+    IPTABLES_WRAPPER_MODE_CACHE_FILE="${cache}" IPTABLES_WRAPPER_MODE_CACHE_TTL=1h IPTABLES_WRAPPER_READONLY=1 "${linkdir}/iptables-save" > /dev/null
+    if [ -e "${cache}" ]; then
+	echo "the wrapper cached the mode detected in read-only mode" 1>&2
+	exit 1
+    fi
+    IPTABLES_WRAPPER_MODE_CACHE_FILE="${cache}" IPTABLES_WRAPPER_MODE_CACHE_TTL=1h IPTABLES_WRAPPER_NO_SWITCH_APPLETS=iptables-save "${linkdir}/iptables-save" > /dev/null
+    if [ "$(cat "${cache}")" != nft ]; then
+	echo "the wrapper didn't cache the nft mode selected without rules: $(cat "${cache}")" 1>&2
+	exit 1
+    fi
+    # A fresh cache is used instead of the detection, a stale one isn't.
+    echo legacy > "${cache}"
+    set -- $(IPTABLES_WRAPPER_MODE_CACHE_FILE="${cache}" IPTABLES_WRAPPER_MODE_CACHE_TTL=1h IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_PRINT_CMD=1 "${linkdir}/iptables-save")
+    if [ "${1:-}" != "${sbin}/xtables-legacy-multi" ]; then
+	echo "the wrapper ignored the fresh mode cache and ran ${1:-nothing}" 1>&2
+	exit 1
+    fi
+    sleep 2
+    set -- $(IPTABLES_WRAPPER_MODE_CACHE_FILE="${cache}" IPTABLES_WRAPPER_MODE_CACHE_TTL=1 IPTABLES_WRAPPER_NO_SWITCH_APPLETS=iptables-save IPTABLES_WRAPPER_PRINT_CMD=1 "${linkdir}/iptables-save")
+    if [ "${1:-}" != "${sbin}/xtables-nft-multi" ] || [ "$(cat "${cache}")" != nft ]; then
+	echo "the wrapper used the stale mode cache and ran ${1:-nothing}" 1>&2
+	exit 1
+    fi
+    # Resetting it removes the file, as does uninstalling the wrapper.
+    IPTABLES_WRAPPER_MODE_CACHE_FILE="${cache}" "${sbin}/iptables-wrapper" mode --reset-cache > /dev/null
+    if [ -e "${cache}" ]; then
+	echo "iptables-wrapper mode --reset-cache didn't remove the mode cache" 1>&2
+	exit 1
+    fi
+    echo legacy > "${cache}"
+    if ! IPTABLES_WRAPPER_MODE_CACHE_FILE="${cache}" "${sbin}/iptables-wrapper" uninstall --dir "${linkdir}" --wrapper "${sbin}/iptables-wrapper" | grep -q "^removed ${cache}$" || [ -e "${cache}" ]; then
+	echo "iptables-wrapper uninstall didn't remove the mode cache" 1>&2
+	exit 1
+    fi
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables-save"
+    # Without a TTL, there is no cache.
+    IPTABLES_WRAPPER_MODE_CACHE_FILE="${cache}" IPTABLES_WRAPPER_NO_SWITCH_APPLETS=iptables-save "${linkdir}/iptables-save" > /dev/null
+    if [ -e "${cache}" ]; then
+	echo "the wrapper wrote the mode cache without IPTABLES_WRAPPER_MODE_CACHE_TTL" 1>&2
+	exit 1
+    fi
+    rm -rf "${linkdir}"
+}
+
+ensure_path_works() {
+    for backend in nft legacy; do
+	if [ -x "${sbin}/xtables-${backend}-multi" ] && [ "$("${sbin}/iptables-wrapper" path "${backend}")" != "${sbin}/xtables-${backend}-multi" ]; then
+	    echo "iptables-wrapper path ${backend} didn't print ${sbin}/xtables-${backend}-multi" 1>&2
+	    exit 1
+	fi
+    done
+    empty=$(mktemp -d)
+    touch "${empty}/iptables"
+    chmod +x "${empty}/iptables"
+    if IPTABLES_SBIN_DIR="${empty}" "${sbin}/iptables-wrapper" path nft > /dev/null 2>&1; then
+	echo "iptables-wrapper path nft passed without xtables-nft-multi" 1>&2
+	exit 1
+    fi
+    rm -rf "${empty}"
+}
+
+ensure_unknown_applets_are_refused() {
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/conntrack"
+    if "${linkdir}/conntrack" -L > /dev/null 2>&1; then
+	echo "the wrapper ran as conntrack" 1>&2
+	exit 1
+    fi
+    rm -rf "${linkdir}"
+}
+
+ensure_bad_versions_are_refused() {
+    fakedir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${fakedir}/iptables"
+    # Real `iptables --version` outputs from different distros, and some
+    # without the v or with a distro suffix.
+    for version in \
+	"iptables v1.4.21" \
+	"iptables v1.6.1" \
+	"iptables v1.8.0 (nf_tables)" \
+	"iptables v1.8.2 (nf_tables)" \
+	"iptables 1.8.2" \
+	"iptables v1.8.3 (nf_tables)" \
+	"iptables v1.8.3-5.el8 (nf_tables)" \
+	"iptables v1.8.4 (nf_tables)" \
+	"iptables v1.8.7 (nf_tables)" \
+	"iptables v1.8.8 (nf_tables)" \
+	"iptables v1.8.9 (nf_tables)" \
+	"iptables v1.8.10 (nf_tables)" \
+	"iptables v1.8.30 (nf_tables)" \
+	"iptables v2.0.0 (nf_tables)"; do
+	# Only nft is installed, so it's selected without any rules.
+	printf '#!/bin/sh\ncase "$*" in *--version*) echo "%s" ;; *) echo ran ;; esac\n' "${version}" > "${fakedir}/xtables-nft-multi"
+	chmod +x "${fakedir}/xtables-nft-multi"
+	status=0
+	output=$(IPTABLES_SBIN_DIR="${fakedir}" IPTABLES_WRAPPER_READONLY=1 "${fakedir}/iptables" -L 2>&1) || status=$?
+	case "${version}" in
+	    *1.8.[0123]\ *|*1.8.[0123]-*|*1.8.[0123])
+		if [ "${status}" = 0 ] || ! echo "${output}" | grep -q "upgrade to 1.8.4 or newer"; then
+		    echo "the wrapper ran iptables with ${version}: ${output}" 1>&2
+		    exit 1
+		fi
+		if [ "$(IPTABLES_WRAPPER_NO_VERSION_CHECK=1 IPTABLES_SBIN_DIR="${fakedir}" IPTABLES_WRAPPER_READONLY=1 "${fakedir}/iptables" -L 2>/dev/null)" != ran ]; then
+		    echo "the wrapper refused ${version} with IPTABLES_WRAPPER_NO_VERSION_CHECK=1" 1>&2
+		    exit 1
+		fi
+		;;
+	    *)
+		if [ "${status}" != 0 ] || [ "${output}" != ran ]; then
+		    echo "the wrapper refused iptables with ${version}: ${output}" 1>&2
+		    exit 1
+		fi
+		;;
+	esac
+    done
+    rm -rf "${fakedir}"
+}
+
+# write_fake_backend DIR MODE VERSION writes a fake xtables-MODE-multi to
+# DIR, printing "iptables VERSION" for --version and "ran MODE" otherwise.
+write_fake_backend() {
+    printf '#!/bin/sh\ncase "$*" in *--version*) echo "iptables %s" ;; *) echo "ran %s" ;; esac\n' "$3" "$2" > "$1/xtables-$2-multi"
+    chmod +x "$1/xtables-$2-multi"
+}
+
+# new_fake_sbin sets ${fakedir} to a new folder with the iptables commands
+# symlinked to the wrapper and fake nft and legacy backends, to be used with
+# IPTABLES_SBIN_DIR.
+new_fake_sbin() {
+    fakedir=$(mktemp -d)
+    for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+	ln -s "${sbin}/iptables-wrapper" "${fakedir}/${cmd}"
+    done
+    write_fake_backend "${fakedir}" nft "v1.8.9 (nf_tables)"
+    write_fake_backend "${fakedir}" legacy "v1.8.9 (legacy)"
+}
+
+# run_verify_image DIR ARGS... runs verify-image against the fake sbin folder
+# DIR, saving its output in ${output} and its exit code in ${status}.
+run_verify_image() {
+    fakedir=$1
+    shift
+    status=0
+    output=$(IPTABLES_SBIN_DIR="${fakedir}" "${sbin}/iptables-wrapper" verify-image "$@" 2>&1) || status=$?
+}
+
+# expect_verify_image STATUS LINE fails unless the last run_verify_image
+# exited with STATUS and printed LINE.
+expect_verify_image() {
+    if [ "${status}" != "$1" ] || ! echo "${output}" | grep -qx "$2"; then
+	echo "verify-image didn't exit with $1 and print '$2', exited with ${status}: ${output}" 1>&2
+	exit 1
+    fi
+}
+
+ensure_verify_image_works() {
+    new_fake_sbin
+    run_verify_image "${fakedir}"
+    expect_verify_image 0 "all 11 checks passed"
+    expect_verify_image 0 "PASS: backend versions match"
+
+    # Mismatched versions only warn, unless warnings are errors.
+    write_fake_backend "${fakedir}" legacy "v1.8.7 (legacy)"
+    run_verify_image "${fakedir}"
+    expect_verify_image 0 "WARN: backend versions match: nft is 1.8.9 but legacy is 1.8.7"
+    expect_verify_image 0 "all 11 checks passed, with 1 warnings"
+    run_verify_image "${fakedir}" --warnings-as-errors
+    expect_verify_image 1 "FAIL: backend versions match: nft is 1.8.9 but legacy is 1.8.7"
+    expect_verify_image 1 "1 of 11 checks failed"
+
+    # A buggy version fails even without --warnings-as-errors.
+    write_fake_backend "${fakedir}" nft "v1.8.2 (nf_tables)"
+    run_verify_image "${fakedir}"
+    expect_verify_image 1 "FAIL: nft backend version is safe: .*upgrade to 1.8.4 or newer"
+    write_fake_backend "${fakedir}" nft "v1.8.7 (nf_tables)"
+
+    # A missing backend fails, unless only the other one is required, in
+    # which case it only warns.
+    rm "${fakedir}/xtables-legacy-multi"
+    run_verify_image "${fakedir}"
+    expect_verify_image 1 "FAIL: legacy backend is installed: ${fakedir}/xtables-legacy-multi is not executable"
+    run_verify_image "${fakedir}" --single-backend nft
+    expect_verify_image 0 "WARN: both backends are installed: only nft is required, nodes using legacy mode can't be handled"
+    expect_verify_image 0 "all 9 checks passed, with 1 warnings"
+    run_verify_image "${fakedir}" --single-backend nft --warnings-as-errors
+    expect_verify_image 1 "FAIL: both backends are installed: only nft is required, nodes using legacy mode can't be handled"
+    run_verify_image "${fakedir}" --single-backend legacy
+    expect_verify_image 1 "FAIL: legacy backend is installed: ${fakedir}/xtables-legacy-multi is not executable"
+    run_verify_image "${fakedir}" --single-backend bogus
+    expect_verify_image 2 "Error: .*"
+    rm -rf "${fakedir}"
+}
+
+ensure_firewalld_is_detected() {
+    mkdir -p /var/run
+    touch /var/run/firewalld.pid
+    # Only nft is installed, so it's selected without any rules and the
+    # commands in the fake folder are switched to it.
+    new_fake_sbin
+    rm "${fakedir}/xtables-legacy-multi"
+    status=0
+    output=$(IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L 2>&1) || status=$?
+    if [ "${status}" != 0 ] || ! echo "${output}" | grep -q "^Warning: firewalld is running" || ! echo "${output}" | grep -q "^ran nft$"; then
+	echo "the wrapper didn't warn about firewalld and switch anyway, exited with ${status}: ${output}" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}"
+
+    new_fake_sbin
+    rm "${fakedir}/xtables-legacy-multi"
+    status=0
+    output=$(IPTABLES_WRAPPER_STRICT=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L 2>&1) || status=$?
+    if [ "${status}" != 1 ] || [ "${output}" != "Error: refusing to switch iptables mode: firewalld is running" ]; then
+	echo "the wrapper didn't refuse to switch with firewalld in strict mode, exited with ${status}: ${output}" 1>&2
+	exit 1
+    fi
+    if [ "$(readlink "${fakedir}/iptables")" != "${sbin}/iptables-wrapper" ]; then
+	echo "the wrapper switched ${fakedir}/iptables with firewalld in strict mode" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}" /var/run/firewalld.pid
+}
+
+ensure_child_output_is_redirected() {
+    new_fake_sbin
+    rm "${fakedir}/xtables-legacy-multi"
+    printf '#!/bin/sh\necho "to stdout $*"\necho "to stderr $*" 1>&2\n' > "${fakedir}/xtables-nft-multi"
+    for run in 1 2; do
+	IPTABLES_WRAPPER_READONLY=1 IPTABLES_SBIN_DIR="${fakedir}" \
+	    IPTABLES_WRAPPER_CHILD_STDOUT="${fakedir}/child.out" IPTABLES_WRAPPER_CHILD_STDERR="${fakedir}/child.err" \
+	    "${fakedir}/iptables" -L "run${run}" > "${fakedir}/terminal.out" 2> "${fakedir}/terminal.err"
+    done
+    if [ -s "${fakedir}/terminal.out" ] || [ -s "${fakedir}/terminal.err" ]; then
+	echo "the child output reached the terminal: $(cat "${fakedir}/terminal.out" "${fakedir}/terminal.err")" 1>&2
+	exit 1
+    fi
+    # The files are appended to, not truncated.
+    if [ "$(cat "${fakedir}/child.out")" != "$(printf 'to stdout -L run1\nto stdout -L run2')" ]; then
+	echo "IPTABLES_WRAPPER_CHILD_STDOUT didn't get the command's stdout: $(cat "${fakedir}/child.out")" 1>&2
+	exit 1
+    fi
+    if [ "$(cat "${fakedir}/child.err")" != "$(printf 'to stderr -L run1\nto stderr -L run2')" ]; then
+	echo "IPTABLES_WRAPPER_CHILD_STDERR didn't get the command's stderr: $(cat "${fakedir}/child.err")" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}"
+}
+
+ensure_post_switch_hook_works() {
+    hookdir=$(mktemp -d)
+    printf '#!/bin/sh\necho "$* ${IPTABLES_WRAPPER_MODE}" >> "%s/calls"\nexit ${HOOK_STATUS:-0}\n' "${hookdir}" > "${hookdir}/hook"
+    chmod +x "${hookdir}/hook"
+
+    # It runs once, after the switch, with the mode as last argument and in
+    # the environment.
+    new_fake_sbin
+    rm "${fakedir}/xtables-legacy-multi"
+    for run in 1 2; do
+	IPTABLES_WRAPPER_POST_SWITCH_HOOK="${hookdir}/hook switched" IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L > /dev/null
+    done
+    if [ "$(cat "${hookdir}/calls")" != "switched nft nft" ]; then
+	echo "the post switch hook didn't run once with the mode: $(cat "${hookdir}/calls")" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}" "${hookdir}/calls"
+
+    # Nothing is switched in read-only mode, or if the switch fails.
+    new_fake_sbin
+    rm "${fakedir}/xtables-legacy-multi"
+    IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_POST_SWITCH_HOOK="${hookdir}/hook" IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L > /dev/null
+    # A folder can't be replaced by the switch.
+    rm "${fakedir}/ip6tables-save"
+    mkdir -p "${fakedir}/ip6tables-save/busy"
+    IPTABLES_WRAPPER_POST_SWITCH_HOOK="${hookdir}/hook" IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L > /dev/null 2>&1
+    if [ -e "${hookdir}/calls" ]; then
+	echo "the post switch hook ran without a switch: $(cat "${hookdir}/calls")" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}"
+
+    # If it fails, the wrapper warns and runs the command anyway.
+    new_fake_sbin
+    rm "${fakedir}/xtables-legacy-multi"
+    status=0
+    output=$(HOOK_STATUS=3 IPTABLES_WRAPPER_POST_SWITCH_HOOK="${hookdir}/hook" IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L 2>&1) || status=$?
+    if [ "${status}" != 0 ] || ! echo "${output}" | grep -q "^Warning: post switch hook failed: " || ! echo "${output}" | grep -q "^ran nft$"; then
+	echo "the wrapper didn't warn about the failed hook and run the command, exited with ${status}: ${output}" 1>&2
+	exit 1
+    fi
+    if [ "$(readlink "${fakedir}/iptables")" != "${fakedir}/xtables-nft-multi" ]; then
+	echo "the switch was undone after the post switch hook failed" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}" "${hookdir}"
+}
+
+ensure_alternatives_links_are_retargeted() {
+    # Without the alternatives commands in the sbin folder, the commands
+    # managed through /etc/alternatives keep that structure and the links in
+    # there are switched instead. Their names are unique so the image's own
+    # alternatives are left alone.
+    new_fake_sbin
+    rm "${fakedir}/xtables-legacy-multi"
+    mkdir -p /etc/alternatives
+    for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+	ln -sf "${sbin}/iptables-wrapper" "/etc/alternatives/wrapper-test-${cmd}"
+	ln -sf "/etc/alternatives/wrapper-test-${cmd}" "${fakedir}/${cmd}"
+    done
+    if ! IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L | grep -q "^ran nft$"; then
+	echo "the wrapper didn't run nft with the commands managed by /etc/alternatives" 1>&2
+	exit 1
+    fi
+    for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+	if [ "$(readlink "${fakedir}/${cmd}")" != "/etc/alternatives/wrapper-test-${cmd}" ]; then
+	    echo "${fakedir}/${cmd} doesn't point to /etc/alternatives anymore: $(readlink "${fakedir}/${cmd}")" 1>&2
+	    exit 1
+	fi
+	if [ "$(readlink "/etc/alternatives/wrapper-test-${cmd}")" != "${fakedir}/xtables-nft-multi" ]; then
+	    echo "/etc/alternatives/wrapper-test-${cmd} wasn't switched to nft: $(readlink "/etc/alternatives/wrapper-test-${cmd}")" 1>&2
+	    exit 1
+	fi
+    done
+    rm -rf "${fakedir}" /etc/alternatives/wrapper-test-*
+}
+
+ensure_debug_dir_works() {
+    new_fake_sbin
+    # Legacy has the kubelet hint chain in every save, nft has no chains.
+    printf '#!/bin/sh\ncase "$*" in *--version*) echo "iptables v1.8.9 (legacy)" ;; -L*) echo "ran legacy" ;; *) printf "*mangle\\n:KUBE-IPTABLES-HINT - [0:0]\\nCOMMIT\\n" ;; esac\n' > "${fakedir}/xtables-legacy-multi"
+    debugdir=$(mktemp -d)
+    if [ "$(IPTABLES_WRAPPER_DEBUG_DIR="${debugdir}" IPTABLES_WRAPPER_READONLY=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L)" != "ran legacy" ]; then
+	echo "the wrapper didn't run legacy with IPTABLES_WRAPPER_DEBUG_DIR" 1>&2
+	exit 1
+    fi
+    set -- "${debugdir}"/*
+    if [ $# != 1 ] || [ ! -f "$1/decision.json" ]; then
+	echo "IPTABLES_WRAPPER_DEBUG_DIR doesn't have a single folder with a decision.json: $(ls -R "${debugdir}")" 1>&2
+	exit 1
+    fi
+    rundir=$1
+    for expected in '"applet": "iptables"' "\"sbinPath\": \"${fakedir}\"" '"mode": "legacy"' '"command": "legacy-iptables-save"' '"command": "nft-iptables-save"' '"KUBE-IPTABLES-HINT"'; do
+	if ! grep -qF "${expected}" "${rundir}/decision.json"; then
+	    echo "decision.json doesn't have ${expected}: $(cat "${rundir}/decision.json")" 1>&2
+	    exit 1
+	fi
+    done
+    # Every probe listed has its raw output saved, and nothing else is.
+    files=$(sed -n 's/^ *"file": "\(.*\)",*$/\1/p' "${rundir}/decision.json" | sort)
+    if [ -z "${files}" ] || [ "${files}" != "$(cd "${rundir}" && ls *.txt | sort)" ]; then
+	echo "the probe files don't match decision.json: $(ls "${rundir}")" 1>&2
+	exit 1
+    fi
+    for file in "${rundir}"/*-legacy-iptables-save.txt; do
+	if ! grep -q "^:KUBE-IPTABLES-HINT " "${file}"; then
+	    echo "${file} doesn't have the raw legacy save output: $(cat "${file}")" 1>&2
+	    exit 1
+	fi
+    done
+    for file in "${rundir}"/*-nft-iptables-save.txt; do
+	if [ "$(cat "${file}")" != "ran nft" ]; then
+	    echo "${file} doesn't have the raw nft save output: $(cat "${file}")" 1>&2
+	    exit 1
+	fi
+    done
+
+    # Every detection gets its own folder.
+    IPTABLES_WRAPPER_DEBUG_DIR="${debugdir}" IPTABLES_WRAPPER_READONLY=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L > /dev/null
+    set -- "${debugdir}"/*
+    if [ $# != 2 ]; then
+	echo "a second detection didn't get its own folder in IPTABLES_WRAPPER_DEBUG_DIR: $(ls "${debugdir}")" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}" "${debugdir}"
+}
+
+# snapshot_links DIR... prints every entry of the given folders, with the
+# target of the symlinks and the checksum of the files.
+snapshot_links() {
+    for dir in "$@"; do
+	for entry in "${dir}"/* "${dir}"/.[!.]*; do
+	    if [ -L "${entry}" ]; then
+		echo "${entry} -> $(readlink "${entry}")"
+	    elif [ -f "${entry}" ]; then
+		echo "${entry} $(cksum < "${entry}")"
+	    elif [ -e "${entry}" ]; then
+		echo "${entry}"
+	    fi
+	done
+    done
+}
+
+ensure_readonly_never_writes() {
+    new_fake_sbin
+    printf '#!/bin/sh\ncase "$*" in *--version*) echo "iptables v1.8.9 (legacy)" ;; -L*|-S*) echo "ran legacy $*" ;; *) printf "*mangle\\n:KUBE-IPTABLES-HINT - [0:0]\\nCOMMIT\\n" ;; esac\n' > "${fakedir}/xtables-legacy-multi"
+    altdir=$(mktemp -d)
+    ln -sf "${altdir}/ip6tables" "${fakedir}/ip6tables"
+    ln -s "${sbin}/iptables-wrapper" "${altdir}/ip6tables"
+    before=$(snapshot_links "${fakedir}" "${altdir}")
+
+    output=$(IPTABLES_WRAPPER_READONLY=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L)
+    if [ "${output}" != "ran legacy -L" ]; then
+	echo "IPTABLES_WRAPPER_READONLY=1 iptables -L didn't run the legacy binary: ${output}" 1>&2
+	exit 1
+    fi
+    output=$(IPTABLES_WRAPPER_READONLY=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/ip6tables" -S)
+    if [ "${output}" != "ran legacy -S" ]; then
+	echo "IPTABLES_WRAPPER_READONLY=1 ip6tables -S didn't run the legacy binary: ${output}" 1>&2
+	exit 1
+    fi
+    set -- $(IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_PRINT_CMD=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/ip6tables" -S)
+    if [ "${1:-}" != "${fakedir}/xtables-legacy-multi" ] || [ "${2:-}" != ip6tables ]; then
+	echo "IPTABLES_WRAPPER_READONLY=1 ip6tables -S would run $*" 1>&2
+	exit 1
+    fi
+
+    after=$(snapshot_links "${fakedir}" "${altdir}")
+    if [ "${before}" != "${after}" ]; then
+	echo "IPTABLES_WRAPPER_READONLY=1 changed the commands:" 1>&2
+	echo "before: ${before}" 1>&2
+	echo "after: ${after}" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}" "${altdir}"
+}
+
+# new_mixed_families_sbin sets ${fakedir} to a new folder with the iptables
+# commands symlinked to the wrapper and standalone fake binaries for each mode,
+# where the IPv4 kubelet chains are in legacy and the IPv6 ones in nft.
+new_mixed_families_sbin() {
+    fakedir=$(mktemp -d)
+    for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+	ln -s "${sbin}/iptables-wrapper" "${fakedir}/${cmd}"
+    done
+    for variant in nft legacy; do
+	for cmd in iptables ip6tables; do
+	    printf '#!/bin/sh\ncase "$*" in *--version*) echo "iptables v1.8.9" ;; *) echo "ran %s %s $*" ;; esac\n' "${cmd}" "${variant}" > "${fakedir}/${cmd}-${variant}"
+	    echo '#!/bin/sh' > "${fakedir}/${cmd}-${variant}-save"
+	    chmod +x "${fakedir}/${cmd}-${variant}" "${fakedir}/${cmd}-${variant}-save"
+	done
+    done
+    printf '*mangle\n:KUBE-IPTABLES-HINT - [0:0]\nCOMMIT\n' > "${fakedir}/hint"
+    echo "cat ${fakedir}/hint" >> "${fakedir}/iptables-legacy-save"
+    echo "cat ${fakedir}/hint" >> "${fakedir}/ip6tables-nft-save"
+}
+
+ensure_mixed_families_are_gated() {
+    # Without an authoritative family, the disagreement is refused in strict
+    # mode, and nothing is switched.
+    new_mixed_families_sbin
+    status=0
+    output=$(IPTABLES_WRAPPER_STRICT=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L 2>&1) || status=$?
+    if [ "${status}" != 1 ] || ! echo "${output}" | grep -q "^Error: "; then
+	echo "the wrapper didn't refuse mixed families in strict mode, exited with ${status}: ${output}" 1>&2
+	exit 1
+    fi
+    if [ "$(readlink "${fakedir}/iptables")" != "${sbin}/iptables-wrapper" ]; then
+	echo "the wrapper switched mixed families in strict mode" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}"
+
+    # Without strict mode, it warns and switches both to the same mode.
+    new_mixed_families_sbin
+    output=$(IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L 2>&1)
+    if ! echo "${output}" | grep -q "^Warning: IPv4 rules are in legacy mode but IPv6 rules are in nft mode, using .* mode for both$"; then
+	echo "the wrapper didn't warn about mixed families: ${output}" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}"
+
+    # The authoritative family decides, even in strict mode.
+    for authoritative in ipv4 ipv6; do
+	case "${authoritative}" in
+	    ipv4) backend=legacy ;;
+	    ipv6) backend=nft ;;
+	esac
+	new_mixed_families_sbin
+	if [ "$(IPTABLES_SBIN_DIR="${fakedir}" IPTABLES_WRAPPER_AUTHORITATIVE_FAMILY=${authoritative} "${sbin}/iptables-wrapper" mode 2> /dev/null)" != "${backend}" ]; then
+	    echo "iptables-wrapper mode didn't print the ${backend} mode of the authoritative ${authoritative} rules" 1>&2
+	    exit 1
+	fi
+	status=0
+	output=$(IPTABLES_WRAPPER_STRICT=1 IPTABLES_WRAPPER_AUTHORITATIVE_FAMILY=${authoritative} IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L 2>&1) || status=$?
+	if [ "${status}" != 0 ] || ! echo "${output}" | grep -q "^ran iptables ${backend} -L$" || \
+	   ! echo "${output}" | grep -q "^Warning: IPv4 rules are in legacy mode but IPv6 rules are in nft mode, using the ${backend} mode of the authoritative ${authoritative} rules$"; then
+	    echo "the wrapper didn't use the ${backend} mode of the authoritative ${authoritative} rules, exited with ${status}: ${output}" 1>&2
+	    exit 1
+	fi
+	if [ "$(readlink "${fakedir}/ip6tables")" != "${fakedir}/ip6tables-${backend}" ]; then
+	    echo "ip6tables wasn't switched to the ${backend} mode of the authoritative ${authoritative} rules: $(readlink "${fakedir}/ip6tables")" 1>&2
+	    exit 1
+	fi
+	rm -rf "${fakedir}"
+    done
+}
+
+ensure_forced_mode_overrides_families() {
+    # The forced mode is used for both families, even though their rules
+    # are in different modes.
+    for forced in nft legacy; do
+	new_mixed_families_sbin
+	output=$(IPTABLES_MODE=${forced} IPTABLES_WRAPPER_INDEPENDENT_FAMILIES=1 IPTABLES_SBIN_DIR="${fakedir}" "${fakedir}/iptables" -L 2>&1)
+	if ! echo "${output}" | grep -q "^ran iptables ${forced} -L$"; then
+	    echo "the wrapper didn't run the forced ${forced} mode with independent families: ${output}" 1>&2
+	    exit 1
+	fi
+	for cmd in iptables ip6tables; do
+	    if [ "$(readlink "${fakedir}/${cmd}")" != "${fakedir}/${cmd}-${forced}" ]; then
+		echo "${cmd} wasn't switched to the forced ${forced} mode with independent families: $(readlink "${fakedir}/${cmd}")" 1>&2
+		exit 1
+	    fi
+	done
+	rm -rf "${fakedir}"
+    done
+}
+
+ensure_nft_ruleset_is_weighed() {
+    # The kubelet chains in the nft ruleset conflict with the ones that
+    # iptables-legacy-save finds, instead of winning outright.
+    new_mixed_families_sbin
+    echo '#!/bin/sh' > "${fakedir}/ip6tables-nft-save"
+    printf '#!/bin/sh\nprintf "table ip mangle {\\n\\tchain KUBE-IPTABLES-HINT {\\n\\t}\\n}\\n"\n' > "${fakedir}/nft"
+    chmod +x "${fakedir}/nft"
+    if IPTABLES_WRAPPER_NFT_PROBE=1 IPTABLES_SBIN_DIR="${fakedir}" "${sbin}/iptables-wrapper" mode --strict > /dev/null 2>&1; then
+	echo "iptables-wrapper mode --strict passed with kubelet chains in legacy and in the nft ruleset" 1>&2
+	exit 1
+    fi
+    if ! IPTABLES_WRAPPER_NFT_PROBE=1 IPTABLES_SBIN_DIR="${fakedir}" "${sbin}/iptables-wrapper" mode 2>&1 | grep -q "^Warning: kubelet chains found in both modes"; then
+	echo "iptables-wrapper mode didn't warn about kubelet chains in legacy and in the nft ruleset" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakedir}"
+}
+
+ensure_signals_are_forwarded() {
+    # Only the legacy backend takes the xtables lock, which is used to keep
+    # the command running.
+    if [ "${mode}" != legacy ]; then
+	return
+    fi
+    linkdir=$(mktemp -d)
+    ln -s "${sbin}/iptables-wrapper" "${linkdir}/iptables"
+    lock="${XTABLES_LOCKFILE:-/run/xtables.lock}"
+
+    flock "${lock}" sleep 4 &
+    holder=$!
+    sleep 1
+    # Buffering the output keeps the wrapper as the parent of the command.
+    IPTABLES_WRAPPER_READONLY=1 IPTABLES_WRAPPER_OUTPUT_MODE=buffer "${linkdir}/iptables" -w -t filter -N TEST-SIGNAL > /dev/null 2>&1 &
+    wrapper=$!
+    sleep 1
+    kill -TERM "${wrapper}"
+    status=0
+    wait "${wrapper}" || status=$?
+    wait "${holder}"
+    sleep 1
+    if [ "${status}" != 143 ]; then
+	echo "expected exit code 143 from the wrapper after SIGTERM, got ${status}" 1>&2
+	exit 1
+    fi
+    if iptables-legacy -t filter -n -L TEST-SIGNAL > /dev/null 2>&1; then
+	echo "the command kept running after the wrapper got SIGTERM" 1>&2
+	exit 1
+    fi
+    rm -rf "${linkdir}"
+}
+
+ensure_manifest_matches() {
+    manifest=/iptables-wrapper.manifest
+    if [ ! -f "${manifest}" ]; then
+	return
+    fi
+    grep '^link' "${manifest}" | while IFS="$(printf '\t')" read -r _ link target; do
+	if [ "$(realpath "${link}")" != "${target}" ]; then
+	    echo "manifest link ${link} does not point to ${target}" 1>&2
+	    exit 1
+	fi
+    done
+}
+
+ensure_manifest_round_trip_works() {
+    bindir=$(mktemp -d)
+    manifest="${bindir}.manifest"
+    # Files the install didn't create must survive the uninstall, even if
+    # they run the wrapper.
+    touch "${bindir}/unrelated"
+    ln -s "${sbin}/iptables-wrapper" "${bindir}/arptables"
+    # What the install replaces is restored by the uninstall.
+    ln -s "${bindir}/unrelated" "${bindir}/iptables-restore"
+    echo "real iptables" > "${bindir}/iptables"
+    "${sbin}/iptables-wrapper" install --dir "${bindir}" --preset ipv4 --manifest "${manifest}" > /dev/null
+    for entry in "iptables	${sbin}/iptables-wrapper		${bindir}/iptables.iptables-wrapper-orig" \
+		 "iptables-save	${sbin}/iptables-wrapper" \
+		 "iptables-restore	${sbin}/iptables-wrapper	${bindir}/unrelated	"; do
+	if ! grep -q "^link	${bindir}/${entry}$" "${manifest}"; then
+	    echo "install --manifest did not list ${bindir}/${entry}: $(cat "${manifest}")" 1>&2
+	    exit 1
+	fi
+    done
+    if [ "$(grep -c '^link' "${manifest}")" != 3 ] || ! grep -q '^altstyle	none$' "${manifest}"; then
+	echo "install --manifest wrote an unexpected manifest: $(cat "${manifest}")" 1>&2
+	exit 1
+    fi
+    # A listed command replaced since the install is left alone. The
+    # configured manifest is used without --manifest.
+    rm "${bindir}/iptables-save"
+    echo "not the wrapper" > "${bindir}/iptables-save"
+    if ! IPTABLES_WRAPPER_MANIFEST="${manifest}" "${sbin}/iptables-wrapper" uninstall 2>&1 | grep -q "^Warning: skipping ${bindir}/iptables-save"; then
+	echo "uninstall with IPTABLES_WRAPPER_MANIFEST didn't skip the replaced iptables-save" 1>&2
+	exit 1
+    fi
+    if [ "$(cat "${bindir}/iptables")" != "real iptables" ] || [ -e "${bindir}/iptables.iptables-wrapper-orig" ] || \
+       [ "$(readlink "${bindir}/iptables-restore")" != "${bindir}/unrelated" ]; then
+	echo "uninstall with IPTABLES_WRAPPER_MANIFEST didn't restore the replaced commands: $(ls -l "${bindir}")" 1>&2
+	exit 1
+    fi
+    if [ ! -f "${bindir}/unrelated" ] || [ ! -L "${bindir}/arptables" ] || [ ! -f "${bindir}/iptables-save" ]; then
+	echo "uninstall with IPTABLES_WRAPPER_MANIFEST removed commands it didn't list: $(ls "${bindir}")" 1>&2
+	exit 1
+    fi
+    rm -rf "${bindir}" "${manifest}"
+}
+
 ensure_iptables_undecided
+ensure_verify_works
+ensure_manifest_matches
+ensure_manifest_round_trip_works
+ensure_bindir_install_works
+ensure_uninstall_works
+ensure_install_presets_work
+ensure_arp_ebtables_install_works
+ensure_copy_install_works
+ensure_hardlink_install_works
+ensure_verify_self_works
+ensure_concurrent_installs_work
+ensure_links_are_replaced_atomically
+ensure_recursion_guard_works
+ensure_no_mode_error_has_hints
+ensure_output_modes_match
+ensure_probe_env_is_applied
+ensure_detect_timeout_is_applied
+ensure_forced_mode_works
+ensure_unknown_applets_are_refused
+ensure_path_works
+ensure_mode_cache_works
+ensure_bad_versions_are_refused
+ensure_verify_image_works
+ensure_firewalld_is_detected
+ensure_child_output_is_redirected
+ensure_post_switch_hook_works
+ensure_alternatives_links_are_retargeted
+ensure_debug_dir_works
+ensure_readonly_never_writes
+ensure_mixed_families_are_gated
+ensure_forced_mode_overrides_families
+ensure_nft_ruleset_is_weighed
 
-# Initialize the chosen iptables mode with just a hint chain
-iptables-${mode} -t mangle -N KUBE-IPTABLES-HINT
+# Initialize the chosen iptables mode with just the scenario's kubelet chain
+case "${scenario}" in
+    hint)
+        iptables-${mode} -t mangle -N KUBE-IPTABLES-HINT
+        ;;
+    canary)
+        iptables-${mode} -t mangle -N KUBE-KUBELET-CANARY
+        ;;
+    ipv6)
+        ip6tables-${mode} -t mangle -N KUBE-IPTABLES-HINT
+        ;;
+    mixed)
+        iptables-${mode} -t nat -N KUBE-KUBELET-CANARY
+        iptables-${mode} -t nat -N KUBE-SERVICES
+        ip6tables-${mode} -t filter -N KUBE-KUBELET-CANARY
+        iptables-${wrongmode} -t mangle -N KUBE-IPTABLES-HINT
+        ;;
+    rules)
+        iptables-${mode} -t filter -N USER-RULES
+        for port in 22 80 443; do
+            iptables-${mode} -t filter -A USER-RULES -p tcp --dport ${port} -j ACCEPT
+        done
+        ;;
+    user)
+        if [ "${mode}" != legacy ]; then
+            echo "ERROR: the user scenario is only valid for legacy" 1>&2
+            exit 1
+        fi
+        iptables-legacy -t filter -N USER-FIREWALL
+        export IPTABLES_WRAPPER_LEGACY_HINT_CHAINS=USER-FIREWALL
+        ;;
+    tables)
+        if [ "${mode}" != nft ]; then
+            echo "ERROR: the tables scenario is only valid for nft" 1>&2
+            exit 1
+        fi
+        iptables-nft -t nat -N KUBE-KUBELET-CANARY
+        iptables-nft -t nat -N KUBE-SERVICES
+        export IPTABLES_WRAPPER_ALL_TABLES=1
+        ;;
+    split)
+        if [ -x "${sbin}/alternatives" ]; then
+            # alternatives manages ip6tables as part of iptables, so the
+            # families can't be switched independently.
+            echo "skipping the split scenario, not supported with alternatives"
+            exit 0
+        fi
+        iptables-${mode} -t mangle -N KUBE-IPTABLES-HINT
+        ip6tables-${wrongmode} -t mangle -N KUBE-IPTABLES-HINT
+        export IPTABLES_WRAPPER_INDEPENDENT_FAMILIES=1
+        ;;
+    shim)
+        iptables-${mode} -t mangle -N KUBE-IPTABLES-HINT
+        mv "${sbin}/xtables-${mode}-multi" "${sbin}/xtables-${mode}-multi.real"
+        for cmd in iptables iptables-save iptables-restore ip6tables ip6tables-save ip6tables-restore; do
+            shim="${sbin}/${cmd%%-*}-${mode}${cmd#${cmd%%-*}}"
+            rm -f "${shim}"
+            printf '#!/bin/sh\nexec %s %s "$@"\n' "${sbin}/xtables-${mode}-multi.real" "${cmd}" > "${shim}"
+            chmod +x "${shim}"
+        done
+        ;;
+    stale)
+        iptables-${mode} -t mangle -N KUBE-IPTABLES-HINT
+        iptables-${mode} -t nat -N KUBE-SERVICES
+        iptables-${mode} -t nat -N KUBE-POSTROUTING
+        iptables-${wrongmode} -t mangle -N KUBE-KUBELET-CANARY
+        ;;
+    hinted)
+        iptables-${mode} -t mangle -N KUBE-IPTABLES-HINT
+        iptables-${wrongmode} -t mangle -N KUBE-KUBELET-CANARY
+        iptables-${wrongmode} -t filter -N KUBE-PROXY-CANARY
+        ;;
+    *)
+        echo "ERROR: bad scenario '${scenario}'" 1>&2
+        exit 1
+        ;;
+esac
 
 # Put some junk in the other iptables system
 iptables-${wrongmode} -t filter -N BAD-1
@@ -80,6 +1428,93 @@ iptables-${wrongmode} -t filter -A BAD-2 -j DROP
 
 ensure_iptables_undecided
 
-iptables -L > /dev/null
+if [ "${scenario}" = canary ] && { [ -x "${sbin}/update-alternatives" ] || [ -x "${sbin}/alternatives" ]; }; then
+    # Make the alternatives commands fail, as with a corrupt alternatives
+    # database, so the wrapper has to create the symlinks itself.
+    fakebin=$(mktemp -d)
+    for cmd in alternatives update-alternatives; do
+	printf '#!/bin/sh\nexit 2\n' > "${fakebin}/${cmd}"
+	chmod +x "${fakebin}/${cmd}"
+    done
+    if ! PATH="${fakebin}:${PATH}" iptables -L 2>&1 > /dev/null | grep -q "^Warning: .*alternatives failed, creating the symlinks"; then
+	echo "the wrapper didn't fall back to symlinks when the alternatives command failed" 1>&2
+	exit 1
+    fi
+    rm -rf "${fakebin}"
+else
+    iptables -L > /dev/null
+fi
 
 ensure_iptables_resolved ${mode}
+# Once the mode is selected the commands don't point to the wrapper anymore.
+if "${sbin}/iptables-wrapper" verify > /dev/null; then
+    echo "iptables-wrapper verify passed after the mode was selected" 1>&2
+    exit 1
+fi
+if [ "${scenario}" = split ]; then
+    ensure_iptables_resolved ${wrongmode} ip6tables
+else
+    if [ "$("${sbin}/iptables-wrapper" mode)" != "${mode}" ]; then
+	echo "iptables-wrapper mode didn't print ${mode}" 1>&2
+	exit 1
+    fi
+    if ! "${sbin}/iptables-wrapper" family-check > /dev/null; then
+	echo "iptables-wrapper family-check failed with a single mode" 1>&2
+	exit 1
+    fi
+fi
+if [ "${scenario}" = hint ]; then
+    # Make the IPv6 rules disagree with the IPv4 ones.
+    ip6tables-${wrongmode} -t mangle -N KUBE-IPTABLES-HINT
+    status=0
+    "${sbin}/iptables-wrapper" family-check > /dev/null 2>&1 || status=$?
+    if [ "${status}" != 4 ]; then
+	echo "expected exit code 4 from family-check with disagreeing families, got ${status}" 1>&2
+	exit 1
+    fi
+    # The disagreement is only a warning for mode, unless told otherwise.
+    if ! "${sbin}/iptables-wrapper" mode 2>&1 | grep -q "^Warning: IPv4 rules are in"; then
+	echo "iptables-wrapper mode didn't warn about disagreeing families" 1>&2
+	exit 1
+    fi
+    if "${sbin}/iptables-wrapper" mode --warnings-as-errors > /dev/null 2>&1; then
+	echo "iptables-wrapper mode --warnings-as-errors passed with disagreeing families" 1>&2
+	exit 1
+    fi
+    if IPTABLES_WRAPPER_WARNINGS_AS_ERRORS=1 "${sbin}/iptables-wrapper" mode > /dev/null 2>&1; then
+	echo "IPTABLES_WRAPPER_WARNINGS_AS_ERRORS=1 didn't make mode fail with disagreeing families" 1>&2
+	exit 1
+    fi
+    ip6tables-${wrongmode} -t mangle -X KUBE-IPTABLES-HINT
+fi
+if [ "${scenario}" = stale ]; then
+    # The leftover canary means both modes have kubelet chains.
+    if ! "${sbin}/iptables-wrapper" mode 2>&1 | grep -q "^Warning: kubelet chains found in both modes, with [0-9]* legacy and [0-9]* nft rules"; then
+	echo "iptables-wrapper mode didn't warn about kubelet chains in both modes" 1>&2
+	exit 1
+    fi
+    if "${sbin}/iptables-wrapper" mode --strict > /dev/null 2>&1; then
+	echo "iptables-wrapper mode --strict passed with kubelet chains in both modes" 1>&2
+	exit 1
+    fi
+    if IPTABLES_WRAPPER_STRICT=1 "${sbin}/iptables-wrapper" mode > /dev/null 2>&1; then
+	echo "IPTABLES_WRAPPER_STRICT=1 didn't make mode fail with kubelet chains in both modes" 1>&2
+	exit 1
+    fi
+    if IPTABLES_STRICT=1 "${sbin}/iptables-wrapper" mode > /dev/null 2>&1; then
+	echo "IPTABLES_STRICT=1 didn't make mode fail with kubelet chains in both modes" 1>&2
+	exit 1
+    fi
+fi
+ensure_validate_rules_works
+ensure_match_regex_works
+ensure_sbin_dir_override_works
+ensure_log_level_works
+ensure_nft_kernel_support_is_detected
+ensure_applet_name_is_preserved
+ensure_stale_canaries_are_reported
+ensure_decision_socket_works
+ensure_netns_flag_works
+ensure_restore_reads_stdin
+ensure_lock_policies_work
+ensure_signals_are_forwarded
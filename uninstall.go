@@ -0,0 +1,126 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/pkg/install"
+)
+
+// uninstallCommand removes the iptables commands that are symlinks to the
+// wrapper binary or copies of it, or reverts exactly the ones listed in a
+// manifest, and removes the mode cache file.
+func uninstallCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("uninstall", flag.ContinueOnError)
+	dir := flags.String("dir", "", "folder where the iptables commands are installed (default: detected sbin folder)")
+	wrapperPath := flags.String("wrapper", "", "path to the wrapper binary (default: this binary)")
+	manifest := flags.String("manifest", "", "only revert the commands listed in this manifest, written by install --manifest or the installer script (default $"+manifestEnv+", if it exists)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *manifest != "" && (*dir != "" || *wrapperPath != "") {
+		fmt.Fprintln(os.Stderr, "Error: --manifest can't be used with --dir or --wrapper")
+		return 2
+	}
+	if *manifest == "" && *dir == "" && *wrapperPath == "" {
+		// The configured manifest is only used if an install wrote it.
+		if path := os.Getenv(manifestEnv); path != "" {
+			if _, err := os.Stat(path); err == nil {
+				*manifest = path
+			}
+		}
+	}
+
+	if *manifest != "" {
+		m, err := install.ReadManifest(*manifest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		links, err := install.NewSymlinker("", "").WithLogf(warnf).UnlinkManifest(ctx, m)
+		if status := printUnlinked(links, err); status != 0 {
+			return status
+		}
+		return removeModeCache()
+	}
+
+	if *dir == "" {
+		sbinPath, err := detectBinaryDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		*dir = sbinPath
+	}
+
+	if *wrapperPath == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: finding wrapper binary: %s\n", err)
+			return 1
+		}
+		*wrapperPath = executable
+	}
+
+	links, err := install.NewSymlinker(*dir, *wrapperPath).WithLogf(warnf).UnlinkAll(ctx)
+	if status := printUnlinked(links, err); status != 0 {
+		return status
+	}
+	return removeModeCache()
+}
+
+// printUnlinked prints the links removed by an uninstall, warns about the ones
+// skipped and returns the exit code for err.
+func printUnlinked(links []install.Link, err error) int {
+	for _, link := range links {
+		if link.Skipped != "" {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: %s\n", link.Path, link.Skipped)
+			continue
+		}
+		switch {
+		case link.Backup != "":
+			fmt.Printf("restored %s from %s\n", link.Path, link.Backup)
+		case link.Previous != "":
+			fmt.Printf("restored %s -> %s\n", link.Path, link.Previous)
+		default:
+			fmt.Printf("removed %s -> %s\n", link.Path, link.Target)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// removeModeCache removes the mode cache file, printing its path if there was
+// one, and returns the exit code. uninstall runs it since the mode the file
+// holds was selected by the wrapper that was uninstalled.
+func removeModeCache() int {
+	path, err := resetModeCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if path != "" {
+		fmt.Printf("removed %s\n", path)
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// validateRulesCommand checks a ruleset file with `iptables-restore --test`, run
+// through the multi binary of the detected mode, without applying it.
+func validateRulesCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("validate-rules", flag.ContinueOnError)
+	ipv6 := flags.Bool("6", false, "validate an IPv6 ruleset with ip6tables-restore")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Error: validate-rules expects exactly one ruleset file")
+		return 2
+	}
+
+	rules, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	defer rules.Close()
+
+	sbinPath, err := detectBinaryDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	family, applet := iptables.IPv4, "iptables-restore"
+	if *ipv6 {
+		family, applet = iptables.IPv6, "ip6tables-restore"
+	}
+	installation, err := newInstallation(sbinPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	mode, err := resolveMode(ctx, installation, installation, family, strictEnabled())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	binary, _ := iptables.ModeBinary(sbinPath, mode, applet)
+	cmd := exec.CommandContext(ctx, binary, "--test")
+	cmd.Args[0] = applet
+	cmd.Stdin = rules
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "Error: %s is not a valid ruleset for %s mode\n", flags.Arg(0), mode)
+		return 1
+	}
+
+	fmt.Printf("%s is a valid ruleset for %s mode\n", flags.Arg(0), mode)
+	return 0
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// verifyCommand checks that the wrapper has been installed correctly and is
+// ready to be invoked, e.g. from an init container before kube-proxy starts.
+func verifyCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	dir := flags.String("dir", "", "folder where the iptables commands are installed (default: detected sbin folder)")
+	wrapperPath := flags.String("wrapper", "", "path to the wrapper binary (default: this binary)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: verify doesn't accept arguments\n")
+		return 2
+	}
+
+	if *wrapperPath == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: finding wrapper binary: %s\n", err)
+			return 1
+		}
+		*wrapperPath = executable
+	}
+
+	sbinPath, sbinErr := detectBinaryDir()
+	checks := []check{{
+		name: "iptables binaries folder is found",
+		run:  func() error { return sbinErr },
+	}}
+	if *dir == "" {
+		*dir = sbinPath
+	}
+	for _, cmd := range iptables.Commands {
+		cmdPath := filepath.Join(*dir, cmd)
+		checks = append(checks, check{
+			name: cmd + " points to the wrapper",
+			run: func() error {
+				if *dir == "" {
+					return sbinErr
+				}
+				// Installing with --mode=copy or --mode=hardlink leaves copies of
+				// the wrapper or hard links to it instead.
+				if same, err := files.SameContent(cmdPath, *wrapperPath); err == nil && same {
+					return nil
+				}
+				return pointsTo(cmdPath, *wrapperPath)
+			},
+		})
+	}
+	for _, mode := range []iptables.Mode{iptables.NFT, iptables.Legacy} {
+		checks = append(checks, backendInstalledCheck(sbinPath, mode))
+	}
+
+	if !runChecks(os.Stdout, checks, false) {
+		return 1
+	}
+	return 0
+}
+
+// pointsTo checks that path resolves to the same file as target.
+func pointsTo(path, target string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	resolvedTarget, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+	if resolved != resolvedTarget {
+		return fmt.Errorf("%s points to %s", path, resolved)
+	}
+	return nil
+}
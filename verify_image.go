@@ -0,0 +1,140 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/files"
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// verifyImageCommand checks that a container image has been correctly set up
+// to use the wrapper. It's meant to be run as part of the image build.
+func verifyImageCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("verify-image", flag.ContinueOnError)
+	single := flags.String("single-backend", "", "only require the given mode (nft or legacy) to be installed")
+	warningsAsErrors := warningsAsErrorsFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	modes := []iptables.Mode{iptables.NFT, iptables.Legacy}
+	if *single != "" {
+		mode, err := iptables.ParseMode(*single)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 2
+		}
+		modes = []iptables.Mode{mode}
+	}
+
+	sbinPath, err := detectBinaryDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	installation, err := newInstallation(sbinPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	var checks []check
+	for _, cmd := range iptables.Commands {
+		cmdPath := filepath.Join(sbinPath, cmd)
+		checks = append(checks, check{
+			name: cmd + " resolves",
+			run:  func() error { return resolves(cmdPath) },
+		})
+	}
+	for _, mode := range modes {
+		mode := mode
+		checks = append(checks, backendInstalledCheck(sbinPath, mode), check{
+			name: string(mode) + " backend version is safe",
+			run:  func() error { return iptables.CheckVersion(ctx, installation, mode) },
+		})
+	}
+
+	if *single != "" {
+		checks = append(checks, check{
+			name:    "both backends are installed",
+			warning: true,
+			run: func() error {
+				for _, mode := range []iptables.Mode{iptables.NFT, iptables.Legacy} {
+					if !files.ExecutableExists(iptables.XtablesPath(sbinPath, mode)) {
+						return fmt.Errorf("only %s is required, nodes using %s mode can't be handled", *single, mode)
+					}
+				}
+				return nil
+			},
+		})
+	} else {
+		checks = append(checks, check{
+			name:    "backend versions match",
+			warning: true,
+			run: func() error {
+				nftVersion, err := installation.Version(ctx, iptables.NFT)
+				if err != nil {
+					return err
+				}
+				legacyVersion, err := installation.Version(ctx, iptables.Legacy)
+				if err != nil {
+					return err
+				}
+				if nft, legacy := iptables.VersionNumber(nftVersion), iptables.VersionNumber(legacyVersion); nft != legacy {
+					return fmt.Errorf("nft is %s but legacy is %s", nft, legacy)
+				}
+				return nil
+			},
+		})
+	}
+
+	if !runChecks(os.Stdout, checks, *warningsAsErrors) {
+		return 1
+	}
+	return 0
+}
+
+// backendInstalledCheck checks that the `xtables-<mode>-multi` binary is
+// installed in sbinPath.
+func backendInstalledCheck(sbinPath string, mode iptables.Mode) check {
+	return check{
+		name: string(mode) + " backend is installed",
+		run: func() error {
+			if !files.ExecutableExists(iptables.XtablesPath(sbinPath, mode)) {
+				return fmt.Errorf("%s is not executable", iptables.XtablesPath(sbinPath, mode))
+			}
+			return nil
+		},
+	}
+}
+
+// resolves checks that path exists and, if it's a symlink, it points to an
+// executable file.
+func resolves(path string) error {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if !files.ExecutableExists(target) {
+		return errors.New(target + " is not executable")
+	}
+	return nil
+}
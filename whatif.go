@@ -0,0 +1,181 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/kubernetes-sigs/iptables-wrappers/internal/iptables"
+)
+
+// strategyResult is the outcome of running a single mode detection strategy.
+type strategyResult struct {
+	name string
+	mode iptables.Mode
+	// details explains the result, specially when no mode was found.
+	details string
+	// warning, if set, is printed after the results.
+	warning string
+}
+
+// whatifCommand runs every detection strategy independently against the current
+// node state and prints what mode each of them would pick, along with the mode
+// the wrapper would finally select.
+func whatifCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("whatif", flag.ContinueOnError)
+	netnsPath := netnsFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: whatif doesn't accept arguments\n")
+		return 2
+	}
+
+	sbinPath, err := detectBinaryDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	installation, err := newInstallation(sbinPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if *netnsPath != "" {
+		// The probes run concurrently on other threads, so they have to enter
+		// the namespace on their own.
+		installation = installation.WithNetns(*netnsPath)
+	}
+	detector, err := newDetector(installation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	var results []strategyResult
+	if err := inNetns(*netnsPath, func() error {
+		results = strategyResults(ctx, sbinPath, installation, detector)
+		return nil
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	printStrategyResults(os.Stdout, results)
+	for _, r := range results {
+		if r.warning != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", r.warning)
+		}
+	}
+	return 0
+}
+
+// strategyResults runs every detection strategy and returns their results.
+func strategyResults(ctx context.Context, sbinPath string, installation iptables.XtablesMulti, detector iptables.Detector) []strategyResult {
+	var results []strategyResult
+
+	mode, found := detector.KubeletMode(ctx)
+	results = append(results, foundResult("kubelet-chains", mode, found, "no kubelet chains found"))
+	for _, family := range []iptables.Family{iptables.IPv4, iptables.IPv6} {
+		mode, found := detector.FamilyMode(ctx, family)
+		results = append(results, foundResult("kubelet-chains/"+string(family), mode, found, "no kubelet chains found"))
+	}
+
+	if chains := envList(legacyHintChainsEnv); len(chains) > 0 {
+		found := iptables.HasLegacyChains(ctx, installation, chains)
+		results = append(results, foundResult("legacy-hint-chains", iptables.Legacy, found, "none of the chains found in legacy"))
+	}
+
+	legacyLines, nftLines := iptables.RuleLines(ctx, installation)
+	rulesResult := strategyResult{name: "rule-lines", details: fmt.Sprintf("%d legacy rules, %d nft rules", legacyLines, nftLines)}
+	if legacyLines > nftLines {
+		rulesResult.mode = iptables.Legacy
+	} else if nftLines > legacyLines {
+		rulesResult.mode = iptables.NFT
+	}
+	results = append(results, rulesResult)
+
+	if found, err := detector.NFTRulesetHasChains(ctx, installation); err != nil {
+		results = append(results, strategyResult{name: "nft-ruleset", details: err.Error()})
+	} else {
+		results = append(results, foundResult("nft-ruleset", iptables.NFT, found, "no kubelet chains in the nft ruleset"))
+	}
+
+	if supported, reason := iptables.NewNFTKernelProbe(installation).Supported(ctx); supported {
+		results = append(results, strategyResult{name: "nft-kernel", details: "no sign of missing nf_tables support"})
+	} else {
+		results = append(results, strategyResult{name: "nft-kernel", mode: iptables.Legacy, details: reason})
+	}
+
+	if mode, found, err := iptables.ModeFromKernelCmdline(iptables.KernelCmdlinePath); err != nil {
+		results = append(results, strategyResult{name: "kernel-cmdline", details: err.Error()})
+	} else {
+		results = append(results, foundResult("kernel-cmdline", mode, found, "no iptables_wrapper.mode parameter"))
+	}
+
+	if mode, err := iptables.CurrentMode(filepath.Join(sbinPath, "iptables")); err != nil {
+		results = append(results, strategyResult{name: "current-alternative", details: err.Error()})
+	} else {
+		results = append(results, strategyResult{name: "current-alternative", mode: mode})
+	}
+
+	for _, canaries := range iptables.FindCanaryChains(ctx, installation) {
+		result := strategyResult{
+			name:    fmt.Sprintf("canary-chains/%s/%s", canaries.Mode, canaries.Family),
+			details: fmt.Sprintf("%d canary chains, %d other kubelet chains", canaries.Canaries, canaries.OtherChains),
+		}
+		if canaries.Stale() {
+			result.details += ", possibly stale"
+			result.warning = fmt.Sprintf("the %s %s rules only have canary chains, they might be leftovers misleading the detection", canaries.Mode, canaries.Family)
+		}
+		results = append(results, result)
+	}
+
+	if mode, err := resolveMode(ctx, installation, installation, "", strictEnabled()); err != nil {
+		results = append(results, strategyResult{name: "selected", details: err.Error()})
+	} else {
+		results = append(results, strategyResult{name: "selected", mode: mode, details: "with the current environment configuration"})
+	}
+
+	return results
+}
+
+// foundResult builds the strategyResult of a strategy that might not find any mode.
+func foundResult(name string, mode iptables.Mode, found bool, notFoundDetails string) strategyResult {
+	if !found {
+		return strategyResult{name: name, details: notFoundDetails}
+	}
+	return strategyResult{name: name, mode: mode}
+}
+
+// printStrategyResults prints the results as a table.
+func printStrategyResults(out io.Writer, results []strategyResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STRATEGY\tMODE\tDETAILS")
+	for _, r := range results {
+		mode := string(r.mode)
+		if mode == "" {
+			mode = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.name, mode, r.details)
+	}
+	_ = w.Flush()
+}